@@ -0,0 +1,230 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// PortRange an inclusive range of ports. It decodes from a number, "25" or "6881-6889".
+type PortRange struct {
+	From uint16
+	To   uint16
+}
+
+// Contains report whether port is in the range
+func (r PortRange) Contains(port uint16) bool {
+	return port >= r.From && port <= r.To
+}
+
+func (r PortRange) String() string {
+	if r.From == r.To {
+		return strconv.Itoa(int(r.From))
+	}
+	return fmt.Sprintf("%d-%d", r.From, r.To)
+}
+
+func (r PortRange) MarshalJSON() ([]byte, error) {
+	if r.From == r.To {
+		return []byte(r.String()), nil
+	}
+	return json.Marshal(r.String())
+}
+
+func (r *PortRange) UnmarshalJSON(data []byte) error {
+	text := string(bytes.Trim(data, `"`))
+	from, to, isRange := strings.Cut(text, "-")
+	if !isRange {
+		to = from
+	}
+	first, err := strconv.ParseUint(strings.TrimSpace(from), 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port range %s", data)
+	}
+	last, err := strconv.ParseUint(strings.TrimSpace(to), 10, 16)
+	if err != nil || last < first {
+		return fmt.Errorf("invalid port range %s", data)
+	}
+	r.From, r.To = uint16(first), uint16(last)
+	return nil
+}
+
+// Destination what the proxy core knows of a connection. Domain and IP may both
+// be set, e.g. a sniffed domain and the address it resolved to.
+type Destination struct {
+	Domain   string
+	IP       netip.Addr
+	Port     uint16
+	Protocol string
+}
+
+// ParseDestination split a host:port target into a Destination
+func ParseDestination(target string) (Destination, error) {
+	host, portText, err := net.SplitHostPort(target)
+	if err != nil {
+		return Destination{}, NewInvalidInputError(fmt.Sprintf("invalid destination %q", target), err)
+	}
+	port, err := strconv.ParseUint(portText, 10, 16)
+	if err != nil {
+		return Destination{}, NewInvalidInputError(fmt.Sprintf("invalid port in %q", target), err)
+	}
+	dest := Destination{Port: uint16(port)}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		dest.IP = ip
+	} else {
+		dest.Domain = host
+	}
+	return dest, nil
+}
+
+// AuditMatcher matches connections against a set of audit rules. Domains and
+// networks are indexed so they cost a few map lookups whatever the number of
+// rules, keyword rules are checked one by one. It is immutable and safe for
+// concurrent use, build a new one when the rules change.
+type AuditMatcher struct {
+	rules []AuditRule
+	// domains rule indexes by domain, matched against every suffix of a host
+	domains map[string][]int
+	// fullDomains rule indexes by exact domain
+	fullDomains map[string][]int
+	keywords    []indexedString
+	// networks rule indexes by masked prefix, bits lists the prefix lengths in use
+	networks map[netip.Prefix][]int
+	bits     []int
+	// anyDestination rules without domain or network criteria
+	anyDestination []int
+	// protocols lower cased protocols of each rule
+	protocols [][]string
+}
+
+type indexedString struct {
+	value string
+	rule  int
+}
+
+// NewAuditMatcher index rules. Rules earlier in the list win when several match.
+func NewAuditMatcher(rules []AuditRule) *AuditMatcher {
+	m := &AuditMatcher{
+		rules:       slices.Clone(rules),
+		domains:     make(map[string][]int),
+		fullDomains: make(map[string][]int),
+		networks:    make(map[netip.Prefix][]int),
+		protocols:   make([][]string, len(rules)),
+	}
+	for i, rule := range m.rules {
+		for _, protocol := range rule.Protocols {
+			m.protocols[i] = append(m.protocols[i], strings.ToLower(protocol))
+		}
+		if len(rule.Domains) == 0 && len(rule.CIDRs) == 0 {
+			if len(rule.Ports) > 0 || len(rule.Protocols) > 0 {
+				m.anyDestination = append(m.anyDestination, i)
+			}
+			continue
+		}
+		for _, domain := range rule.Domains {
+			switch {
+			case strings.HasPrefix(domain, "full:"):
+				domain = normalizeDomain(strings.TrimPrefix(domain, "full:"))
+				m.fullDomains[domain] = append(m.fullDomains[domain], i)
+			case strings.HasPrefix(domain, "keyword:"):
+				keyword := normalizeDomain(strings.TrimPrefix(domain, "keyword:"))
+				m.keywords = append(m.keywords, indexedString{value: keyword, rule: i})
+			default:
+				domain = normalizeDomain(strings.TrimPrefix(domain, "domain:"))
+				m.domains[domain] = append(m.domains[domain], i)
+			}
+		}
+		for _, prefix := range rule.CIDRs {
+			if !prefix.IsValid() {
+				continue
+			}
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefixBits(prefix)).Masked()
+			m.networks[prefix] = append(m.networks[prefix], i)
+			if !slices.Contains(m.bits, prefix.Bits()) {
+				m.bits = append(m.bits, prefix.Bits())
+			}
+		}
+	}
+	return m
+}
+
+// prefixBits the length of prefix once its address is unmapped to IPv4
+func prefixBits(prefix netip.Prefix) int {
+	if prefix.Addr().Is4In6() {
+		return max(prefix.Bits()-96, 0)
+	}
+	return prefix.Bits()
+}
+
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+}
+
+// Len number of rules
+func (m *AuditMatcher) Len() int {
+	return len(m.rules)
+}
+
+// Match return the first rule dest hits
+func (m *AuditMatcher) Match(dest Destination) (AuditRule, bool) {
+	dest.Protocol = strings.ToLower(dest.Protocol)
+	best := -1
+	if dest.Domain != "" {
+		domain := normalizeDomain(dest.Domain)
+		best = m.first(best, m.fullDomains[domain], dest)
+		for suffix := domain; ; {
+			best = m.first(best, m.domains[suffix], dest)
+			_, rest, ok := strings.Cut(suffix, ".")
+			if !ok {
+				break
+			}
+			suffix = rest
+		}
+		for _, keyword := range m.keywords {
+			if (best < 0 || keyword.rule < best) && strings.Contains(domain, keyword.value) && m.matchRest(keyword.rule, dest) {
+				best = keyword.rule
+			}
+		}
+	}
+	if dest.IP.IsValid() {
+		ip := dest.IP.Unmap().WithZone("")
+		for _, bits := range m.bits {
+			if prefix, err := ip.Prefix(bits); err == nil {
+				best = m.first(best, m.networks[prefix], dest)
+			}
+		}
+	}
+	best = m.first(best, m.anyDestination, dest)
+
+	if best < 0 {
+		return AuditRule{}, false
+	}
+	return m.rules[best], true
+}
+
+// first the lowest of best and the candidates matching the rest of dest, -1 for none
+func (m *AuditMatcher) first(best int, candidates []int, dest Destination) int {
+	for _, i := range candidates {
+		if (best < 0 || i < best) && m.matchRest(i, dest) {
+			best = i
+		}
+	}
+	return best
+}
+
+// matchRest check the port and protocol criteria of rule i, dest.Protocol is lower cased
+func (m *AuditMatcher) matchRest(i int, dest Destination) bool {
+	rule := &m.rules[i]
+	if len(rule.Ports) > 0 && !slices.ContainsFunc(rule.Ports, func(r PortRange) bool { return r.Contains(dest.Port) }) {
+		return false
+	}
+	if len(m.protocols[i]) > 0 && !slices.Contains(m.protocols[i], dest.Protocol) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,241 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPortRangeJSON(t *testing.T) {
+	tests := []struct {
+		body    string
+		want    PortRange
+		wantErr bool
+	}{
+		{`25`, PortRange{25, 25}, false},
+		{`"465"`, PortRange{465, 465}, false},
+		{`"6881-6889"`, PortRange{6881, 6889}, false},
+		{`"6889-6881"`, PortRange{}, true},
+		{`"smtp"`, PortRange{}, true},
+		{`70000`, PortRange{}, true},
+	}
+	for _, tt := range tests {
+		var got PortRange
+		err := json.Unmarshal([]byte(tt.body), &got)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("Unmarshal(%s) = %v, %v, want %v, error %v", tt.body, got, err, tt.want, tt.wantErr)
+		}
+	}
+
+	data, err := json.Marshal([]PortRange{{25, 25}, {6881, 6889}})
+	if err != nil || string(data) != `[25,"6881-6889"]` {
+		t.Fatalf("Unexpected encoding %s %v", data, err)
+	}
+}
+
+var testAuditRules = []AuditRule{
+	{ID: 1, Name: "abuse", Domains: []string{"abuse.example", "full:exact.example", "keyword:torrent"}},
+	{ID: 2, Name: "smtp", Ports: []PortRange{{25, 25}, {465, 465}, {587, 587}}},
+	{ID: 3, Name: "bittorrent", Protocols: []string{"BitTorrent"}},
+	{ID: 4, Name: "blocked networks", CIDRs: []netip.Prefix{
+		netip.MustParsePrefix("10.1.0.0/16"),
+		netip.MustParsePrefix("2001:db8::/32"),
+		netip.MustParsePrefix("::ffff:192.0.2.0/120"),
+	}},
+	{ID: 5, Name: "tracker port", Domains: []string{"tracker.example"}, Ports: []PortRange{{6881, 6889}}},
+	{ID: 6, Name: "empty"},
+}
+
+func TestAuditMatcher(t *testing.T) {
+	m := NewAuditMatcher(testAuditRules)
+	tests := []struct {
+		name string
+		dest Destination
+		want int
+	}{
+		{"domain suffix", Destination{Domain: "www.Abuse.Example.", Port: 443}, 1},
+		{"domain itself", Destination{Domain: "abuse.example", Port: 443}, 1},
+		{"not a suffix", Destination{Domain: "notabuse.example", Port: 443}, 0},
+		{"full domain", Destination{Domain: "exact.example", Port: 443}, 1},
+		{"full domain subdomain", Destination{Domain: "www.exact.example", Port: 443}, 0},
+		{"keyword", Destination{Domain: "mytorrents.org", Port: 443}, 1},
+		{"port only rule", Destination{Domain: "mail.example", Port: 587}, 2},
+		{"earlier rule wins", Destination{Domain: "abuse.example", Port: 25}, 1},
+		{"protocol", Destination{IP: netip.MustParseAddr("8.8.8.8"), Port: 51413, Protocol: "bittorrent"}, 3},
+		{"ipv4 network", Destination{IP: netip.MustParseAddr("10.1.2.3"), Port: 443}, 4},
+		{"mapped ipv4", Destination{IP: netip.MustParseAddr("::ffff:10.1.2.3"), Port: 443}, 4},
+		{"mapped rule", Destination{IP: netip.MustParseAddr("192.0.2.7"), Port: 443}, 4},
+		{"ipv6 network", Destination{IP: netip.MustParseAddr("2001:db8::1"), Port: 443}, 4},
+		{"outside network", Destination{IP: netip.MustParseAddr("10.2.0.1"), Port: 443}, 0},
+		{"domain and port", Destination{Domain: "tracker.example", Port: 6885}, 5},
+		{"domain without port", Destination{Domain: "tracker.example", Port: 443}, 0},
+		{"domain or network", Destination{Domain: "cdn.example", IP: netip.MustParseAddr("10.1.0.1"), Port: 443}, 4},
+		{"clean", Destination{Domain: "example.com", IP: netip.MustParseAddr("93.184.216.34"), Port: 443}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, ok := m.Match(tt.dest)
+			if ok != (tt.want != 0) || rule.ID != tt.want {
+				t.Fatalf("Match(%+v) = %d %v, want rule %d", tt.dest, rule.ID, ok, tt.want)
+			}
+		})
+	}
+	if m.Len() != len(testAuditRules) {
+		t.Fatalf("Expected %d rules, got %d", len(testAuditRules), m.Len())
+	}
+}
+
+func TestParseDestination(t *testing.T) {
+	dest, err := ParseDestination("[2001:db8::1]:443")
+	if err != nil || dest.IP != netip.MustParseAddr("2001:db8::1") || dest.Port != 443 || dest.Domain != "" {
+		t.Fatalf("Unexpected destination %+v %v", dest, err)
+	}
+	dest, err = ParseDestination("example.com:25")
+	if err != nil || dest.Domain != "example.com" || dest.Port != 25 || dest.IP.IsValid() {
+		t.Fatalf("Unexpected destination %+v %v", dest, err)
+	}
+	if _, err := ParseDestination("example.com"); err == nil {
+		t.Fatalf("Expected an error without port")
+	}
+	if _, err := ParseDestination("example.com:http"); err == nil {
+		t.Fatalf("Expected an error for a named port")
+	}
+}
+
+func TestAuditRules(t *testing.T) {
+	var nodeId string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nodeId = r.URL.Query().Get("node_id")
+		if r.Header.Get("If-None-Match") == `"r1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"r1"`)
+		_, _ = w.Write([]byte(`{"message":"ok","data":[
+			{"id":1,"name":"smtp","ports":[25,"465","6881-6889"]},
+			{"id":2,"domains":["abuse.example"],"cidrs":["10.0.0.0/8"]}
+		]}`))
+	}))
+	t.Cleanup(server.Close)
+	client := newTestClient(t, server.URL)
+	ctx := context.Background()
+
+	rules, err := client.AuditRules(ctx, 7, Trojan)
+	if err != nil {
+		t.Fatalf("AuditRules() unexpected error: %v", err)
+	}
+	if nodeId != "7" {
+		t.Fatalf("Expected node_id 7, got %q", nodeId)
+	}
+	if len(rules) != 2 || rules[0].Ports[2] != (PortRange{6881, 6889}) || rules[1].CIDRs[0] != netip.MustParsePrefix("10.0.0.0/8") {
+		t.Fatalf("Unexpected rules %+v", rules)
+	}
+
+	if _, err := client.AuditRules(ctx, 7, Trojan); !errors.Is(err, ErrorAuditRulesNotModified) {
+		t.Fatalf("Expected not modified, got %v", err)
+	}
+	// the ETag is kept per node
+	if _, err := client.AuditRules(ctx, 8, Trojan); err != nil {
+		t.Fatalf("Expected rules for another node, got %v", err)
+	}
+}
+
+func TestAuditRulesInvalid(t *testing.T) {
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if r.Header.Get("If-None-Match") != "" {
+			t.Errorf("Expected no ETag after an invalid response, got %q", r.Header.Get("If-None-Match"))
+		}
+		w.Header().Set("ETag", `"bad"`)
+		_, _ = w.Write([]byte(`{"data":[{"id":1,"cidrs":["10.0.0.1"]}]}`))
+	}))
+	t.Cleanup(server.Close)
+	client := newTestClient(t, server.URL)
+
+	for i := 0; i < 2; i++ {
+		_, err := client.AuditRules(context.Background(), 1, Trojan)
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) || !apiErr.IsParseError() {
+			t.Fatalf("Expected a parse error, got %v", err)
+		}
+	}
+	if hits.Load() != 2 {
+		t.Fatalf("Expected 2 requests, got %d", hits.Load())
+	}
+}
+
+func TestSubmitViolations(t *testing.T) {
+	var (
+		hits atomic.Int32
+		body struct {
+			RegisterId string      `json:"register_id"`
+			Data       []Violation `json:"data"`
+		}
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) > 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.URL.Path != "/api/v1/server/enhanced/trojan/submitViolations" {
+			t.Errorf("Unexpected path %s", r.URL.Path)
+		}
+		raw, _ := io.ReadAll(r.Body)
+		_ = json.Unmarshal(raw, &body)
+		_, _ = w.Write([]byte(`{"data":true,"message":"success"}`))
+	}))
+	t.Cleanup(server.Close)
+	client := newTestClientWith(t, server.URL, Config{
+		Retry: &RetryPolicy{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+	})
+	ctx := context.Background()
+
+	violations := []Violation{{UID: 1, RuleID: 2, Target: "smtp.example:25", Timestamp: 1700000000}}
+	if err := client.SubmitViolations(ctx, "test-register-id", Trojan, violations); err != nil {
+		t.Fatalf("SubmitViolations() unexpected error: %v", err)
+	}
+	if body.RegisterId != "test-register-id" || len(body.Data) != 1 || body.Data[0] != violations[0] {
+		t.Fatalf("Unexpected body %+v", body)
+	}
+
+	if err := client.SubmitViolations(ctx, "test-register-id", Trojan, nil); err != nil || hits.Load() != 1 {
+		t.Fatalf("Expected nothing sent for no violations, got %v after %d requests", err, hits.Load())
+	}
+
+	// violations are not retried, the panel would count them twice
+	if err := client.SubmitViolations(ctx, "test-register-id", Trojan, violations); err == nil {
+		t.Fatalf("Expected the 503 error")
+	}
+	if hits.Load() != 2 {
+		t.Fatalf("Expected no retry, got %d requests", hits.Load())
+	}
+}
+
+func BenchmarkAuditMatcher(b *testing.B) {
+	rules := make([]AuditRule, 0, 10000)
+	for i := 0; i < 5000; i++ {
+		rules = append(rules, AuditRule{ID: i, Domains: []string{fmt.Sprintf("abuse%d.example", i)}})
+		rules = append(rules, AuditRule{ID: 5000 + i, CIDRs: []netip.Prefix{
+			netip.PrefixFrom(netip.AddrFrom4([4]byte{10, byte(i >> 8), byte(i), 0}), 24),
+		}})
+	}
+	rules = append(rules, AuditRule{ID: 10000, Ports: []PortRange{{25, 25}}})
+	m := NewAuditMatcher(rules)
+	dest := Destination{Domain: "www.cdn.example.com", IP: netip.MustParseAddr("93.184.216.34"), Port: 443}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok := m.Match(dest); ok {
+			b.Fatal("Unexpected match")
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	resty "github.com/go-resty/resty/v2"
+)
+
+const (
+	heartbeatBatchPath = "/api/v1/server/enhanced/batch/heartbeat"
+	usersBatchPath     = "/api/v1/server/enhanced/batch/users"
+)
+
+// bulkRetryAfter how long a bulk or delta route the panel answered 404 for is
+// replaced by the calls it saves before it is tried again
+const bulkRetryAfter = 10 * time.Minute
+
+// batchItem per-node result of a bulk call. Status is the HTTP status the
+// per-node call would have answered, an error item carries the error envelope.
+type batchItem struct {
+	NodeId     NodeId   `json:"node_id"`
+	NodeType   NodeType `json:"node_type"`
+	RegisterId string   `json:"register_id"`
+	Status     int      `json:"status"`
+	ETag       string   `json:"etag"`
+	Users      []User   `json:"users"`
+
+	raw json.RawMessage
+}
+
+// err the error of the node, nil on success
+func (item *batchItem) err(url string) error {
+	switch {
+	case item.Status == 304:
+		return ErrorUserNotModified
+	case item.Status >= 400:
+		return NewAPIErrorFromResponse(item.Status, item.raw, url)
+	}
+	return nil
+}
+
+// HeartbeatBatch send the heartbeats of many nodes in one request. The
+// result maps each register id to the error of its node, nil on success.
+// When the panel has no bulk route, one Heartbeat per node is sent instead.
+// The returned error reports a failure of the whole request.
+func (c *Client) HeartbeatBatch(ctx context.Context, beats []NodeHeartbeat) (map[string]error, error) {
+	results := make(map[string]error, len(beats))
+	if len(beats) == 0 {
+		return results, nil
+	}
+	if !c.bulkAvailable(heartbeatBatchPath) {
+		return c.heartbeatEach(ctx, beats, results), nil
+	}
+	items, url, err := c.bulk(ctx, OpHeartbeatBatch, heartbeatBatchPath, beats)
+	if c.bulkMissingRoute(heartbeatBatchPath, err) {
+		return c.heartbeatEach(ctx, beats, results), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	byId := make(map[string]*batchItem, len(items))
+	for _, item := range items {
+		byId[item.RegisterId] = item
+	}
+	for _, beat := range beats {
+		item, ok := byId[beat.RegisterId]
+		if !ok {
+			results[beat.RegisterId] = NewParseError("node missing from batch response", fmt.Errorf("register id %s", beat.RegisterId))
+			continue
+		}
+		results[beat.RegisterId] = item.err(url)
+	}
+	return results, nil
+}
+
+func (c *Client) heartbeatEach(ctx context.Context, beats []NodeHeartbeat, results map[string]error) map[string]error {
+	for _, beat := range beats {
+		results[beat.RegisterId] = c.Heartbeat(ctx, beat.RegisterId, beat.NodeType, beat.NodeIp)
+	}
+	return results
+}
+
+// UsersBatch fetch the users of many nodes in one request. ETags are kept
+// per node and shared with RawUsersByNodeId, so a node whose users have not
+// changed gets ErrorUserNotModified in its NodeUsers. When the panel has no
+// bulk route, UsersByNodeId is called for each node instead. The returned
+// error reports a failure of the whole request.
+func (c *Client) UsersBatch(ctx context.Context, nodes []NodeKey) (map[NodeKey]NodeUsers, error) {
+	results := make(map[NodeKey]NodeUsers, len(nodes))
+	if len(nodes) == 0 {
+		return results, nil
+	}
+	if !c.bulkAvailable(usersBatchPath) {
+		return c.usersEach(ctx, nodes, results), nil
+	}
+
+	type usersRequest struct {
+		NodeKey
+		ETag string `json:"etag,omitempty"`
+	}
+	requests := make([]usersRequest, len(nodes))
+	for i, node := range nodes {
+		requests[i].NodeKey = node
+		if value, ok := c.eTags.Load(usersByNodeETagKey(node)); ok {
+			requests[i].ETag = value.(string)
+		}
+	}
+	items, url, err := c.bulk(ctx, OpUsersBatch, usersBatchPath, requests)
+	if c.bulkMissingRoute(usersBatchPath, err) {
+		return c.usersEach(ctx, nodes, results), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	byNode := make(map[NodeKey]*batchItem, len(items))
+	for _, item := range items {
+		byNode[NodeKey{NodeId: item.NodeId, NodeType: NodeType(item.NodeType.String())}] = item
+	}
+	for _, node := range nodes {
+		item, ok := byNode[NodeKey{NodeId: node.NodeId, NodeType: NodeType(node.NodeType.String())}]
+		if !ok {
+			results[node] = NodeUsers{Err: NewParseError("node missing from batch response", fmt.Errorf("node %s/%d", node.NodeType, node.NodeId))}
+			continue
+		}
+		if err := item.err(url); err != nil {
+			results[node] = NodeUsers{Err: err}
+			continue
+		}
+		c.eTags.Store(usersByNodeETagKey(node), item.ETag)
+		results[node] = NodeUsers{Users: item.Users}
+	}
+	return results, nil
+}
+
+func (c *Client) usersEach(ctx context.Context, nodes []NodeKey, results map[NodeKey]NodeUsers) map[NodeKey]NodeUsers {
+	for _, node := range nodes {
+		users, err := c.UsersByNodeId(ctx, node.NodeId, node.NodeType)
+		var list []User
+		if users != nil {
+			list = *users
+		}
+		results[node] = NodeUsers{Users: list, Err: err}
+	}
+	return results
+}
+
+// usersByNodeETagKey the ETag key RawUsersByNodeId uses for node
+func usersByNodeETagKey(node NodeKey) string {
+	return fmt.Sprintf("users_%s_%d", node.NodeType, node.NodeId)
+}
+
+// bulk post items to a bulk route and decode the per-node results
+func (c *Client) bulk(ctx context.Context, name string, path string, items any) ([]*batchItem, string, error) {
+	body := map[string]any{"data": items}
+	payload, err := c.encodeBody(body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	op := operation{name: name}
+	res, url, err := c.execute(ctx, op, resty.MethodPost, path, func(r *resty.Request) {
+		r.ForceContentType("application/json")
+		payload.apply(r)
+	})
+	if err != nil {
+		return nil, url, requestError(url, err)
+	}
+
+	if res.StatusCode() >= 400 {
+		respBody := res.Body()
+		return nil, url, NewAPIErrorFromResponse(res.StatusCode(), respBody, url)
+	}
+
+	var resp struct {
+		Data []json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(res.Body(), &resp); err != nil {
+		return nil, url, NewParseError("parse response failed", err)
+	}
+	if resp.Data == nil {
+		return nil, url, NewParseError("parse response failed", errors.New("missing data"))
+	}
+	results := make([]*batchItem, 0, len(resp.Data))
+	for _, raw := range resp.Data {
+		item := &batchItem{raw: raw}
+		if err := json.Unmarshal(raw, item); err != nil {
+			return nil, url, NewParseError("parse response failed", err)
+		}
+		results = append(results, item)
+	}
+	return results, url, nil
+}
+
+// bulkAvailable report whether path may be tried, it is skipped for
+// bulkRetryAfter after the panel answered 404 for it
+func (c *Client) bulkAvailable(path string) bool {
+	value, ok := c.bulkMissing.Load(path)
+	if !ok {
+		return true
+	}
+	if time.Since(value.(time.Time)) < bulkRetryAfter {
+		return false
+	}
+	c.bulkMissing.Delete(path)
+	return true
+}
+
+// bulkMissingRoute report whether err means the panel has no route at path,
+// a 404 without error code, and remember it
+func (c *Client) bulkMissingRoute(path string, err error) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != 404 || apiErr.Code != "" {
+		return false
+	}
+	c.bulkMissing.Store(path, time.Now())
+	return true
+}
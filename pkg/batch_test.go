@@ -0,0 +1,211 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHeartbeatBatch(t *testing.T) {
+	var got []NodeHeartbeat
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != heartbeatBatchPath {
+			t.Errorf("Unexpected path %s", r.URL.Path)
+		}
+		var body struct {
+			Data []NodeHeartbeat `json:"data"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		got = body.Data
+		_, _ = w.Write([]byte(`{"data":[
+			{"register_id":"a","status":200},
+			{"register_id":"b","status":400,"message":"register expired","code":"register_expired"}
+		]}`))
+	}))
+	t.Cleanup(server.Close)
+	client := newTestClient(t, server.URL)
+
+	results, err := client.HeartbeatBatch(context.Background(), []NodeHeartbeat{
+		{RegisterId: "a", NodeType: Trojan, NodeIp: "1.2.3.4"},
+		{RegisterId: "b", NodeType: VMess},
+		{RegisterId: "c", NodeType: VMess},
+	})
+	if err != nil {
+		t.Fatalf("HeartbeatBatch() unexpected error: %v", err)
+	}
+	if len(got) != 3 || got[0].NodeIp != "1.2.3.4" || got[1].NodeType != VMess {
+		t.Fatalf("Unexpected request %+v", got)
+	}
+	if results["a"] != nil {
+		t.Fatalf("Expected node a to succeed, got %v", results["a"])
+	}
+	if !errors.Is(results["b"], ErrRegisterExpired) {
+		t.Fatalf("Expected node b expired, got %v", results["b"])
+	}
+	var apiErr *APIError
+	if !errors.As(results["c"], &apiErr) || !apiErr.IsParseError() {
+		t.Fatalf("Expected a parse error for the missing node, got %v", results["c"])
+	}
+}
+
+func TestHeartbeatBatchFallback(t *testing.T) {
+	var bulk, single atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == heartbeatBatchPath {
+			bulk.Add(1)
+			http.NotFound(w, r)
+			return
+		}
+		single.Add(1)
+		if strings.HasPrefix(r.URL.Path, "/api/v1/server/enhanced/vmess/") {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"message":"register expired","code":"register_expired"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"data":true}`))
+	}))
+	t.Cleanup(server.Close)
+	client := newTestClient(t, server.URL)
+	beats := []NodeHeartbeat{{RegisterId: "a", NodeType: Trojan}, {RegisterId: "b", NodeType: VMess}}
+
+	for range 2 {
+		results, err := client.HeartbeatBatch(context.Background(), beats)
+		if err != nil {
+			t.Fatalf("HeartbeatBatch() unexpected error: %v", err)
+		}
+		if results["a"] != nil || !errors.Is(results["b"], ErrRegisterExpired) {
+			t.Fatalf("Unexpected per-node results %v", results)
+		}
+	}
+	if bulk.Load() != 1 || single.Load() != 4 {
+		t.Fatalf("Expected the bulk route tried once, got %d bulk and %d single calls", bulk.Load(), single.Load())
+	}
+
+	// probed again once the route may have been deployed
+	client.bulkMissing.Store(heartbeatBatchPath, time.Now().Add(-bulkRetryAfter))
+	if _, err := client.HeartbeatBatch(context.Background(), beats); err != nil {
+		t.Fatalf("HeartbeatBatch() unexpected error: %v", err)
+	}
+	if bulk.Load() != 2 {
+		t.Fatalf("Expected the bulk route probed again, got %d", bulk.Load())
+	}
+}
+
+func TestHeartbeatBatchError(t *testing.T) {
+	server := newTestServer(t, http.StatusNotFound, map[string]any{"message": "node not found", "code": "node_not_found"})
+	client := newTestClient(t, server.URL)
+	_, err := client.HeartbeatBatch(context.Background(), []NodeHeartbeat{{RegisterId: "a", NodeType: Trojan}})
+	if !errors.Is(err, ErrNodeNotFound) {
+		t.Fatalf("Expected a coded 404 to fail the request, got %v", err)
+	}
+	if !client.bulkAvailable(heartbeatBatchPath) {
+		t.Fatalf("Expected a coded 404 not to disable the bulk route")
+	}
+}
+
+func TestUsersBatch(t *testing.T) {
+	type nodeRequest struct {
+		NodeId   NodeId   `json:"node_id"`
+		NodeType NodeType `json:"node_type"`
+		ETag     string   `json:"etag"`
+	}
+	var requests [][]nodeRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Data []nodeRequest `json:"data"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		requests = append(requests, body.Data)
+		items := make([]map[string]any, 0, len(body.Data))
+		for _, node := range body.Data {
+			item := map[string]any{"node_id": node.NodeId, "node_type": node.NodeType}
+			switch {
+			case node.NodeId == 3:
+				item["status"] = 404
+				item["message"] = "node not found"
+				item["code"] = "node_not_found"
+			case node.ETag == `"v1"`:
+				item["status"] = 304
+			default:
+				item["status"] = 200
+				item["etag"] = `"v1"`
+				item["users"] = []map[string]any{{"id": int(node.NodeId), "uuid": "u"}}
+			}
+			items = append(items, item)
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"data": items})
+	}))
+	t.Cleanup(server.Close)
+	client := newTestClient(t, server.URL)
+	nodes := []NodeKey{{NodeId: 1, NodeType: Trojan}, {NodeId: 2, NodeType: VMess}, {NodeId: 3, NodeType: VMess}}
+
+	results, err := client.UsersBatch(context.Background(), nodes)
+	if err != nil {
+		t.Fatalf("UsersBatch() unexpected error: %v", err)
+	}
+	if got := results[nodes[1]]; got.Err != nil || len(got.Users) != 1 || got.Users[0].ID != 2 {
+		t.Fatalf("Unexpected users of node 2: %+v", got)
+	}
+	if !errors.Is(results[nodes[2]].Err, ErrNodeNotFound) {
+		t.Fatalf("Expected node 3 not found, got %v", results[nodes[2]].Err)
+	}
+
+	results, err = client.UsersBatch(context.Background(), nodes)
+	if err != nil {
+		t.Fatalf("UsersBatch() unexpected error: %v", err)
+	}
+	if requests[1][0].ETag != `"v1"` || requests[1][2].ETag != "" {
+		t.Fatalf("Expected the per-node ETags sent, got %+v", requests[1])
+	}
+	if !errors.Is(results[nodes[0]].Err, ErrorUserNotModified) {
+		t.Fatalf("Expected node 1 not modified, got %+v", results[nodes[0]])
+	}
+
+	// the ETags are shared with the per-node call
+	if value, ok := client.eTags.Load("users_trojan_1"); !ok || value != `"v1"` {
+		t.Fatalf("Expected the ETag under the per-node key, got %v", value)
+	}
+}
+
+func TestUsersBatchFallback(t *testing.T) {
+	var bulk atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == usersBatchPath {
+			bulk.Add(1)
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte(`{"data":[{"id":1,"uuid":"a"},{"id":2,"uuid":"b"}]}`))
+	}))
+	t.Cleanup(server.Close)
+	client := newTestClient(t, server.URL)
+	nodes := []NodeKey{{NodeId: 1, NodeType: Trojan}, {NodeId: 2, NodeType: Trojan}}
+
+	results, err := client.UsersBatch(context.Background(), nodes)
+	if err != nil {
+		t.Fatalf("UsersBatch() unexpected error: %v", err)
+	}
+	for _, node := range nodes {
+		if got := results[node]; got.Err != nil || len(got.Users) != 2 {
+			t.Fatalf("Unexpected users of node %d: %+v", node.NodeId, got)
+		}
+	}
+	results, err = client.UsersBatch(context.Background(), nodes)
+	if err != nil || !errors.Is(results[nodes[0]].Err, ErrorUserNotModified) {
+		t.Fatalf("Expected the per-node ETags used, got %+v %v", results, err)
+	}
+	if bulk.Load() != 1 {
+		t.Fatalf("Expected the bulk route tried once, got %d", bulk.Load())
+	}
+}
@@ -0,0 +1,217 @@
+package pkg
+
+import (
+	"sync"
+	"time"
+)
+
+// BreakerState state of a circuit breaker
+type BreakerState int
+
+const (
+	// BreakerClosed requests flow normally and failures are counted
+	BreakerClosed BreakerState = iota
+	// BreakerOpen requests fail fast with ErrorTypeCircuitOpen until the cool-down ends
+	BreakerOpen
+	// BreakerHalfOpen a limited number of probe requests decide whether to close again
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// BreakerScope selects what a circuit breaker guards
+type BreakerScope int
+
+const (
+	// BreakerPerHost one breaker per panel host
+	BreakerPerHost BreakerScope = iota
+	// BreakerPerEndpoint one breaker per host and operation
+	BreakerPerEndpoint
+)
+
+// CircuitBreakerConfig circuit breaker options, zero fields use the defaults
+type CircuitBreakerConfig struct {
+	// Scope what a breaker guards, defaults to BreakerPerHost
+	Scope BreakerScope
+	// Window length of the failure counting window, defaults to 30s
+	Window time.Duration
+	// MinRequests requests needed in a window before the breaker can open, defaults to 10
+	MinRequests int
+	// FailureRate failure ratio in a window that opens the breaker, defaults to 0.5
+	FailureRate float64
+	// CoolDown how long the breaker stays open before probing, defaults to 30s
+	CoolDown time.Duration
+	// HalfOpenRequests successful probes needed to close again, defaults to 1
+	HalfOpenRequests int
+	// OnStateChange called after a breaker changes state, name is the host or host and operation
+	OnStateChange func(name string, from, to BreakerState)
+}
+
+func (c CircuitBreakerConfig) withDefaults() CircuitBreakerConfig {
+	if c.Window <= 0 {
+		c.Window = 30 * time.Second
+	}
+	if c.MinRequests <= 0 {
+		c.MinRequests = 10
+	}
+	if c.FailureRate <= 0 {
+		c.FailureRate = 0.5
+	}
+	if c.CoolDown <= 0 {
+		c.CoolDown = 30 * time.Second
+	}
+	if c.HalfOpenRequests <= 0 {
+		c.HalfOpenRequests = 1
+	}
+	return c
+}
+
+// breakerGroup holds the breakers of a Client keyed by host or endpoint
+type breakerGroup struct {
+	config   CircuitBreakerConfig
+	now      func() time.Time
+	breakers sync.Map
+}
+
+func newBreakerGroup(config *CircuitBreakerConfig) *breakerGroup {
+	if config == nil {
+		return nil
+	}
+	return &breakerGroup{config: config.withDefaults(), now: time.Now}
+}
+
+// get return the breaker for a request to op on host
+func (g *breakerGroup) get(host string, op string) *breaker {
+	name := host
+	if g.config.Scope == BreakerPerEndpoint {
+		name = host + " " + op
+	}
+	if b, ok := g.breakers.Load(name); ok {
+		return b.(*breaker)
+	}
+	b, _ := g.breakers.LoadOrStore(name, &breaker{name: name, group: g})
+	return b.(*breaker)
+}
+
+// breaker is a single circuit breaker
+type breaker struct {
+	name  string
+	group *breakerGroup
+
+	mu          sync.Mutex
+	state       BreakerState
+	generation  uint64
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	probes      int
+	successes   int
+}
+
+// allow report whether a request may be sent, and the generation to pass to record
+func (b *breaker) allow() (uint64, bool) {
+	b.mu.Lock()
+	now := b.group.now()
+	from := b.state
+	if b.state == BreakerOpen && now.Sub(b.openedAt) >= b.group.config.CoolDown {
+		b.setState(BreakerHalfOpen, now)
+	}
+
+	allowed := true
+	switch b.state {
+	case BreakerOpen:
+		allowed = false
+	case BreakerHalfOpen:
+		if b.probes >= b.group.config.HalfOpenRequests {
+			allowed = false
+		} else {
+			b.probes++
+		}
+	}
+	generation, to := b.generation, b.state
+	b.mu.Unlock()
+
+	b.notify(from, to)
+	return generation, allowed
+}
+
+// record report the outcome of a request allowed in generation
+func (b *breaker) record(generation uint64, success bool) {
+	b.mu.Lock()
+	if generation != b.generation {
+		// the breaker changed state while the request was in flight
+		b.mu.Unlock()
+		return
+	}
+	now := b.group.now()
+	from := b.state
+	config := b.group.config
+
+	switch b.state {
+	case BreakerClosed:
+		if now.Sub(b.windowStart) >= config.Window {
+			b.windowStart = now
+			b.requests, b.failures = 0, 0
+		}
+		b.requests++
+		if !success {
+			b.failures++
+		}
+		if b.requests >= config.MinRequests && float64(b.failures)/float64(b.requests) >= config.FailureRate {
+			b.setState(BreakerOpen, now)
+		}
+	case BreakerHalfOpen:
+		if !success {
+			b.setState(BreakerOpen, now)
+			break
+		}
+		b.successes++
+		if b.successes >= config.HalfOpenRequests {
+			b.setState(BreakerClosed, now)
+		}
+	}
+	to := b.state
+	b.mu.Unlock()
+
+	b.notify(from, to)
+}
+
+// abort release a request allowed in generation that finished without an outcome,
+// e.g. because its context was canceled
+func (b *breaker) abort(generation uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if generation == b.generation && b.state == BreakerHalfOpen && b.probes > 0 {
+		b.probes--
+	}
+}
+
+// setState switch state and reset the counters, b.mu must be held
+func (b *breaker) setState(state BreakerState, now time.Time) {
+	b.state = state
+	b.generation++
+	b.windowStart = now
+	b.requests, b.failures = 0, 0
+	b.probes, b.successes = 0, 0
+	if state == BreakerOpen {
+		b.openedAt = now
+	}
+}
+
+func (b *breaker) notify(from, to BreakerState) {
+	if from != to && b.group.config.OnStateChange != nil {
+		b.group.config.OnStateChange(b.name, from, to)
+	}
+}
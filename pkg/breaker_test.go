@@ -0,0 +1,264 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeClock is a manually advanced clock for breaker tests
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+type stateChange struct {
+	name     string
+	from, to BreakerState
+}
+
+func newTestBreakerGroup(config CircuitBreakerConfig) (*breakerGroup, *fakeClock, *[]stateChange) {
+	var changes []stateChange
+	config.OnStateChange = func(name string, from, to BreakerState) {
+		changes = append(changes, stateChange{name, from, to})
+	}
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	g := newBreakerGroup(&config)
+	g.now = clock.Now
+	return g, clock, &changes
+}
+
+func TestBreakerStateMachine(t *testing.T) {
+	g, clock, changes := newTestBreakerGroup(CircuitBreakerConfig{
+		MinRequests:      4,
+		FailureRate:      0.5,
+		CoolDown:         10 * time.Second,
+		HalfOpenRequests: 2,
+	})
+	b := g.get("http://panel", OpHeartbeat)
+
+	send := func(success bool) bool {
+		gen, ok := b.allow()
+		if ok {
+			b.record(gen, success)
+		}
+		return ok
+	}
+
+	// 1 failure out of 4 stays closed
+	for _, success := range []bool{true, true, true, false} {
+		send(success)
+	}
+	if b.state != BreakerClosed {
+		t.Fatalf("Expected closed, got %v", b.state)
+	}
+
+	// a new window starts, 2 failures out of 4 opens
+	clock.Advance(time.Minute)
+	for _, success := range []bool{false, true, false, true} {
+		send(success)
+	}
+	if b.state != BreakerOpen {
+		t.Fatalf("Expected open, got %v", b.state)
+	}
+	if send(true) {
+		t.Fatal("Expected request to be rejected while open")
+	}
+
+	// after the cool-down, only HalfOpenRequests probes are let through
+	clock.Advance(10 * time.Second)
+	gen1, ok1 := b.allow()
+	gen2, ok2 := b.allow()
+	_, ok3 := b.allow()
+	if !ok1 || !ok2 || ok3 {
+		t.Fatalf("Expected 2 probes in half-open, got %v %v %v", ok1, ok2, ok3)
+	}
+	b.record(gen1, true)
+	b.record(gen2, true)
+	if b.state != BreakerClosed {
+		t.Fatalf("Expected closed after successful probes, got %v", b.state)
+	}
+
+	want := []stateChange{
+		{"http://panel", BreakerClosed, BreakerOpen},
+		{"http://panel", BreakerOpen, BreakerHalfOpen},
+		{"http://panel", BreakerHalfOpen, BreakerClosed},
+	}
+	if len(*changes) != len(want) {
+		t.Fatalf("Expected changes %v, got %v", want, *changes)
+	}
+	for i := range want {
+		if (*changes)[i] != want[i] {
+			t.Errorf("change %d = %v, want %v", i, (*changes)[i], want[i])
+		}
+	}
+}
+
+func TestBreakerHalfOpenFailureReopens(t *testing.T) {
+	g, clock, _ := newTestBreakerGroup(CircuitBreakerConfig{MinRequests: 1, CoolDown: time.Second})
+	b := g.get("http://panel", OpHeartbeat)
+
+	gen, _ := b.allow()
+	b.record(gen, false)
+	if b.state != BreakerOpen {
+		t.Fatalf("Expected open, got %v", b.state)
+	}
+
+	clock.Advance(time.Second)
+	gen, ok := b.allow()
+	if !ok {
+		t.Fatal("Expected probe to be allowed")
+	}
+	b.record(gen, false)
+	if b.state != BreakerOpen {
+		t.Fatalf("Expected open after failed probe, got %v", b.state)
+	}
+	if _, ok := b.allow(); ok {
+		t.Fatal("Expected request to be rejected after failed probe")
+	}
+}
+
+func TestBreakerAbortReleasesProbe(t *testing.T) {
+	g, clock, _ := newTestBreakerGroup(CircuitBreakerConfig{MinRequests: 1, CoolDown: time.Second})
+	b := g.get("http://panel", OpHeartbeat)
+
+	gen, _ := b.allow()
+	b.record(gen, false)
+	clock.Advance(time.Second)
+
+	gen, _ = b.allow()
+	b.abort(gen)
+	if _, ok := b.allow(); !ok {
+		t.Fatal("Expected aborted probe to be released")
+	}
+}
+
+func TestBreakerStaleGenerationIgnored(t *testing.T) {
+	g, _, _ := newTestBreakerGroup(CircuitBreakerConfig{MinRequests: 1})
+	b := g.get("http://panel", OpHeartbeat)
+
+	stale, _ := b.allow()
+	gen, _ := b.allow()
+	b.record(gen, false)
+	// a request sent before the breaker opened must not affect the open state
+	b.record(stale, true)
+	if b.state != BreakerOpen {
+		t.Fatalf("Expected open, got %v", b.state)
+	}
+}
+
+func TestBreakerScope(t *testing.T) {
+	tests := []struct {
+		name  string
+		scope BreakerScope
+		same  bool
+	}{
+		{"per host", BreakerPerHost, true},
+		{"per endpoint", BreakerPerEndpoint, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newBreakerGroup(&CircuitBreakerConfig{Scope: tt.scope})
+			a := g.get("http://panel", OpHeartbeat)
+			b := g.get("http://panel", OpRawUsers)
+			if (a == b) != tt.same {
+				t.Fatalf("Expected same breaker = %v", tt.same)
+			}
+		})
+	}
+}
+
+func TestClientCircuitBreaker(t *testing.T) {
+	var hits atomic.Int32
+	var healthy atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(`{"data":true,"message":"success"}`))
+	}))
+	t.Cleanup(server.Close)
+
+	var mu sync.Mutex
+	var states []BreakerState
+	client := newTestClientWith(t, server.URL, Config{
+		CircuitBreaker: &CircuitBreakerConfig{
+			MinRequests: 3,
+			CoolDown:    50 * time.Millisecond,
+			OnStateChange: func(name string, from, to BreakerState) {
+				mu.Lock()
+				defer mu.Unlock()
+				states = append(states, to)
+			},
+		},
+	})
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if err := client.Heartbeat(ctx, "test-register-id", Trojan, ""); err == nil {
+			t.Fatal("Expected error from failing panel, got nil")
+		}
+	}
+
+	err := client.Heartbeat(ctx, "test-register-id", Trojan, "")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || !apiErr.IsCircuitOpen() {
+		t.Fatalf("Expected circuit open error, got %v", err)
+	}
+	if got := hits.Load(); got != 3 {
+		t.Fatalf("Expected open breaker to skip the panel, got %d requests", got)
+	}
+
+	healthy.Store(true)
+	time.Sleep(60 * time.Millisecond)
+	if err := client.Heartbeat(ctx, "test-register-id", Trojan, ""); err != nil {
+		t.Fatalf("Heartbeat() after cool-down unexpected error: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []BreakerState{BreakerOpen, BreakerHalfOpen, BreakerClosed}
+	if len(states) != len(want) {
+		t.Fatalf("Expected states %v, got %v", want, states)
+	}
+	for i := range want {
+		if states[i] != want[i] {
+			t.Fatalf("Expected states %v, got %v", want, states)
+		}
+	}
+}
+
+func TestBreakerIgnoresClientErrors(t *testing.T) {
+	server := newTestServer(t, http.StatusNotFound, map[string]any{"message": "not found"})
+	client := newTestClientWith(t, server.URL, Config{
+		CircuitBreaker: &CircuitBreakerConfig{MinRequests: 1},
+	})
+
+	for i := 0; i < 3; i++ {
+		err := client.Heartbeat(context.Background(), "test-register-id", Trojan, "")
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) || !apiErr.IsClientError() {
+			t.Fatalf("Expected client error, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/xflash-panda/server-client/pkg/xray"
+)
+
+// CertManagerConfig where a CertManager keeps the certificate of a node,
+// zero durations use the defaults
+type CertManagerConfig struct {
+	NodeId   NodeId
+	NodeType NodeType
+	// CertFile and KeyFile paths the PEM certificate chain and key are written to
+	CertFile string
+	KeyFile  string
+	// CheckInterval how often Run asks the panel for a new certificate, defaults to 1h
+	CheckInterval time.Duration
+	// RenewBefore Run checks every minute once the certificate expires within
+	// this, defaults to 7 days
+	RenewBefore time.Duration
+}
+
+// CertUpdate a certificate the manager installed
+type CertUpdate struct {
+	CertFile    string
+	KeyFile     string
+	Domain      string
+	NotAfter    time.Time
+	Certificate *tls.Certificate
+}
+
+// TLSCertConfig the update as an xray certificate entry reading the files
+func (u CertUpdate) TLSCertConfig() *xray.TLSCertConfig {
+	return &xray.TLSCertConfig{CertFile: u.CertFile, KeyFile: u.KeyFile}
+}
+
+// CertManager keeps the certificate of a node pulled from the panel on disk.
+// New certificates are validated, written atomically and announced to the
+// subscribers, so the proxy core can reload. It is safe for concurrent use.
+type CertManager struct {
+	client *Client
+	config CertManagerConfig
+	now    func() time.Time
+
+	// refreshing serializes Refresh, so files and state are installed in order
+	refreshing sync.Mutex
+
+	mu          sync.RWMutex
+	current     *CertUpdate
+	certPEM     []byte
+	keyPEM      []byte
+	subscribers map[int]func(CertUpdate)
+	nextId      int
+}
+
+// NewCertManager create a manager, call Load to pick up files left by a previous run
+func NewCertManager(client *Client, config CertManagerConfig) *CertManager {
+	if config.CheckInterval <= 0 {
+		config.CheckInterval = time.Hour
+	}
+	if config.RenewBefore <= 0 {
+		config.RenewBefore = 7 * 24 * time.Hour
+	}
+	return &CertManager{client: client, config: config, now: time.Now, subscribers: make(map[int]func(CertUpdate))}
+}
+
+// Subscribe call fn with every certificate installed from now on, the returned
+// function removes it. fn runs on the goroutine that installed the certificate.
+func (m *CertManager) Subscribe(fn func(CertUpdate)) (unsubscribe func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := m.nextId
+	m.nextId++
+	m.subscribers[id] = fn
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.subscribers, id)
+	}
+}
+
+// Current the installed certificate, false before the first Load or Refresh
+func (m *CertManager) Current() (CertUpdate, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.current == nil {
+		return CertUpdate{}, false
+	}
+	return *m.current, true
+}
+
+// GetCertificate serve the installed certificate, for tls.Config.GetCertificate
+func (m *CertManager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	current, ok := m.Current()
+	if !ok {
+		return nil, NewInvalidInputError("no certificate installed", nil)
+	}
+	return current.Certificate, nil
+}
+
+// NeedsRenewal report whether there is no certificate or it expires within RenewBefore
+func (m *CertManager) NeedsRenewal() bool {
+	current, ok := m.Current()
+	return !ok || !m.now().Add(m.config.RenewBefore).Before(current.NotAfter)
+}
+
+// Load install the certificate files left on disk, without notifying subscribers.
+// An expired certificate is not installed.
+func (m *CertManager) Load() error {
+	certPEM, err := os.ReadFile(m.config.CertFile)
+	if err != nil {
+		return NewIOError("read certificate failed", err)
+	}
+	keyPEM, err := os.ReadFile(m.config.KeyFile)
+	if err != nil {
+		return NewIOError("read certificate failed", err)
+	}
+	update, err := m.parse(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.current, m.certPEM, m.keyPEM = update, certPEM, keyPEM
+	return nil
+}
+
+// Refresh pull the certificate from the panel and install it when it changed.
+// It reports whether a new certificate was installed. An invalid or expired
+// certificate is rejected and the installed one kept.
+func (m *CertManager) Refresh(ctx context.Context) (bool, error) {
+	m.refreshing.Lock()
+	defer m.refreshing.Unlock()
+	cert, err := m.client.NodeCert(ctx, m.config.NodeId, m.config.NodeType)
+	if errors.Is(err, ErrorCertNotModified) {
+		if _, ok := m.Current(); ok {
+			return false, nil
+		}
+		// the ETag was stored by a fetch that was never installed, e.g. by
+		// another manager or before a failed write, ask for the full certificate
+		m.client.eTags.Delete(certETagKey(m.config.NodeId, m.config.NodeType))
+		cert, err = m.client.NodeCert(ctx, m.config.NodeId, m.config.NodeType)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	certPEM, keyPEM := []byte(cert.CertPEM), []byte(cert.KeyPEM)
+	m.mu.RLock()
+	unchanged := bytes.Equal(certPEM, m.certPEM) && bytes.Equal(keyPEM, m.keyPEM)
+	m.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	update, err := m.parse(certPEM, keyPEM)
+	if err != nil {
+		m.client.eTags.Delete(certETagKey(m.config.NodeId, m.config.NodeType))
+		return false, err
+	}
+	update.Domain = cert.Domain
+	if err := m.write(certPEM, keyPEM); err != nil {
+		m.client.eTags.Delete(certETagKey(m.config.NodeId, m.config.NodeType))
+		return false, err
+	}
+
+	m.mu.Lock()
+	m.current, m.certPEM, m.keyPEM = update, certPEM, keyPEM
+	subscribers := make([]func(CertUpdate), 0, len(m.subscribers))
+	for _, fn := range m.subscribers {
+		subscribers = append(subscribers, fn)
+	}
+	m.mu.Unlock()
+	for _, fn := range subscribers {
+		fn(*update)
+	}
+	return true, nil
+}
+
+// Run refresh the certificate every CheckInterval, or every minute once it is
+// due for renewal, until ctx is done. Failures are logged and retried.
+func (m *CertManager) Run(ctx context.Context) error {
+	for {
+		if _, err := m.Refresh(ctx); err != nil && ctx.Err() == nil {
+			m.client.logger.WarnContext(ctx, "certificate refresh failed",
+				"node_id", int(m.config.NodeId), "node_type", string(m.config.NodeType), "error", err)
+		}
+		wait := m.config.CheckInterval
+		if m.NeedsRenewal() {
+			wait = min(wait, time.Minute)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// parse validate that the chain and key form a pair and that the leaf is valid now
+func (m *CertManager) parse(certPEM, keyPEM []byte) (*CertUpdate, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, NewParseError("invalid certificate", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, NewParseError("invalid certificate", err)
+	}
+	now := m.now()
+	if now.After(leaf.NotAfter) || now.Before(leaf.NotBefore) {
+		return nil, NewParseError("invalid certificate", fmt.Errorf("certificate valid from %s to %s", leaf.NotBefore, leaf.NotAfter))
+	}
+	cert.Leaf = leaf
+	return &CertUpdate{
+		CertFile:    m.config.CertFile,
+		KeyFile:     m.config.KeyFile,
+		NotAfter:    leaf.NotAfter,
+		Certificate: &cert,
+	}, nil
+}
+
+// write replace both files through renames, so readers never see a partial
+// file. A reader loading between the two renames gets a pair that does not
+// match and fails, subscribers are only told once both files are in place.
+func (m *CertManager) write(certPEM, keyPEM []byte) error {
+	keyTmp, err := writeTemp(m.config.KeyFile, keyPEM, 0o600)
+	if err != nil {
+		return err
+	}
+	certTmp, err := writeTemp(m.config.CertFile, certPEM, 0o644)
+	if err != nil {
+		_ = os.Remove(keyTmp)
+		return err
+	}
+	if err := os.Rename(keyTmp, m.config.KeyFile); err != nil {
+		_ = os.Remove(keyTmp)
+		_ = os.Remove(certTmp)
+		return NewIOError("install key failed", err)
+	}
+	if err := os.Rename(certTmp, m.config.CertFile); err != nil {
+		_ = os.Remove(certTmp)
+		return NewIOError("install certificate failed", err)
+	}
+	return nil
+}
+
+// writeTemp write data to a synced temporary file next to path
+func writeTemp(path string, data []byte, perm os.FileMode) (string, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return "", NewIOError("write certificate failed", err)
+	}
+	name := f.Name()
+	err = f.Chmod(perm)
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(name)
+		return "", NewIOError("write certificate failed", fmt.Errorf("%s: %w", path, err))
+	}
+	return name, nil
+}
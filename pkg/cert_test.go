@@ -0,0 +1,302 @@
+package pkg
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newNodeCert a self-signed certificate for domain valid until notAfter
+func newNodeCert(t *testing.T, domain string, notAfter time.Time) NodeCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    notAfter.Add(-90 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NodeCert{
+		Domain:  domain,
+		CertPEM: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		KeyPEM:  string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+	}
+}
+
+// certPanel serves a certificate that tests can rotate, with its ETag
+type certPanel struct {
+	mu      sync.Mutex
+	cert    NodeCert
+	version int
+	hits    atomic.Int32
+}
+
+func (p *certPanel) set(cert NodeCert) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cert = cert
+	p.version++
+}
+
+func (p *certPanel) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.hits.Add(1)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	etag := `"v` + strconv.Itoa(p.version) + `"`
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	_ = json.NewEncoder(w).Encode(RespNodeCert{Data: &p.cert})
+}
+
+func newCertManager(t *testing.T, panel *certPanel) (*CertManager, CertManagerConfig) {
+	t.Helper()
+	server := httptest.NewServer(panel)
+	t.Cleanup(server.Close)
+	dir := t.TempDir()
+	config := CertManagerConfig{
+		NodeId:   1,
+		NodeType: Trojan,
+		CertFile: filepath.Join(dir, "cert.pem"),
+		KeyFile:  filepath.Join(dir, "key.pem"),
+	}
+	return NewCertManager(newTestClient(t, server.URL), config), config
+}
+
+func TestCertManagerRefresh(t *testing.T) {
+	panel := &certPanel{}
+	first := newNodeCert(t, "node.example", time.Now().Add(60*24*time.Hour))
+	panel.set(first)
+	manager, config := newCertManager(t, panel)
+	ctx := context.Background()
+
+	var updates []CertUpdate
+	unsubscribe := manager.Subscribe(func(u CertUpdate) { updates = append(updates, u) })
+
+	changed, err := manager.Refresh(ctx)
+	if err != nil || !changed {
+		t.Fatalf("Refresh() = %v, %v, want a new certificate", changed, err)
+	}
+	if len(updates) != 1 || updates[0].Domain != "node.example" || updates[0].Certificate.Leaf == nil {
+		t.Fatalf("Expected one update, got %+v", updates)
+	}
+	if data, _ := os.ReadFile(config.CertFile); string(data) != first.CertPEM {
+		t.Fatalf("Expected the certificate on disk")
+	}
+	if info, err := os.Stat(config.KeyFile); err != nil || (runtime.GOOS != "windows" && info.Mode().Perm() != 0o600) {
+		t.Fatalf("Expected a private key file, got %v %v", info.Mode(), err)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(config.CertFile)); len(entries) != 2 {
+		t.Fatalf("Expected no temporary files left, got %d entries", len(entries))
+	}
+	if manager.NeedsRenewal() {
+		t.Fatalf("Expected a certificate valid for 60 days to need no renewal")
+	}
+	if tlsCert := updates[0].TLSCertConfig(); tlsCert.CertFile != config.CertFile || tlsCert.KeyFile != config.KeyFile {
+		t.Fatalf("Unexpected xray certificate %+v", tlsCert)
+	}
+
+	// 304, nothing new
+	if changed, err := manager.Refresh(ctx); err != nil || changed || len(updates) != 1 {
+		t.Fatalf("Refresh() = %v, %v, want no change", changed, err)
+	}
+
+	// rotation close to expiry
+	second := newNodeCert(t, "node.example", time.Now().Add(3*24*time.Hour))
+	panel.set(second)
+	if changed, err := manager.Refresh(ctx); err != nil || !changed || len(updates) != 2 {
+		t.Fatalf("Refresh() = %v, %v, want the rotated certificate", changed, err)
+	}
+	if !manager.NeedsRenewal() {
+		t.Fatalf("Expected a certificate expiring in 3 days to need renewal")
+	}
+	served, err := manager.GetCertificate(nil)
+	if err != nil || served.Leaf.NotAfter.Equal(updates[0].NotAfter) {
+		t.Fatalf("Expected the rotated certificate to be served, got %v", err)
+	}
+
+	unsubscribe()
+	panel.set(newNodeCert(t, "node.example", time.Now().Add(90*24*time.Hour)))
+	if _, err := manager.Refresh(ctx); err != nil || len(updates) != 2 {
+		t.Fatalf("Expected no update after unsubscribing, got %d %v", len(updates), err)
+	}
+}
+
+func TestCertManagerRejectsInvalid(t *testing.T) {
+	valid := newNodeCert(t, "node.example", time.Now().Add(30*24*time.Hour))
+	other := newNodeCert(t, "other.example", time.Now().Add(30*24*time.Hour))
+	tests := []struct {
+		name string
+		cert NodeCert
+	}{
+		{"expired", newNodeCert(t, "node.example", time.Now().Add(-time.Hour))},
+		{"mismatched key", NodeCert{CertPEM: valid.CertPEM, KeyPEM: other.KeyPEM}},
+		{"not pem", NodeCert{CertPEM: "certificate", KeyPEM: "key"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			panel := &certPanel{}
+			panel.set(valid)
+			manager, config := newCertManager(t, panel)
+			if _, err := manager.Refresh(context.Background()); err != nil {
+				t.Fatalf("Refresh() unexpected error: %v", err)
+			}
+
+			panel.set(tt.cert)
+			_, err := manager.Refresh(context.Background())
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) || !apiErr.IsParseError() {
+				t.Fatalf("Expected a parse error, got %v", err)
+			}
+			if data, _ := os.ReadFile(config.CertFile); string(data) != valid.CertPEM {
+				t.Fatalf("Expected the valid certificate to stay on disk")
+			}
+			if current, _ := manager.Current(); current.Domain != "node.example" {
+				t.Fatalf("Expected the valid certificate to stay installed, got %+v", current)
+			}
+
+			// the rejected certificate is fetched again, not answered by a 304
+			before := panel.hits.Load()
+			_, err = manager.Refresh(context.Background())
+			if err == nil || panel.hits.Load() != before+1 {
+				t.Fatalf("Expected the rejected certificate to be fetched again, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCertManagerLoad(t *testing.T) {
+	panel := &certPanel{}
+	cert := newNodeCert(t, "node.example", time.Now().Add(30*24*time.Hour))
+	panel.set(cert)
+	manager, config := newCertManager(t, panel)
+
+	err := manager.Load()
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || !apiErr.IsIOError() || !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected no files yet, got %v", err)
+	}
+	if _, err := manager.GetCertificate(nil); !errors.As(err, &apiErr) || !apiErr.IsInvalidInput() {
+		t.Fatalf("Expected no certificate to serve, got %v", err)
+	}
+	if err := os.WriteFile(config.CertFile, []byte(cert.CertPEM), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(config.KeyFile, []byte(cert.KeyPEM), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.Load(); err != nil {
+		t.Fatalf("Load() unexpected error: %v", err)
+	}
+	if _, ok := manager.Current(); !ok {
+		t.Fatalf("Expected the loaded certificate to be installed")
+	}
+
+	// the panel still has the same certificate, nothing to announce
+	notified := false
+	manager.Subscribe(func(CertUpdate) { notified = true })
+	if changed, err := manager.Refresh(context.Background()); err != nil || changed || notified {
+		t.Fatalf("Refresh() = %v, %v, want the loaded certificate kept", changed, err)
+	}
+}
+
+func TestCertManagerWriteError(t *testing.T) {
+	panel := &certPanel{}
+	panel.set(newNodeCert(t, "node.example", time.Now().Add(30*24*time.Hour)))
+	manager, _ := newCertManager(t, panel)
+	manager.config.CertFile = filepath.Join(t.TempDir(), "missing", "cert.pem")
+
+	_, err := manager.Refresh(context.Background())
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || !apiErr.IsIOError() {
+		t.Fatalf("Expected an I/O error, got %v", err)
+	}
+	if _, ok := manager.Current(); ok {
+		t.Fatalf("Expected nothing installed")
+	}
+}
+
+func TestCertManagerStaleETag(t *testing.T) {
+	panel := &certPanel{}
+	panel.set(newNodeCert(t, "node.example", time.Now().Add(30*24*time.Hour)))
+	manager, _ := newCertManager(t, panel)
+
+	// another caller fetched the certificate, the ETag alone must not leave
+	// the manager without one
+	if _, err := manager.client.NodeCert(context.Background(), 1, Trojan); err != nil {
+		t.Fatalf("NodeCert() unexpected error: %v", err)
+	}
+	if changed, err := manager.Refresh(context.Background()); err != nil || !changed {
+		t.Fatalf("Refresh() = %v, %v, want the certificate installed", changed, err)
+	}
+}
+
+func TestCertManagerRun(t *testing.T) {
+	panel := &certPanel{}
+	panel.set(newNodeCert(t, "node.example", time.Now().Add(30*24*time.Hour)))
+	manager, _ := newCertManager(t, panel)
+	manager.config.CheckInterval = 10 * time.Millisecond
+
+	updates := make(chan CertUpdate, 2)
+	manager.Subscribe(func(u CertUpdate) { updates <- u })
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- manager.Run(ctx) }()
+
+	<-updates
+	rotated := newNodeCert(t, "rotated.example", time.Now().Add(30*24*time.Hour))
+	panel.set(rotated)
+	select {
+	case u := <-updates:
+		if u.Domain != "rotated.example" {
+			t.Fatalf("Unexpected update %+v", u)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected Run to pick up the rotation")
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected Run to stop with the context, got %v", err)
+	}
+}
+
+func TestNodeCertMissing(t *testing.T) {
+	server := newTestServer(t, 200, map[string]any{"data": map[string]any{"certificate": ""}})
+	client := newTestClient(t, server.URL)
+	_, err := client.NodeCert(context.Background(), 1, Trojan)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || !apiErr.IsParseError() {
+		t.Fatalf("Expected a parse error for an empty certificate, got %v", err)
+	}
+}
@@ -5,13 +5,17 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptrace"
 	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	resty "github.com/go-resty/resty/v2"
-	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Config  api config
@@ -20,6 +24,91 @@ type Config struct {
 	Token   string
 	Timeout time.Duration
 	Debug   bool
+	// TLS custom CA, client certificate and pinning for the panel connection
+	TLS *TLSConfig
+	// Proxy outbound proxy URL, the scheme is one of http, https or socks5
+	Proxy string
+	// DialContext custom dialer for the panel connection
+	DialContext DialContextFunc
+	// LocalAddr source IP or interface name to bind outgoing connections to,
+	// ignored when DialContext is set
+	LocalAddr string
+	// Resolve static IP used for the hostnames of APIHost or APIHosts instead of DNS
+	Resolve string
+	// CloseConnection close the connection after every request instead of reusing it
+	CloseConnection bool
+	// MaxIdleConns maximum idle connections kept in the pool, defaults to 100
+	MaxIdleConns int
+	// MaxIdleConnsPerHost maximum idle connections kept per host, defaults to GOMAXPROCS+1
+	MaxIdleConnsPerHost int
+	// IdleConnTimeout how long an idle connection is kept, defaults to 90s
+	IdleConnTimeout time.Duration
+	// EnableHTTP2 negotiate HTTP/2 with TLS panels
+	EnableHTTP2 bool
+	// Retry retry policy for failed requests, nil uses DefaultRetryPolicy
+	Retry *RetryPolicy
+	// CircuitBreaker fail fast while the panel is unhealthy, nil disables it
+	CircuitBreaker *CircuitBreakerConfig
+	// APIHosts panel hosts in order of preference, replaces APIHost when set.
+	// Requests fail over to the next host on network errors and 5xx.
+	APIHosts []Host
+	// Failover probing of failed hosts, used with APIHosts
+	Failover *FailoverConfig
+	// RateLimit client-side token bucket limits, nil disables them
+	RateLimit *RateLimitConfig
+	// Metrics receives request measurements, nil disables them
+	Metrics Metrics
+	// TracerProvider creates a span per call, nil disables tracing
+	TracerProvider trace.TracerProvider
+	// Propagator writes the trace context into request headers, defaults to W3C trace context
+	Propagator propagation.TextMapPropagator
+	// SkipResultCheck accept success responses with "data": false, for older
+	// panels that do not report the result of Submit, Heartbeat and Unregister
+	SkipResultCheck bool
+	// Compression request and response compression, nil negotiates compressed
+	// responses and sends requests uncompressed
+	Compression *CompressionConfig
+	// Logger receives failed requests and debug output, defaults to slog.Default().
+	// Use slog.New(slog.DiscardHandler) to silence the client.
+	Logger *slog.Logger
+}
+
+// Operation names of the Client methods, used to key per-method settings
+const (
+	OpRawConfig            = "RawConfig"
+	OpConfig               = "Config"
+	OpRegister             = "Register"
+	OpUnregister           = "Unregister"
+	OpRawUsers             = "RawUsers"
+	OpRawUsersByNodeId     = "RawUsersByNodeId"
+	OpUsersIter            = "UsersIter"
+	OpUsersDelta           = "UsersDelta"
+	OpSubmit               = "Submit"
+	OpSubmitWithAgent      = "SubmitWithAgent"
+	OpSubmitStatsWithAgent = "SubmitStatsWithAgent"
+	OpSubmitOnlineUsers    = "SubmitOnlineUsers"
+	OpHeartbeat            = "Heartbeat"
+	OpSubmitNodeStatus     = "SubmitNodeStatus"
+	OpVerify               = "Verify"
+	OpAuditRules           = "AuditRules"
+	OpSubmitViolations     = "SubmitViolations"
+	OpNodeCert             = "NodeCert"
+	OpHeartbeatBatch       = "HeartbeatBatch"
+	OpUsersBatch           = "UsersBatch"
+	OpEvents               = "Events"
+)
+
+// operation identifies a Client call for retries, limits and observers
+type operation struct {
+	name       string
+	nodeType   NodeType
+	nodeId     NodeId
+	registerId string
+	// stream leave the body of a success response unread in RawBody
+	stream bool
+	// longLived the response stays open until the caller closes it, so the
+	// client timeout only covers the wait for the response headers. Requires stream.
+	longLived bool
 }
 
 // Client APIClient create a api client to the panel.
@@ -28,6 +117,18 @@ type Client struct {
 	config   *Config
 	eTags    sync.Map
 	batchSeq atomic.Uint64
+	retry    *RetryPolicy
+	breakers *breakerGroup
+	hosts    *hostPool
+	limiters *rateLimiters
+	tracing  *tracing
+	logger   *slog.Logger
+
+	middleware middleware
+	// bulkMissing bulk and delta routes the panel answered 404 for, with the time it did
+	bulkMissing sync.Map
+	// pushClient shares the transport of client without its timeout, for long-lived streams
+	pushClient *resty.Client
 }
 
 // New creat a api instance
@@ -38,57 +139,252 @@ func New(apiConfig *Config) *Client {
 	} else {
 		client.SetTimeout(5 * time.Second)
 	}
-	client.OnError(func(req *resty.Request, err error) {
-		var v *resty.ResponseError
-		if errors.As(err, &v) {
-			// v.Response contains the last response from the server
-			// v.Err contains the original error
-			log.Errorln(v.Err)
-		}
-	})
-	client.SetBaseURL(apiConfig.APIHost)
-	// Create Key for each requests
-	client.SetRetryCount(3)
+	logger := apiConfig.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	client.SetLogger(restyLogger{logger: logger})
+	// retries are driven by the RetryPolicy in execute
+	client.SetRetryCount(0)
 	client.SetQueryParams(map[string]string{
 		"token": apiConfig.Token,
 	})
-	client.SetCloseConnection(true)
+	client.SetCloseConnection(apiConfig.CloseConnection)
+	configureTransport(client, apiConfig)
+	if apiConfig.Compression == nil || !apiConfig.Compression.DisableResponse {
+		client.SetTransport(&decompressTransport{base: client.GetClient().Transport})
+	}
 
 	if apiConfig.Debug {
 		client.SetDebug(true)
 	}
 
 	apiClient := &Client{
-		client: client,
-		config: apiConfig,
-	}
+		client:   client,
+		config:   apiConfig,
+		retry:    apiConfig.Retry.withDefaults(),
+		breakers: newBreakerGroup(apiConfig.CircuitBreaker),
+		limiters: newRateLimiters(apiConfig.RateLimit),
+		tracing:  newTracing(apiConfig.TracerProvider, apiConfig.Propagator),
+		logger:   logger,
+	}
+	apiClient.hosts = newHostPool(apiConfig.APIHost, apiConfig.APIHosts, apiConfig.Failover, apiClient.probe)
+	apiClient.pushClient = resty.NewWithClient(&http.Client{Transport: client.GetClient().Transport}).
+		SetLogger(restyLogger{logger: logger}).
+		SetRetryCount(0).
+		SetQueryParams(map[string]string{"token": apiConfig.Token}).
+		SetDebug(apiConfig.Debug)
+	client.SetBaseURL(apiClient.hosts.primary())
 	return apiClient
 }
 
+// Close stop the background work of the client, e.g. probing failed hosts
+func (c *Client) Close() {
+	c.hosts.close()
+}
+
 // Debug set the client debug for client
 func (c *Client) Debug(enable bool) {
 	c.client.SetDebug(enable)
+	c.pushClient.SetDebug(enable)
+}
+
+// execute send the request built by prepare and retry it according to the retry policy of op.
+// prepare is called for every attempt, so each one starts from a fresh request.
+// The returned url is the one of the host that served the last attempt.
+func (c *Client) execute(ctx context.Context, op operation, method string, path string, prepare func(r *resty.Request)) (res *resty.Response, url string, err error) {
+	policy := c.retry.forOperation(op.name)
+	start := time.Now()
+	attempt := 1
+	if c.tracing != nil {
+		var span trace.Span
+		ctx, span = c.tracing.start(ctx, op)
+		defer func() {
+			c.tracing.end(span, attempt, res, err)
+		}()
+	}
+	defer func() {
+		c.observeRequest(op, start, attempt, res, err)
+	}()
+	for ; ; attempt++ {
+		if c.limiters != nil && !c.limiters.wait(ctx, op.name) {
+			url = c.hosts.primary() + path
+			if ctx.Err() != nil {
+				return nil, url, ctx.Err()
+			}
+			return nil, url, NewRateLimitedError(url)
+		}
+		res, url, err = c.attempt(ctx, op, method, path, prepare)
+		if attempt >= policy.MaxAttempts || ctx.Err() != nil || !policy.shouldRetry(res, err) {
+			c.logAttempt(ctx, op, url, attempt, res, err, 0)
+			return res, url, err
+		}
+
+		wait, ok := policy.backoff(attempt, res)
+		if deadline, hasDeadline := ctx.Deadline(); !ok || hasDeadline && time.Until(deadline) < wait {
+			// the panel asks for a longer wait than allowed or the next
+			// attempt could not finish in time, report this one
+			c.logAttempt(ctx, op, url, attempt, res, err, 0)
+			return res, url, err
+		}
+		c.logAttempt(ctx, op, url, attempt, res, err, wait)
+		if c.config.Metrics != nil {
+			c.config.Metrics.ObserveRetry(op.name, op.nodeType)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return res, url, err
+		case <-timer.C:
+		}
+	}
+}
+
+// attempt send the request to the preferred host, failing over to the other
+// healthy hosts on network errors and 5xx. Non-idempotent operations only fail
+// over when no connection to the host was made, once the panel may have
+// received the request the error is returned.
+func (c *Client) attempt(ctx context.Context, op operation, method string, path string, prepare func(r *resty.Request)) (res *resty.Response, url string, err error) {
+	nonIdempotent := nonIdempotentOps[op.name]
+	for _, host := range c.hosts.candidates() {
+		url = host.url + path
+		sendCtx, connected := ctx, &atomic.Bool{}
+		if nonIdempotent {
+			sendCtx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+				GotConn: func(httptrace.GotConnInfo) { connected.Store(true) },
+			})
+		}
+		res, err = c.send(sendCtx, host.url, op, method, url, prepare)
+		if ctx.Err() != nil {
+			return res, url, err
+		}
+
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && apiErr.IsAborted() {
+			return res, url, err
+		}
+		circuitOpen := errors.As(err, &apiErr) && apiErr.IsCircuitOpen()
+		serverError := err == nil && res.StatusCode() >= 500
+		switch {
+		case err == nil && !serverError:
+			c.hosts.markHealthy(host)
+			return res, url, err
+		case !circuitOpen:
+			c.hosts.markFailed(host)
+		}
+		if nonIdempotent && (serverError || connected.Load()) {
+			return res, url, err
+		}
+	}
+	return res, url, err
+}
+
+// send send the request once to url, guarded by the circuit breaker of host
+func (c *Client) send(ctx context.Context, host string, op operation, method string, url string, prepare func(r *resty.Request)) (*resty.Response, error) {
+	client, reqCtx := c.client, ctx
+	var release func(*resty.Response, error) error
+	if op.longLived {
+		client = c.pushClient
+		reqCtx, release = headerDeadline(ctx, c.client.GetClient().Timeout)
+	}
+	req := client.R().SetContext(reqCtx)
+	prepare(req)
+	if c.tracing != nil {
+		c.tracing.inject(ctx, req)
+	}
+	if err := c.middleware.beforeRequest(ctx, op, req); err != nil {
+		return nil, NewAbortedError(url, err)
+	}
+
+	var b *breaker
+	var generation uint64
+	if c.breakers != nil {
+		b = c.breakers.get(host, op.name)
+		var allowed bool
+		if generation, allowed = b.allow(); !allowed {
+			return nil, NewCircuitOpenError(url)
+		}
+	}
+
+	if op.stream {
+		req.SetDoNotParseResponse(true)
+	}
+	res, err := req.Execute(method, url)
+	if release != nil {
+		err = release(res, err)
+	}
+	if err != nil && res != nil && res.RawResponse == nil {
+		res = nil
+	}
+	if op.stream && err == nil && res.StatusCode() >= 300 {
+		// only success bodies are streamed, the others are small and read by the error paths
+		err = bufferBody(res)
+	}
+	c.middleware.afterResponse(ctx, op, req, res, err)
+
+	if b != nil {
+		switch {
+		case ctx.Err() != nil:
+			b.abort(generation)
+		case err != nil:
+			b.record(generation, false)
+		default:
+			b.record(generation, res.StatusCode() < 500)
+		}
+	}
+	return res, err
+}
+
+// probe report whether url answers below 500, used to detect recovered hosts
+func (c *Client) probe(ctx context.Context, url string) bool {
+	res, err := c.client.R().SetContext(ctx).Get(url)
+	return err == nil && res.StatusCode() < 500
 }
 
-func (c *Client) assembleURL(path string) string {
-	return c.config.APIHost + path
+// checkResult turn a success response reporting "data": false into a business
+// logic error carrying the panel message, and the code if the body has one
+func (c *Client) checkResult(resp RespSubmit, body []byte, url string) error {
+	if resp.Data || c.config.SkipResultCheck {
+		return nil
+	}
+	message := resp.Message
+	if message == "" {
+		message = "panel reported failure"
+	}
+	apiErr := NewBusinessLogicError(message, url)
+	apiErr.Body = string(body)
+	if envelope, ok := parseErrorEnvelope(body); ok {
+		apiErr.Code = envelope.code()
+		apiErr.RequestID = envelope.RequestID
+	}
+	return apiErr
+}
+
+// requestError wrap the error of a failed request, keeping errors that are already typed
+func requestError(url string, err error) error {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	return NewNetworkError("request failed", url, err)
 }
 
 // RawConfig get node config raw data by nodeId
 func (c *Client) RawConfig(ctx context.Context, nodeId NodeId, nodeType NodeType) (rawData []byte, err error) {
 	path := fmt.Sprintf("/api/v1/server/enhanced/%s/config", nodeType)
-	res, err := c.client.R().
-		SetContext(ctx).
-		ForceContentType("application/json").
-		SetQueryParam("node_id", strconv.Itoa(int(nodeId))).
-		Get(path)
+	op := operation{name: OpRawConfig, nodeType: nodeType, nodeId: nodeId}
+	res, url, err := c.execute(ctx, op, resty.MethodGet, path, func(r *resty.Request) {
+		r.ForceContentType("application/json").
+			SetQueryParam("node_id", strconv.Itoa(int(nodeId)))
+	})
 	if err != nil {
-		return nil, fmt.Errorf("request %s failed: %w", c.assembleURL(path), err)
+		return nil, requestError(url, err)
 	}
 
 	if res.StatusCode() >= 400 {
 		body := res.Body()
-		return nil, fmt.Errorf("request %s failed: %s, %w", c.assembleURL(path), string(body), err)
+		return nil, NewAPIErrorFromResponse(res.StatusCode(), body, url)
 	}
 
 	return res.Body(), nil
@@ -97,25 +393,23 @@ func (c *Client) RawConfig(ctx context.Context, nodeId NodeId, nodeType NodeType
 // Config get node config by nodeId
 func (c *Client) Config(ctx context.Context, nodeId NodeId, nodeType NodeType) (config NodeConfig, err error) {
 	path := fmt.Sprintf("/api/v1/server/enhanced/%s/config", nodeType)
-	url := c.assembleURL(path)
+	factoryFunc, ok := configFactories[NodeType(nodeType.String())]
+	if !ok {
+		return nil, NewInvalidInputError(fmt.Sprintf("invalid config type: %s", nodeType), nil)
+	}
 
-	res, err := c.client.R().
-		SetContext(ctx).
-		ForceContentType("application/json").
-		SetQueryParam("node_id", strconv.Itoa(int(nodeId))).
-		Get(path)
+	op := operation{name: OpConfig, nodeType: nodeType, nodeId: nodeId}
+	res, url, err := c.execute(ctx, op, resty.MethodGet, path, func(r *resty.Request) {
+		r.ForceContentType("application/json").
+			SetQueryParam("node_id", strconv.Itoa(int(nodeId)))
+	})
 	if err != nil {
-		return nil, NewNetworkError("request failed", url, err)
+		return nil, requestError(url, err)
 	}
 
 	if res.StatusCode() >= 400 {
 		body := res.Body()
-		return nil, NewAPIErrorFromStatusCode(res.StatusCode(), string(body), url, nil)
-	}
-
-	factoryFunc, ok := configFactories[NodeType(nodeType.String())]
-	if !ok {
-		return nil, NewBusinessLogicError(fmt.Sprintf("invalid config type: %s", nodeType), "")
+		return nil, NewAPIErrorFromResponse(res.StatusCode(), body, url)
 	}
 
 	resp := RespConfig{
@@ -132,26 +426,25 @@ func (c *Client) Config(ctx context.Context, nodeId NodeId, nodeType NodeType) (
 // Register register node and return register_id
 func (c *Client) Register(ctx context.Context, nodeId NodeId, nodeType NodeType, hostname string, port int, nodeIp string) (registerId string, err error) {
 	path := fmt.Sprintf("/api/v1/server/enhanced/%s/register", nodeType)
-	url := c.assembleURL(path)
 
 	body := map[string]any{"hostname": hostname, "port": port}
 	if nodeIp != "" {
 		body["node_ip"] = nodeIp
 	}
 
-	res, err := c.client.R().
-		SetContext(ctx).
-		ForceContentType("application/json").
-		SetQueryParam("node_id", strconv.Itoa(int(nodeId))).
-		SetBody(body).
-		Post(path)
+	op := operation{name: OpRegister, nodeType: nodeType, nodeId: nodeId}
+	res, url, err := c.execute(ctx, op, resty.MethodPost, path, func(r *resty.Request) {
+		r.ForceContentType("application/json").
+			SetQueryParam("node_id", strconv.Itoa(int(nodeId))).
+			SetBody(body)
+	})
 	if err != nil {
-		return "", NewNetworkError("request failed", url, err)
+		return "", requestError(url, err)
 	}
 
 	if res.StatusCode() >= 400 {
 		body := res.Body()
-		return "", NewAPIErrorFromStatusCode(res.StatusCode(), string(body), url, nil)
+		return "", NewAPIErrorFromResponse(res.StatusCode(), body, url)
 	}
 
 	var resp RespRegister
@@ -165,20 +458,19 @@ func (c *Client) Register(ctx context.Context, nodeId NodeId, nodeType NodeType,
 // Unregister unregister node
 func (c *Client) Unregister(ctx context.Context, nodeType NodeType, registerId string) error {
 	path := fmt.Sprintf("/api/v1/server/enhanced/%s/unregister", nodeType)
-	url := c.assembleURL(path)
 
-	res, err := c.client.R().
-		SetContext(ctx).
-		ForceContentType("application/json").
-		SetQueryParam("register_id", registerId).
-		Post(path)
+	op := operation{name: OpUnregister, nodeType: nodeType, registerId: registerId}
+	res, url, err := c.execute(ctx, op, resty.MethodPost, path, func(r *resty.Request) {
+		r.ForceContentType("application/json").
+			SetQueryParam("register_id", registerId)
+	})
 	if err != nil {
-		return NewNetworkError("request failed", url, err)
+		return requestError(url, err)
 	}
 
 	if res.StatusCode() >= 400 {
 		body := res.Body()
-		return NewAPIErrorFromStatusCode(res.StatusCode(), string(body), url, nil)
+		return NewAPIErrorFromResponse(res.StatusCode(), body, url)
 	}
 
 	var resp RespUnregister
@@ -186,26 +478,25 @@ func (c *Client) Unregister(ctx context.Context, nodeType NodeType, registerId s
 		return NewParseError("failed to parse unregister response", err)
 	}
 
-	return nil
+	return c.checkResult(RespSubmit(resp), res.Body(), url)
 }
 
 // RawUsers get raw users data
 func (c *Client) RawUsers(ctx context.Context, registerId string, nodeType NodeType) (rawData []byte, err error) {
 	path := fmt.Sprintf("/api/v1/server/enhanced/%s/users", nodeType)
-	url := c.assembleURL(path)
 	eTagKey := fmt.Sprintf("users_%s_%s", nodeType, registerId)
 	var eTagValue string
 	if value, ok := c.eTags.Load(eTagKey); ok {
 		eTagValue = value.(string)
 	}
-	res, err := c.client.R().
-		SetContext(ctx).
-		SetQueryParam("register_id", registerId).
-		SetHeader("If-None-Match", eTagValue).
-		ForceContentType("application/json").
-		Get(path)
+	op := operation{name: OpRawUsers, nodeType: nodeType, registerId: registerId}
+	res, url, err := c.execute(ctx, op, resty.MethodGet, path, func(r *resty.Request) {
+		r.SetQueryParam("register_id", registerId).
+			SetHeader("If-None-Match", eTagValue).
+			ForceContentType("application/json")
+	})
 	if err != nil {
-		return nil, NewNetworkError("request failed", url, err)
+		return nil, requestError(url, err)
 	}
 
 	if res.StatusCode() == 304 {
@@ -214,7 +505,7 @@ func (c *Client) RawUsers(ctx context.Context, registerId string, nodeType NodeT
 
 	if res.StatusCode() >= 400 {
 		body := res.Body()
-		return nil, NewAPIErrorFromStatusCode(res.StatusCode(), string(body), url, nil)
+		return nil, NewAPIErrorFromResponse(res.StatusCode(), body, url)
 	}
 	// update etag
 	hash := res.Header().Get("Etag")
@@ -236,23 +527,101 @@ func (c *Client) Users(ctx context.Context, registerId string, nodeType NodeType
 	return resp.Data, nil
 }
 
+// SyncUsers bring set up to date with the panel and return what changed.
+// It asks for the changes since the revision of set, and fetches the full
+// list when set is empty, when the panel reports the revision as expired or
+// when the panel has no delta endpoint. A missing delta endpoint is not
+// asked again for a while, like the bulk routes.
+func (c *Client) SyncUsers(ctx context.Context, registerId string, nodeType NodeType, set *UserSet) (UserChanges, error) {
+	deltaPath := usersDeltaPath(nodeType)
+	if !c.bulkAvailable(deltaPath) {
+		return c.syncFullUsers(ctx, registerId, nodeType, set)
+	}
+	revision := set.Revision()
+	delta, err := c.usersDelta(ctx, registerId, nodeType, revision)
+	if revision != 0 && errors.Is(err, ErrRevisionExpired) {
+		delta, err = c.usersDelta(ctx, registerId, nodeType, 0)
+	}
+	if c.bulkMissingRoute(deltaPath, err) {
+		return c.syncFullUsers(ctx, registerId, nodeType, set)
+	}
+	if err != nil {
+		return UserChanges{}, err
+	}
+	if delta.Full {
+		return set.replace(delta.Revision, delta.Users), nil
+	}
+	return set.applyDelta(delta), nil
+}
+
+// usersDelta get the user changes since revision, 0 asks for the full list
+func (c *Client) usersDelta(ctx context.Context, registerId string, nodeType NodeType, revision int64) (*UsersDelta, error) {
+	path := usersDeltaPath(nodeType)
+	op := operation{name: OpUsersDelta, nodeType: nodeType, registerId: registerId}
+	res, url, err := c.execute(ctx, op, resty.MethodGet, path, func(r *resty.Request) {
+		r.SetQueryParam("register_id", registerId).
+			SetQueryParam("revision", strconv.FormatInt(revision, 10)).
+			ForceContentType("application/json")
+	})
+	if err != nil {
+		return nil, requestError(url, err)
+	}
+
+	if res.StatusCode() >= 400 {
+		body := res.Body()
+		return nil, NewAPIErrorFromResponse(res.StatusCode(), body, url)
+	}
+
+	var resp RespUsersDelta
+	if err := json.Unmarshal(res.Body(), &resp); err != nil {
+		return nil, NewParseError("parse response failed", err)
+	}
+	if resp.Data == nil {
+		return nil, NewParseError("parse response failed", errors.New("missing data"))
+	}
+	return resp.Data, nil
+}
+
+func usersDeltaPath(nodeType NodeType) string {
+	return fmt.Sprintf("/api/v1/server/enhanced/%s/users/delta", nodeType)
+}
+
+// syncFullUsers fill set from the full user list, for panels without the delta endpoint
+func (c *Client) syncFullUsers(ctx context.Context, registerId string, nodeType NodeType, set *UserSet) (UserChanges, error) {
+	if set.Len() == 0 {
+		// a 304 would leave the empty set without users
+		c.eTags.Delete(fmt.Sprintf("users_%s_%s", nodeType, registerId))
+	}
+	users, err := c.Users(ctx, registerId, nodeType)
+	if errors.Is(err, ErrorUserNotModified) {
+		return UserChanges{}, nil
+	}
+	if err != nil {
+		return UserChanges{}, err
+	}
+	var list []User
+	if users != nil {
+		list = *users
+	}
+	return set.replace(0, list), nil
+}
+
 // RawUsersByNodeId get raw users data by nodeId and nodeType
 func (c *Client) RawUsersByNodeId(ctx context.Context, nodeId NodeId, nodeType NodeType) (rawData []byte, err error) {
 	path := fmt.Sprintf("/api/v1/server/enhanced/%s/users", nodeType)
-	url := c.assembleURL(path)
 	eTagKey := fmt.Sprintf("users_%s_%d", nodeType, nodeId)
 	var eTagValue string
 	if value, ok := c.eTags.Load(eTagKey); ok {
 		eTagValue = value.(string)
 	}
-	res, err := c.client.R().
-		SetContext(ctx).
-		SetQueryParam("node_id", strconv.Itoa(int(nodeId))).
-		SetHeader("If-None-Match", eTagValue).
-		ForceContentType("application/json").
-		Get(path)
+	op := operation{name: OpRawUsersByNodeId, nodeType: nodeType, nodeId: nodeId}
+	res, url, err := c.execute(ctx, op, resty.MethodGet, path, func(r *resty.Request) {
+		r.SetQueryParam("node_id", strconv.Itoa(int(nodeId))).
+			SetHeader("If-None-Match", eTagValue).
+			ForceContentType("application/json")
+	})
 	if err != nil {
-		return nil, NewNetworkError("request failed", url, err)
+		return nil, requestError(url, err)
 	}
 
 	if res.StatusCode() == 304 {
@@ -261,7 +630,7 @@ func (c *Client) RawUsersByNodeId(ctx context.Context, nodeId NodeId, nodeType N
 
 	if res.StatusCode() >= 400 {
 		body := res.Body()
-		return nil, NewAPIErrorFromStatusCode(res.StatusCode(), string(body), url, nil)
+		return nil, NewAPIErrorFromResponse(res.StatusCode(), body, url)
 	}
 	// update etag
 	hash := res.Header().Get("Etag")
@@ -283,45 +652,136 @@ func (c *Client) UsersByNodeId(ctx context.Context, nodeId NodeId, nodeType Node
 	return resp.Data, nil
 }
 
+// AuditRules will pull the audit rules of the node, ErrorAuditRulesNotModified
+// is returned while they have not changed since the previous call
+func (c *Client) AuditRules(ctx context.Context, nodeId NodeId, nodeType NodeType) ([]AuditRule, error) {
+	path := fmt.Sprintf("/api/v1/server/enhanced/%s/audit_rules", nodeType)
+	eTagKey := fmt.Sprintf("audit_rules_%s_%d", nodeType, nodeId)
+	var eTagValue string
+	if value, ok := c.eTags.Load(eTagKey); ok {
+		eTagValue = value.(string)
+	}
+	op := operation{name: OpAuditRules, nodeType: nodeType, nodeId: nodeId}
+	res, url, err := c.execute(ctx, op, resty.MethodGet, path, func(r *resty.Request) {
+		r.SetQueryParam("node_id", strconv.Itoa(int(nodeId))).
+			SetHeader("If-None-Match", eTagValue).
+			ForceContentType("application/json")
+	})
+	if err != nil {
+		return nil, requestError(url, err)
+	}
+
+	if res.StatusCode() == 304 {
+		return nil, ErrorAuditRulesNotModified
+	}
+
+	if res.StatusCode() >= 400 {
+		body := res.Body()
+		return nil, NewAPIErrorFromResponse(res.StatusCode(), body, url)
+	}
+
+	var resp RespAuditRules
+	if err := json.Unmarshal(res.Body(), &resp); err != nil {
+		return nil, NewParseError("parse response failed", err)
+	}
+	// update etag once the rules are known to be valid
+	c.eTags.Store(eTagKey, res.Header().Get("Etag"))
+	return resp.Data, nil
+}
+
+// NodeCert will pull the TLS certificate of the node, ErrorCertNotModified is
+// returned while it has not changed since the previous call
+func (c *Client) NodeCert(ctx context.Context, nodeId NodeId, nodeType NodeType) (*NodeCert, error) {
+	path := fmt.Sprintf("/api/v1/server/enhanced/%s/cert", nodeType)
+	eTagKey := certETagKey(nodeId, nodeType)
+	var eTagValue string
+	if value, ok := c.eTags.Load(eTagKey); ok {
+		eTagValue = value.(string)
+	}
+	op := operation{name: OpNodeCert, nodeType: nodeType, nodeId: nodeId}
+	res, url, err := c.execute(ctx, op, resty.MethodGet, path, func(r *resty.Request) {
+		r.SetQueryParam("node_id", strconv.Itoa(int(nodeId))).
+			SetHeader("If-None-Match", eTagValue).
+			ForceContentType("application/json")
+	})
+	if err != nil {
+		return nil, requestError(url, err)
+	}
+
+	if res.StatusCode() == 304 {
+		return nil, ErrorCertNotModified
+	}
+
+	if res.StatusCode() >= 400 {
+		body := res.Body()
+		return nil, NewAPIErrorFromResponse(res.StatusCode(), body, url)
+	}
+
+	var resp RespNodeCert
+	if err := json.Unmarshal(res.Body(), &resp); err != nil {
+		return nil, NewParseError("parse response failed", err)
+	}
+	if resp.Data == nil || resp.Data.CertPEM == "" || resp.Data.KeyPEM == "" {
+		return nil, NewParseError("parse response failed", errors.New("certificate or key missing"))
+	}
+	c.eTags.Store(eTagKey, res.Header().Get("Etag"))
+	return resp.Data, nil
+}
+
+func certETagKey(nodeId NodeId, nodeType NodeType) string {
+	return fmt.Sprintf("cert_%s_%d", nodeType, nodeId)
+}
+
 // Submit reports the user traffic
 func (c *Client) Submit(ctx context.Context, registerId string, nodeType NodeType, userTraffic []*UserTraffic) error {
 	path := fmt.Sprintf("/api/v1/server/enhanced/%s/submit", nodeType)
-	url := c.assembleURL(path)
 
 	body := map[string]any{
 		"register_id": registerId,
 		"data":        userTraffic,
 	}
 
-	res, err := c.client.R().
-		SetContext(ctx).
-		ForceContentType("application/json").
-		SetBody(body).
-		Post(path)
+	payload, err := c.encodeBody(body)
 	if err != nil {
-		return NewNetworkError("request failed", url, err)
+		return err
+	}
+
+	op := operation{name: OpSubmit, nodeType: nodeType, registerId: registerId}
+	res, url, err := c.execute(ctx, op, resty.MethodPost, path, func(r *resty.Request) {
+		r.ForceContentType("application/json")
+		payload.apply(r)
+	})
+	if err != nil {
+		return requestError(url, err)
 	}
 
 	if res.StatusCode() >= 400 {
 		respBody := res.Body()
-		return NewAPIErrorFromStatusCode(res.StatusCode(), string(respBody), url, nil)
+		return NewAPIErrorFromResponse(res.StatusCode(), respBody, url)
 	}
 
 	var resp RespSubmit
 	if err := json.Unmarshal(res.Body(), &resp); err != nil {
 		return NewParseError("parse response failed", err)
 	}
-	return nil
+	return c.checkResult(resp, res.Body(), url)
 }
 
 // SubmitWithAgent reports user traffic with agent
 func (c *Client) SubmitWithAgent(ctx context.Context, registerId string, nodeType NodeType, userTraffic []*UserTraffic) error {
-	path := fmt.Sprintf("/api/v1/server/enhanced/%s/submitWithAgent", nodeType)
-	url := c.assembleURL(path)
+	return c.submitBatch(ctx, registerId, nodeType, c.newBatchId(registerId), userTraffic)
+}
 
-	// generate batch_id: {register_id}_{timestamp}_{seq}
+// newBatchId generate batch_id: {register_id}_{timestamp}_{seq}
+func (c *Client) newBatchId(registerId string) string {
 	seq := c.batchSeq.Add(1)
-	batchId := fmt.Sprintf("%s_%d_%d", registerId, time.Now().Unix(), seq)
+	return fmt.Sprintf("%s_%d_%d", registerId, time.Now().Unix(), seq)
+}
+
+// submitBatch send userTraffic under batchId. The panel counts a batch id
+// once, so a batch whose outcome is unknown can be sent again as it was.
+func (c *Client) submitBatch(ctx context.Context, registerId string, nodeType NodeType, batchId string, userTraffic []*UserTraffic) error {
+	path := fmt.Sprintf("/api/v1/server/enhanced/%s/submitWithAgent", nodeType)
 
 	body := map[string]any{
 		"register_id": registerId,
@@ -329,108 +789,230 @@ func (c *Client) SubmitWithAgent(ctx context.Context, registerId string, nodeTyp
 		"data":        userTraffic,
 	}
 
-	res, err := c.client.R().
-		SetContext(ctx).
-		ForceContentType("application/json").
-		SetBody(body).
-		Post(path)
+	payload, err := c.encodeBody(body)
 	if err != nil {
-		return NewNetworkError("request failed", url, err)
+		return err
+	}
+
+	op := operation{name: OpSubmitWithAgent, nodeType: nodeType, registerId: registerId}
+	res, url, err := c.execute(ctx, op, resty.MethodPost, path, func(r *resty.Request) {
+		r.ForceContentType("application/json")
+		payload.apply(r)
+	})
+	if err != nil {
+		return requestError(url, err)
 	}
 
 	if res.StatusCode() >= 400 {
 		respBody := res.Body()
-		return NewAPIErrorFromStatusCode(res.StatusCode(), string(respBody), url, nil)
+		return NewAPIErrorFromResponse(res.StatusCode(), respBody, url)
 	}
 
 	var resp RespSubmitWithAgent
 	if err := json.Unmarshal(res.Body(), &resp); err != nil {
 		return NewParseError("parse response failed", err)
 	}
-	return nil
+	return c.checkResult(RespSubmit(resp), res.Body(), url)
 }
 
 // SubmitStatsWithAgent reports traffic stats with agent
 func (c *Client) SubmitStatsWithAgent(ctx context.Context, registerId string, nodeType NodeType, stats *TrafficStats) error {
 	path := fmt.Sprintf("/api/v1/server/enhanced/%s/submitStatsWithAgent", nodeType)
-	url := c.assembleURL(path)
 
 	body := map[string]any{
 		"register_id": registerId,
 		"data":        stats,
 	}
 
-	res, err := c.client.R().
-		SetContext(ctx).
-		ForceContentType("application/json").
-		SetBody(body).
-		Post(path)
+	payload, err := c.encodeBody(body)
 	if err != nil {
-		return NewNetworkError("request failed", url, err)
+		return err
+	}
+
+	op := operation{name: OpSubmitStatsWithAgent, nodeType: nodeType, registerId: registerId}
+	res, url, err := c.execute(ctx, op, resty.MethodPost, path, func(r *resty.Request) {
+		r.ForceContentType("application/json")
+		payload.apply(r)
+	})
+	if err != nil {
+		return requestError(url, err)
 	}
 
 	if res.StatusCode() >= 400 {
 		respBody := res.Body()
-		return NewAPIErrorFromStatusCode(res.StatusCode(), string(respBody), url, nil)
+		return NewAPIErrorFromResponse(res.StatusCode(), respBody, url)
 	}
 
 	var resp RespSubmitWithAgent
 	if err := json.Unmarshal(res.Body(), &resp); err != nil {
 		return NewParseError("parse response failed", err)
 	}
-	return nil
+	return c.checkResult(RespSubmit(resp), res.Body(), url)
+}
+
+// SubmitOnlineUsers reports the IPs each user is connected from, keyed by user id,
+// so the panel can enforce device limits. Addresses are normalized and deduplicated,
+// at most MaxOnlineIPsPerUser are sent per user and MaxOnlineIPs in total, the
+// users with the most IPs are trimmed first. An empty map reports nobody online.
+func (c *Client) SubmitOnlineUsers(ctx context.Context, registerId string, nodeType NodeType, online map[int][]string) error {
+	path := fmt.Sprintf("/api/v1/server/enhanced/%s/submitOnlineUsers", nodeType)
+
+	users, dropped := onlineUsers(online)
+	if dropped > 0 {
+		c.logger.WarnContext(ctx, "online report too large, IPs left out",
+			"node_type", string(nodeType), "register_id", registerId, "dropped", dropped)
+	}
+	body := map[string]any{
+		"register_id": registerId,
+		"data":        users,
+	}
+
+	payload, err := c.encodeBody(body)
+	if err != nil {
+		return err
+	}
+
+	op := operation{name: OpSubmitOnlineUsers, nodeType: nodeType, registerId: registerId}
+	res, url, err := c.execute(ctx, op, resty.MethodPost, path, func(r *resty.Request) {
+		r.ForceContentType("application/json")
+		payload.apply(r)
+	})
+	if err != nil {
+		return requestError(url, err)
+	}
+
+	if res.StatusCode() >= 400 {
+		respBody := res.Body()
+		return NewAPIErrorFromResponse(res.StatusCode(), respBody, url)
+	}
+
+	var resp RespSubmitOnlineUsers
+	if err := json.Unmarshal(res.Body(), &resp); err != nil {
+		return NewParseError("parse response failed", err)
+	}
+	return c.checkResult(RespSubmit(resp), res.Body(), url)
+}
+
+// SubmitViolations reports connections that hit audit rules, nothing is sent
+// when violations is empty
+func (c *Client) SubmitViolations(ctx context.Context, registerId string, nodeType NodeType, violations []Violation) error {
+	if len(violations) == 0 {
+		return nil
+	}
+	path := fmt.Sprintf("/api/v1/server/enhanced/%s/submitViolations", nodeType)
+
+	body := map[string]any{
+		"register_id": registerId,
+		"data":        violations,
+	}
+
+	payload, err := c.encodeBody(body)
+	if err != nil {
+		return err
+	}
+
+	op := operation{name: OpSubmitViolations, nodeType: nodeType, registerId: registerId}
+	res, url, err := c.execute(ctx, op, resty.MethodPost, path, func(r *resty.Request) {
+		r.ForceContentType("application/json")
+		payload.apply(r)
+	})
+	if err != nil {
+		return requestError(url, err)
+	}
+
+	if res.StatusCode() >= 400 {
+		respBody := res.Body()
+		return NewAPIErrorFromResponse(res.StatusCode(), respBody, url)
+	}
+
+	var resp RespSubmitViolations
+	if err := json.Unmarshal(res.Body(), &resp); err != nil {
+		return NewParseError("parse response failed", err)
+	}
+	return c.checkResult(RespSubmit(resp), res.Body(), url)
 }
 
 // Heartbeat send heartbeat
 func (c *Client) Heartbeat(ctx context.Context, registerId string, nodeType NodeType, nodeIp string) error {
 	path := fmt.Sprintf("/api/v1/server/enhanced/%s/heartbeat", nodeType)
-	url := c.assembleURL(path)
 
 	body := map[string]any{"register_id": registerId}
 	if nodeIp != "" {
 		body["node_ip"] = nodeIp
 	}
 
-	res, err := c.client.R().
-		SetContext(ctx).
-		ForceContentType("application/json").
-		SetBody(body).
-		Post(path)
+	op := operation{name: OpHeartbeat, nodeType: nodeType, registerId: registerId}
+	res, url, err := c.execute(ctx, op, resty.MethodPost, path, func(r *resty.Request) {
+		r.ForceContentType("application/json").
+			SetBody(body)
+	})
 	if err != nil {
-		return NewNetworkError("request failed", url, err)
+		return requestError(url, err)
 	}
 
 	if res.StatusCode() >= 400 {
 		respBody := res.Body()
-		return NewAPIErrorFromStatusCode(res.StatusCode(), string(respBody), url, nil)
+		return NewAPIErrorFromResponse(res.StatusCode(), respBody, url)
 	}
 
 	var respHeartBeat RespHeartBeat
 	if err := json.Unmarshal(res.Body(), &respHeartBeat); err != nil {
 		return NewParseError("parse response failed", err)
 	}
-	return nil
+	return c.checkResult(RespSubmit(respHeartBeat), res.Body(), url)
+}
+
+// SubmitNodeStatus reports the system status of the node, see StatusCollector
+func (c *Client) SubmitNodeStatus(ctx context.Context, registerId string, nodeType NodeType, status *NodeStatus) error {
+	if status == nil {
+		return NewInvalidInputError("node status is nil", nil)
+	}
+	path := fmt.Sprintf("/api/v1/server/enhanced/%s/status", nodeType)
+
+	body := map[string]any{
+		"register_id": registerId,
+		"data":        status,
+	}
+
+	op := operation{name: OpSubmitNodeStatus, nodeType: nodeType, registerId: registerId}
+	res, url, err := c.execute(ctx, op, resty.MethodPost, path, func(r *resty.Request) {
+		r.ForceContentType("application/json").
+			SetBody(body)
+	})
+	if err != nil {
+		return requestError(url, err)
+	}
+
+	if res.StatusCode() >= 400 {
+		respBody := res.Body()
+		return NewAPIErrorFromResponse(res.StatusCode(), respBody, url)
+	}
+
+	var resp RespSubmitNodeStatus
+	if err := json.Unmarshal(res.Body(), &resp); err != nil {
+		return NewParseError("parse response failed", err)
+	}
+	return c.checkResult(RespSubmit(resp), res.Body(), url)
 }
 
 // Verify check if registerId is valid
 func (c *Client) Verify(ctx context.Context, registerId string, nodeType NodeType) (bool, error) {
 	path := fmt.Sprintf("/api/v1/server/enhanced/%s/verify", nodeType)
-	url := c.assembleURL(path)
 
 	body := map[string]any{"register_id": registerId}
 
-	res, err := c.client.R().
-		SetContext(ctx).
-		ForceContentType("application/json").
-		SetBody(body).
-		Post(path)
+	op := operation{name: OpVerify, nodeType: nodeType, registerId: registerId}
+	res, url, err := c.execute(ctx, op, resty.MethodPost, path, func(r *resty.Request) {
+		r.ForceContentType("application/json").
+			SetBody(body)
+	})
 	if err != nil {
-		return false, NewNetworkError("request failed", url, err)
+		return false, requestError(url, err)
 	}
 
 	if res.StatusCode() >= 400 {
 		respBody := res.Body()
-		return false, NewAPIErrorFromStatusCode(res.StatusCode(), string(respBody), url, nil)
+		return false, NewAPIErrorFromResponse(res.StatusCode(), respBody, url)
 	}
 
 	var respVerify RespVerify
@@ -1,8 +1,10 @@
 package pkg
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -26,11 +28,22 @@ func newTestServer(t *testing.T, statusCode int, body any) *httptest.Server {
 // newTestClient creates a Client pointing to the test server.
 func newTestClient(t *testing.T, serverURL string) *Client {
 	t.Helper()
-	return New(&Config{
-		APIHost: serverURL,
-		Token:   "test-token",
-		Timeout: 5 * time.Second,
-	})
+	return newTestClientWith(t, serverURL, Config{})
+}
+
+// newTestClientWith creates a Client pointing to the test server with the
+// options set in cfg. The token and a 5s timeout are filled in when unset,
+// serverURL is ignored when cfg lists APIHosts.
+func newTestClientWith(tb testing.TB, serverURL string, cfg Config) *Client {
+	tb.Helper()
+	if len(cfg.APIHosts) == 0 {
+		cfg.APIHost = serverURL
+	}
+	cfg.Token = cmp.Or(cfg.Token, "test-token")
+	cfg.Timeout = cmp.Or(cfg.Timeout, 5*time.Second)
+	client := New(&cfg)
+	tb.Cleanup(client.Close)
+	return client
 }
 
 func TestConfig(t *testing.T) {
@@ -349,3 +362,65 @@ func TestHTTPError(t *testing.T) {
 		t.Fatal("Expected error from 500 status code, got nil")
 	}
 }
+
+func TestBusinessFailure(t *testing.T) {
+	resp := map[string]any{
+		"data":    false,
+		"message": "register expired",
+		"code":    CodeRegisterExpired,
+	}
+	server := newTestServer(t, 200, resp)
+	client := newTestClient(t, server.URL)
+
+	ctx := context.Background()
+	calls := map[string]func() error{
+		"Submit": func() error {
+			return client.Submit(ctx, "test-register-id", Trojan, nil)
+		},
+		"SubmitWithAgent": func() error {
+			return client.SubmitWithAgent(ctx, "test-register-id", Trojan, nil)
+		},
+		"SubmitStatsWithAgent": func() error {
+			return client.SubmitStatsWithAgent(ctx, "test-register-id", Trojan, &TrafficStats{})
+		},
+		"Heartbeat": func() error {
+			return client.Heartbeat(ctx, "test-register-id", Trojan, "")
+		},
+		"Unregister": func() error {
+			return client.Unregister(ctx, Trojan, "test-register-id")
+		},
+	}
+	for name, call := range calls {
+		t.Run(name, func(t *testing.T) {
+			err := call()
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("Expected business logic error, got %v", err)
+			}
+			if apiErr.Message != "register expired" || !apiErr.IsServerError() {
+				t.Errorf("Expected panel message in a server error, got %v", apiErr)
+			}
+			if !errors.Is(err, ErrRegisterExpired) {
+				t.Errorf("Expected the panel code to match ErrRegisterExpired")
+			}
+		})
+	}
+}
+
+func TestBusinessFailureSkipResultCheck(t *testing.T) {
+	server := newTestServer(t, 200, map[string]any{"data": false})
+	client := newTestClientWith(t, server.URL, Config{
+		SkipResultCheck: true,
+	})
+
+	if err := client.Heartbeat(context.Background(), "test-register-id", Trojan, ""); err != nil {
+		t.Fatalf("Heartbeat() unexpected error: %v", err)
+	}
+
+	strict := newTestClient(t, server.URL)
+	err := strict.Heartbeat(context.Background(), "test-register-id", Trojan, "")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Message != "panel reported failure" {
+		t.Fatalf("Expected default failure message, got %v", err)
+	}
+}
@@ -0,0 +1,186 @@
+package pkg
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	resty "github.com/go-resty/resty/v2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Encoding HTTP content encoding
+type Encoding string
+
+const (
+	EncodingGzip Encoding = "gzip"
+	EncodingZstd Encoding = "zstd"
+)
+
+// acceptEncoding response encodings negotiated with the panel, in order of preference
+const acceptEncoding = "zstd, gzip"
+
+// CompressionConfig request and response compression, zero fields use the defaults
+type CompressionConfig struct {
+	// DisableResponse do not negotiate zstd responses, the transport then only asks for gzip
+	DisableResponse bool
+	// Request encoding of Submit, SubmitWithAgent, SubmitStatsWithAgent,
+	// SubmitOnlineUsers and SubmitViolations bodies, empty sends them uncompressed
+	Request Encoding
+	// MinRequestSize bodies smaller than this are sent uncompressed, defaults to 1024 bytes
+	MinRequestSize int
+}
+
+func (c *CompressionConfig) minRequestSize() int {
+	if c.MinRequestSize > 0 {
+		return c.MinRequestSize
+	}
+	return 1024
+}
+
+// requestBody JSON body of a request, data holds the compressed form when
+// compression applies and value is sent as is otherwise
+type requestBody struct {
+	value    any
+	data     []byte
+	encoding Encoding
+}
+
+// encodeBody prepare value as a request body, compressing it when configured
+// and large enough. It is called once per call so retries resend the same bytes.
+func (c *Client) encodeBody(value any) (requestBody, error) {
+	body := requestBody{value: value}
+	config := c.config.Compression
+	if config == nil || config.Request == "" {
+		return body, nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return body, NewInvalidInputError("failed to marshal request body", err)
+	}
+	if len(data) < config.minRequestSize() {
+		return body, nil
+	}
+	compressed, err := compress(config.Request, data)
+	if err != nil {
+		return body, NewInvalidInputError("failed to compress request body", err)
+	}
+	body.data = compressed
+	body.encoding = config.Request
+	return body, nil
+}
+
+// apply set the body on r
+func (b requestBody) apply(r *resty.Request) {
+	if b.data == nil {
+		r.SetBody(b.value)
+		return
+	}
+	r.SetHeader("Content-Type", "application/json").
+		SetHeader("Content-Encoding", string(b.encoding)).
+		SetBody(b.data)
+}
+
+func compress(encoding Encoding, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	switch encoding {
+	case EncodingGzip:
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	case EncodingZstd:
+		w, err := zstd.NewWriter(&buf, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported encoding %q", encoding)
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressTransport ask for compressed responses and decode them, so the
+// rest of the client, streaming included, reads plain bodies
+type decompressTransport struct {
+	base http.RoundTripper
+}
+
+func (t *decompressTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// leave requests that negotiate on their own alone
+	if req.Header.Get("Accept-Encoding") != "" || req.Header.Get("Range") != "" {
+		return t.base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+	res, err := t.base.RoundTrip(req)
+	if err != nil || res.Body == nil || res.Body == http.NoBody {
+		return res, err
+	}
+
+	var open func(io.Reader) (io.ReadCloser, error)
+	switch strings.ToLower(strings.TrimSpace(res.Header.Get("Content-Encoding"))) {
+	case "gzip":
+		open = func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		}
+	case "zstd":
+		open = func(r io.Reader) (io.ReadCloser, error) {
+			dec, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return nil, err
+			}
+			return dec.IOReadCloser(), nil
+		}
+	default:
+		return res, nil
+	}
+	res.Body = &decodingBody{body: res.Body, open: open}
+	res.Header.Del("Content-Encoding")
+	res.Header.Del("Content-Length")
+	res.ContentLength = -1
+	res.Uncompressed = true
+	return res, nil
+}
+
+// decodingBody decode body on first read, so errors in the encoding are
+// reported by Read like any other body error
+type decodingBody struct {
+	body io.ReadCloser
+	open func(io.Reader) (io.ReadCloser, error)
+
+	once    sync.Once
+	decoder io.ReadCloser
+	err     error
+}
+
+func (b *decodingBody) Read(p []byte) (int, error) {
+	b.once.Do(func() {
+		b.decoder, b.err = b.open(b.body)
+	})
+	if b.err != nil {
+		return 0, b.err
+	}
+	return b.decoder.Read(p)
+}
+
+func (b *decodingBody) Close() error {
+	if b.decoder != nil {
+		_ = b.decoder.Close()
+	}
+	return b.body.Close()
+}
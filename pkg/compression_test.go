@@ -0,0 +1,241 @@
+package pkg
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// submitRecord what the mock panel saw of a submit request
+type submitRecord struct {
+	encoding string
+	size     int
+	body     map[string]any
+}
+
+// newDecodingServer decode compressed submit bodies like a panel behind a
+// decompressing proxy would, and record them
+func newDecodingServer(t *testing.T, records chan<- submitRecord) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := io.ReadAll(r.Body)
+		record := submitRecord{encoding: r.Header.Get("Content-Encoding"), size: len(raw)}
+		var reader io.Reader = bytes.NewReader(raw)
+		switch record.encoding {
+		case "gzip":
+			gz, err := gzip.NewReader(reader)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			reader = gz
+		case "zstd":
+			dec, err := zstd.NewReader(reader)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			defer dec.Close()
+			reader = dec
+		}
+		if err := json.NewDecoder(reader).Decode(&record.body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		records <- record
+		_, _ = w.Write([]byte(`{"data":true,"message":"success"}`))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func manyTraffics(n int) []*UserTraffic {
+	traffics := make([]*UserTraffic, n)
+	for i := range traffics {
+		traffics[i] = &UserTraffic{UID: i + 1, Upload: 1024, Download: 2048, Count: 1}
+	}
+	return traffics
+}
+
+func TestRequestCompression(t *testing.T) {
+	for _, encoding := range []Encoding{EncodingGzip, EncodingZstd} {
+		t.Run(string(encoding), func(t *testing.T) {
+			records := make(chan submitRecord, 3)
+			server := newDecodingServer(t, records)
+			client := newTestClientWith(t, server.URL, Config{
+				Compression: &CompressionConfig{Request: encoding},
+			})
+			ctx := context.Background()
+			traffics := manyTraffics(500)
+
+			if err := client.Submit(ctx, "test-register-id", Trojan, traffics); err != nil {
+				t.Fatalf("Submit() unexpected error: %v", err)
+			}
+			if err := client.SubmitWithAgent(ctx, "test-register-id", Trojan, traffics); err != nil {
+				t.Fatalf("SubmitWithAgent() unexpected error: %v", err)
+			}
+			stats := &TrafficStats{Count: 500, UserIds: make([]int, 500)}
+			if err := client.SubmitStatsWithAgent(ctx, "test-register-id", Trojan, stats); err != nil {
+				t.Fatalf("SubmitStatsWithAgent() unexpected error: %v", err)
+			}
+
+			plain, _ := json.Marshal(map[string]any{"register_id": "test-register-id", "data": traffics})
+			for i := 0; i < 3; i++ {
+				record := <-records
+				if record.encoding != string(encoding) {
+					t.Fatalf("Expected %s body, got %q", encoding, record.encoding)
+				}
+				if record.body["register_id"] != "test-register-id" {
+					t.Fatalf("Expected the decoded body to keep its fields, got %v", record.body)
+				}
+				if i == 0 && record.size >= len(plain)/2 {
+					t.Fatalf("Expected a compressed body, got %d bytes for %d plain", record.size, len(plain))
+				}
+			}
+		})
+	}
+}
+
+func TestRequestCompressionThreshold(t *testing.T) {
+	records := make(chan submitRecord, 1)
+	server := newDecodingServer(t, records)
+	client := newTestClientWith(t, server.URL, Config{
+		Compression: &CompressionConfig{Request: EncodingGzip, MinRequestSize: 4096},
+	})
+
+	if err := client.Submit(context.Background(), "test-register-id", Trojan, manyTraffics(1)); err != nil {
+		t.Fatalf("Submit() unexpected error: %v", err)
+	}
+	if record := <-records; record.encoding != "" {
+		t.Fatalf("Expected a small body to be sent uncompressed, got %q", record.encoding)
+	}
+}
+
+func TestRequestCompressionRetry(t *testing.T) {
+	var hits atomic.Int32
+	records := make(chan submitRecord, 1)
+	decoding := newDecodingServer(t, records)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) == 1 {
+			// fail before reading, the retry must resend the whole compressed body
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		decoding.Config.Handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	client := newTestClientWith(t, server.URL, Config{
+		Retry:       &RetryPolicy{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+		Compression: &CompressionConfig{Request: EncodingZstd},
+	})
+
+	// SubmitWithAgent is deduplicated by batch id, so it is retried
+	if err := client.SubmitWithAgent(context.Background(), "test-register-id", Trojan, manyTraffics(200)); err != nil {
+		t.Fatalf("SubmitWithAgent() unexpected error: %v", err)
+	}
+	if hits.Load() != 2 {
+		t.Fatalf("Expected a retry, got %d requests", hits.Load())
+	}
+	if record := <-records; record.encoding != "zstd" || len(record.body["data"].([]any)) != 200 {
+		t.Fatalf("Expected the retried body to decode, got %q", record.encoding)
+	}
+}
+
+// newEncodingServer answer a users list compressed with the first encoding the client accepts
+func newEncodingServer(t *testing.T, accepted *atomic.Value) *httptest.Server {
+	t.Helper()
+	body := usersBody(500)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accept := r.Header.Get("Accept-Encoding")
+		accepted.Store(accept)
+		w.Header().Set("Content-Type", "application/json")
+		var buf bytes.Buffer
+		switch {
+		case bytes.Contains([]byte(accept), []byte("zstd")):
+			enc, _ := zstd.NewWriter(&buf)
+			_, _ = enc.Write(body)
+			_ = enc.Close()
+			w.Header().Set("Content-Encoding", "zstd")
+		case bytes.Contains([]byte(accept), []byte("gzip")):
+			gz := gzip.NewWriter(&buf)
+			_, _ = gz.Write(body)
+			_ = gz.Close()
+			w.Header().Set("Content-Encoding", "gzip")
+		default:
+			buf.Write(body)
+		}
+		_, _ = w.Write(buf.Bytes())
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestResponseDecompression(t *testing.T) {
+	var accepted atomic.Value
+	server := newEncodingServer(t, &accepted)
+	client := newTestClient(t, server.URL)
+	ctx := context.Background()
+
+	users, err := client.Users(ctx, "test-register-id", Trojan)
+	if err != nil || len(*users) != 500 {
+		t.Fatalf("Users() unexpected result: %v", err)
+	}
+	if accepted.Load() != acceptEncoding {
+		t.Fatalf("Expected Accept-Encoding %q, got %q", acceptEncoding, accepted.Load())
+	}
+
+	count := 0
+	for _, err := range client.UsersIter(ctx, "test-register-id", Trojan) {
+		if err != nil {
+			t.Fatalf("UsersIter() unexpected error: %v", err)
+		}
+		count++
+	}
+	if count != 500 {
+		t.Fatalf("Expected the streamed body to be decoded, got %d users", count)
+	}
+}
+
+func TestResponseDecompressionDisabled(t *testing.T) {
+	var accepted atomic.Value
+	server := newEncodingServer(t, &accepted)
+	client := newTestClientWith(t, server.URL, Config{
+		Compression: &CompressionConfig{DisableResponse: true},
+	})
+
+	users, err := client.Users(context.Background(), "test-register-id", Trojan)
+	if err != nil || len(*users) != 500 {
+		t.Fatalf("Users() unexpected result: %v", err)
+	}
+	// the transport default still handles gzip
+	if accepted.Load() != "gzip" {
+		t.Fatalf("Expected only the transport gzip default, got %q", accepted.Load())
+	}
+}
+
+func TestResponseDecompressionCorrupt(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "zstd")
+		_, _ = w.Write([]byte("not zstd"))
+	}))
+	t.Cleanup(server.Close)
+	client := newTestClientWith(t, server.URL, Config{
+		Retry: &RetryPolicy{MaxAttempts: 1},
+	})
+
+	_, err := client.Users(context.Background(), "test-register-id", Trojan)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || !apiErr.IsNetworkError() {
+		t.Fatalf("Expected a body read error, got %v", err)
+	}
+}
@@ -1,6 +1,9 @@
 package pkg
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 )
@@ -17,16 +20,50 @@ const (
 	ErrorTypeNetworkError ErrorType = "NetworkError" // 网络连接错误
 	ErrorTypeParseError   ErrorType = "ParseError"   // 响应解析错误
 	ErrorTypeNotModified  ErrorType = "NotModified"  // 304 Not Modified
+	ErrorTypeCircuitOpen  ErrorType = "CircuitOpen"  // 熔断器打开，请求未发出
+	ErrorTypeRateLimited  ErrorType = "RateLimited"  // 客户端限流，请求未发出
+	ErrorTypeAborted      ErrorType = "Aborted"      // 请求钩子中止，请求未发出
+	ErrorTypeInvalidInput ErrorType = "InvalidInput" // 调用参数错误（节点类型、配置类型等），请求未发出
+	ErrorTypeIOError      ErrorType = "IOError"      // 本地文件读写错误
 	ErrorTypeUnknown      ErrorType = "Unknown"      // 未知错误
 )
 
+// 面板错误码，对应错误响应体中的 code 字段
+const (
+	CodeNodeNotFound    = "node_not_found"   // 节点不存在或已删除
+	CodeUnauthorized    = "unauthorized"     // token 无效
+	CodeRegisterExpired = "register_expired" // register_id 已过期，需要重新注册
+	CodeRevisionExpired = "revision_expired" // 用户增量同步的版本过旧，需要全量同步
+)
+
+// 哨兵错误，配合 errors.Is 使用
+var (
+	ErrNodeNotFound    = errors.New("node not found")
+	ErrUnauthorized    = errors.New("unauthorized")
+	ErrRegisterExpired = errors.New("register id expired")
+	ErrRevisionExpired = errors.New("users revision expired")
+)
+
+// ErrorCodes 面板错误码到哨兵错误的映射
+// 面板使用其他错误码时可在初始化阶段追加，运行期间不要修改
+var ErrorCodes = map[string]error{
+	CodeNodeNotFound:    ErrNodeNotFound,
+	CodeUnauthorized:    ErrUnauthorized,
+	CodeRegisterExpired: ErrRegisterExpired,
+	CodeRevisionExpired: ErrRevisionExpired,
+}
+
 // APIError 自定义API错误类型
 type APIError struct {
-	StatusCode int       // HTTP状态码
-	Type       ErrorType // 错误类型
-	Message    string    // 错误消息
-	URL        string    // 请求的URL
-	Err        error     // 原始错误
+	StatusCode  int                 // HTTP状态码
+	Type        ErrorType           // 错误类型
+	Message     string              // 错误消息
+	URL         string              // 请求的URL
+	Err         error               // 原始错误
+	Code        string              // 面板错误码，数字错误码会转为字符串
+	RequestID   string              // 面板请求ID，用于排查问题
+	FieldErrors map[string][]string // 参数校验错误，字段名到错误消息
+	Body        string              // 原始响应体
 }
 
 // Error 实现error接口
@@ -42,6 +79,23 @@ func (e *APIError) Unwrap() error {
 	return e.Err
 }
 
+// Is 实现errors.Is接口，按错误码匹配哨兵错误
+// 没有错误码时 401/403 视为 ErrUnauthorized，410 视为 ErrRevisionExpired
+func (e *APIError) Is(target error) bool {
+	if e.Code != "" {
+		if sentinel, ok := ErrorCodes[e.Code]; ok && sentinel == target {
+			return true
+		}
+	}
+	switch target {
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+	case ErrRevisionExpired:
+		return e.StatusCode == http.StatusGone
+	}
+	return false
+}
+
 // IsClientError 判断是否为客户端错误 (4xx)
 // 客户端错误表示请求有问题，调用方需要修正请求参数、认证信息等
 func (e *APIError) IsClientError() bool {
@@ -69,6 +123,31 @@ func (e *APIError) IsNotModified() bool {
 	return e.StatusCode == http.StatusNotModified || e.Type == ErrorTypeNotModified
 }
 
+// IsCircuitOpen 判断是否因熔断器打开而快速失败
+func (e *APIError) IsCircuitOpen() bool {
+	return e.Type == ErrorTypeCircuitOpen
+}
+
+// IsRateLimited 判断是否因客户端限流而快速失败
+func (e *APIError) IsRateLimited() bool {
+	return e.Type == ErrorTypeRateLimited
+}
+
+// IsAborted 判断是否被请求钩子中止
+func (e *APIError) IsAborted() bool {
+	return e.Type == ErrorTypeAborted
+}
+
+// IsInvalidInput 判断是否为调用参数错误
+func (e *APIError) IsInvalidInput() bool {
+	return e.Type == ErrorTypeInvalidInput
+}
+
+// IsIOError 判断是否为本地文件读写错误
+func (e *APIError) IsIOError() bool {
+	return e.Type == ErrorTypeIOError
+}
+
 // NewAPIError 创建一个新的API错误
 func NewAPIError(statusCode int, errorType ErrorType, message string, url string, err error) *APIError {
 	return &APIError{
@@ -86,6 +165,86 @@ func NewAPIErrorFromStatusCode(statusCode int, message string, url string, err e
 	return NewAPIError(statusCode, errorType, message, url, err)
 }
 
+// NewAPIErrorFromResponse 根据面板错误响应创建错误
+// 响应体为 JSON 错误信封时解析 message、code、request_id 和 errors 字段，否则原始响应体作为错误消息
+//
+//	{"message": "node not found", "code": "node_not_found", "request_id": "abc", "errors": {"port": ["invalid"]}}
+func NewAPIErrorFromResponse(statusCode int, body []byte, url string) *APIError {
+	apiErr := NewAPIErrorFromStatusCode(statusCode, string(body), url, nil)
+	apiErr.Body = string(body)
+	envelope, ok := parseErrorEnvelope(body)
+	if !ok {
+		return apiErr
+	}
+	if envelope.Message != "" {
+		apiErr.Message = envelope.Message
+	}
+	apiErr.Code = envelope.code()
+	apiErr.RequestID = envelope.RequestID
+	apiErr.FieldErrors = envelope.fieldErrors()
+	return apiErr
+}
+
+// errorEnvelope 面板错误响应体
+type errorEnvelope struct {
+	Message   string                     `json:"message"`
+	Code      json.RawMessage            `json:"code"`
+	RequestID string                     `json:"request_id"`
+	Errors    map[string]json.RawMessage `json:"errors"`
+}
+
+// parseErrorEnvelope 解析错误信封，响应体不是 JSON 对象或不含任何已知字段时返回 false
+func parseErrorEnvelope(body []byte) (errorEnvelope, bool) {
+	var envelope errorEnvelope
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 || body[0] != '{' {
+		return envelope, false
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return envelope, false
+	}
+	ok := envelope.Message != "" || len(envelope.Code) > 0 || envelope.RequestID != "" || len(envelope.Errors) > 0
+	return envelope, ok
+}
+
+// code 错误码可能是字符串或数字
+func (e errorEnvelope) code() string {
+	if len(e.Code) == 0 || string(e.Code) == "null" {
+		return ""
+	}
+	var s string
+	if err := json.Unmarshal(e.Code, &s); err == nil {
+		return s
+	}
+	var n json.Number
+	if err := json.Unmarshal(e.Code, &n); err == nil {
+		return n.String()
+	}
+	return ""
+}
+
+// fieldErrors 字段错误可能是字符串或字符串数组
+func (e errorEnvelope) fieldErrors() map[string][]string {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	fields := make(map[string][]string, len(e.Errors))
+	for field, raw := range e.Errors {
+		var messages []string
+		if err := json.Unmarshal(raw, &messages); err == nil {
+			fields[field] = messages
+			continue
+		}
+		var message string
+		if err := json.Unmarshal(raw, &message); err == nil {
+			fields[field] = []string{message}
+			continue
+		}
+		fields[field] = []string{string(raw)}
+	}
+	return fields
+}
+
 // getErrorTypeFromStatusCode 根据HTTP状态码获取对应的错误类型
 func getErrorTypeFromStatusCode(statusCode int) ErrorType {
 	if statusCode == http.StatusNotModified {
@@ -117,6 +276,35 @@ func NewNotModifiedError() *APIError {
 	return NewAPIError(http.StatusNotModified, ErrorTypeNotModified, "content not modified", "", nil)
 }
 
+// NewCircuitOpenError 创建熔断错误
+// 熔断器处于打开状态时请求不会发出，调用方应等待冷却后再试
+func NewCircuitOpenError(url string) *APIError {
+	return NewAPIError(0, ErrorTypeCircuitOpen, "circuit breaker is open", url, nil)
+}
+
+// NewRateLimitedError 创建限流错误
+// 在 context 截止时间内拿不到令牌时返回，请求不会发出
+func NewRateLimitedError(url string) *APIError {
+	return NewAPIError(0, ErrorTypeRateLimited, "client rate limit exceeded", url, nil)
+}
+
+// NewAbortedError 创建钩子中止错误
+// BeforeRequestHook 返回错误时请求不会发出，也不会重试，err 为钩子返回的原始错误
+func NewAbortedError(url string, err error) *APIError {
+	return NewAPIError(0, ErrorTypeAborted, "request aborted by hook", url, err)
+}
+
+// NewInvalidInputError 创建调用参数错误
+// 参数在本地校验失败，请求不会发出，调用方需修正参数后再试
+func NewInvalidInputError(message string, err error) *APIError {
+	return NewAPIError(0, ErrorTypeInvalidInput, message, "", err)
+}
+
+// NewIOError 创建本地文件读写错误
+func NewIOError(message string, err error) *APIError {
+	return NewAPIError(0, ErrorTypeIOError, message, "", err)
+}
+
 // NewBusinessLogicError 创建业务逻辑错误
 // 业务逻辑错误通常来自API响应中的Message字段，默认视为服务端错误(500)
 func NewBusinessLogicError(message string, url string) *APIError {
@@ -1,9 +1,12 @@
 package pkg
 
 import (
+	"cmp"
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 )
 
@@ -249,6 +252,33 @@ func TestErrorFactoryFunctions(t *testing.T) {
 			wantType:      ErrorTypeNotModified,
 			wantServerErr: false,
 		},
+		{
+			name: "NewCircuitOpenError",
+			factoryFunc: func() *APIError {
+				return NewCircuitOpenError("http://example.com")
+			},
+			wantStatus:    0,
+			wantType:      ErrorTypeCircuitOpen,
+			wantServerErr: false,
+		},
+		{
+			name: "NewRateLimitedError",
+			factoryFunc: func() *APIError {
+				return NewRateLimitedError("http://example.com")
+			},
+			wantStatus:    0,
+			wantType:      ErrorTypeRateLimited,
+			wantServerErr: false,
+		},
+		{
+			name: "NewAbortedError",
+			factoryFunc: func() *APIError {
+				return NewAbortedError("http://example.com", errors.New("denied"))
+			},
+			wantStatus:    0,
+			wantType:      ErrorTypeAborted,
+			wantServerErr: false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -292,6 +322,18 @@ func TestAPIError_SpecialMethods(t *testing.T) {
 		}
 	})
 
+	t.Run("IsCircuitOpen", func(t *testing.T) {
+		err := NewCircuitOpenError("")
+		if !err.IsCircuitOpen() {
+			t.Error("IsCircuitOpen() should return true for circuit open error")
+		}
+
+		err2 := NewNetworkError("network failed", "", nil)
+		if err2.IsCircuitOpen() {
+			t.Error("IsCircuitOpen() should return false for network error")
+		}
+	})
+
 	t.Run("IsNotModified", func(t *testing.T) {
 		err := NewNotModifiedError()
 		if !err.IsNotModified() {
@@ -309,3 +351,407 @@ func TestAPIError_SpecialMethods(t *testing.T) {
 		}
 	})
 }
+
+func TestNewAPIErrorFromResponse(t *testing.T) {
+	tests := []struct {
+		name        string
+		statusCode  int
+		body        string
+		wantMessage string
+		wantCode    string
+		wantReqID   string
+		wantFields  map[string][]string
+	}{
+		{
+			name:        "full envelope",
+			statusCode:  422,
+			body:        `{"message":"invalid params","code":"invalid_params","request_id":"req-1","errors":{"port":["must be positive","required"],"host":"required"}}`,
+			wantMessage: "invalid params",
+			wantCode:    "invalid_params",
+			wantReqID:   "req-1",
+			wantFields:  map[string][]string{"port": {"must be positive", "required"}, "host": {"required"}},
+		},
+		{
+			name:        "numeric code",
+			statusCode:  404,
+			body:        `{"message":"node not found","code":40401}`,
+			wantMessage: "node not found",
+			wantCode:    "40401",
+		},
+		{
+			name:        "plain text body",
+			statusCode:  502,
+			body:        "bad gateway",
+			wantMessage: "bad gateway",
+		},
+		{
+			name:        "unrelated json",
+			statusCode:  500,
+			body:        `{"data":null}`,
+			wantMessage: `{"data":null}`,
+		},
+		{
+			name:        "empty body",
+			statusCode:  500,
+			body:        "",
+			wantMessage: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := NewAPIErrorFromResponse(tt.statusCode, []byte(tt.body), "http://example.com")
+			if err.StatusCode != tt.statusCode || err.Type != getErrorTypeFromStatusCode(tt.statusCode) {
+				t.Errorf("StatusCode = %v, Type = %v", err.StatusCode, err.Type)
+			}
+			if err.Message != tt.wantMessage {
+				t.Errorf("Message = %q, want %q", err.Message, tt.wantMessage)
+			}
+			if err.Code != tt.wantCode {
+				t.Errorf("Code = %q, want %q", err.Code, tt.wantCode)
+			}
+			if err.RequestID != tt.wantReqID {
+				t.Errorf("RequestID = %q, want %q", err.RequestID, tt.wantReqID)
+			}
+			if err.Body != tt.body {
+				t.Errorf("Body = %q, want %q", err.Body, tt.body)
+			}
+			if len(err.FieldErrors) != len(tt.wantFields) {
+				t.Fatalf("FieldErrors = %v, want %v", err.FieldErrors, tt.wantFields)
+			}
+			for field, want := range tt.wantFields {
+				if fmt.Sprint(err.FieldErrors[field]) != fmt.Sprint(want) {
+					t.Errorf("FieldErrors[%s] = %v, want %v", field, err.FieldErrors[field], want)
+				}
+			}
+		})
+	}
+}
+
+func TestAPIError_Sentinels(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		body       string
+		want       error
+		notWant    []error
+	}{
+		{
+			name:       "node not found code",
+			statusCode: 404,
+			body:       `{"message":"node not found","code":"node_not_found"}`,
+			want:       ErrNodeNotFound,
+			notWant:    []error{ErrUnauthorized, ErrRegisterExpired},
+		},
+		{
+			name:       "register expired code",
+			statusCode: 400,
+			body:       `{"message":"register id expired","code":"register_expired"}`,
+			want:       ErrRegisterExpired,
+			notWant:    []error{ErrNodeNotFound, ErrUnauthorized},
+		},
+		{
+			name:       "unauthorized code",
+			statusCode: 400,
+			body:       `{"message":"token is error","code":"unauthorized"}`,
+			want:       ErrUnauthorized,
+		},
+		{
+			name:       "401 without code",
+			statusCode: 401,
+			body:       "unauthorized",
+			want:       ErrUnauthorized,
+		},
+		{
+			name:       "403 without code",
+			statusCode: 403,
+			body:       `{"message":"token is error"}`,
+			want:       ErrUnauthorized,
+		},
+		{
+			name:       "plain 404 is not node not found",
+			statusCode: 404,
+			body:       "not found",
+			notWant:    []error{ErrNodeNotFound, ErrUnauthorized, ErrRegisterExpired},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error = NewAPIErrorFromResponse(tt.statusCode, []byte(tt.body), "")
+			// sentinels also match through wrapping
+			err = fmt.Errorf("sync users: %w", err)
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("errors.Is(%v) = false, want true", tt.want)
+			}
+			for _, sentinel := range tt.notWant {
+				if errors.Is(err, sentinel) {
+					t.Errorf("errors.Is(%v) = true, want false", sentinel)
+				}
+			}
+		})
+	}
+}
+
+func TestClientErrorEnvelope(t *testing.T) {
+	server := newTestServer(t, 404, map[string]any{
+		"message":    "node not found",
+		"code":       CodeNodeNotFound,
+		"request_id": "req-42",
+	})
+	client := newTestClient(t, server.URL)
+
+	_, err := client.Config(context.Background(), 1, Trojan)
+	if !errors.Is(err, ErrNodeNotFound) {
+		t.Fatalf("Expected ErrNodeNotFound, got %v", err)
+	}
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Message != "node not found" || apiErr.RequestID != "req-42" {
+		t.Fatalf("Expected parsed envelope, got %+v", apiErr)
+	}
+}
+
+// clientCalls every public Client method, reduced to its error
+var clientCalls = []struct {
+	name string
+	// parses reports whether the method decodes the response body
+	parses bool
+	call   func(c *Client) error
+}{
+	{"RawConfig", false, func(c *Client) error {
+		_, err := c.RawConfig(context.Background(), 1, Trojan)
+		return err
+	}},
+	{"Config", true, func(c *Client) error {
+		_, err := c.Config(context.Background(), 1, Trojan)
+		return err
+	}},
+	{"Register", true, func(c *Client) error {
+		_, err := c.Register(context.Background(), 1, Trojan, "host", 443, "")
+		return err
+	}},
+	{"Unregister", true, func(c *Client) error {
+		return c.Unregister(context.Background(), Trojan, "test-register-id")
+	}},
+	{"RawUsers", false, func(c *Client) error {
+		_, err := c.RawUsers(context.Background(), "test-register-id", Trojan)
+		return err
+	}},
+	{"Users", true, func(c *Client) error {
+		_, err := c.Users(context.Background(), "test-register-id", Trojan)
+		return err
+	}},
+	{"RawUsersByNodeId", false, func(c *Client) error {
+		_, err := c.RawUsersByNodeId(context.Background(), 1, Trojan)
+		return err
+	}},
+	{"UsersByNodeId", true, func(c *Client) error {
+		_, err := c.UsersByNodeId(context.Background(), 1, Trojan)
+		return err
+	}},
+	{"Submit", true, func(c *Client) error {
+		return c.Submit(context.Background(), "test-register-id", Trojan, nil)
+	}},
+	{"SubmitWithAgent", true, func(c *Client) error {
+		return c.SubmitWithAgent(context.Background(), "test-register-id", Trojan, nil)
+	}},
+	{"SubmitStatsWithAgent", true, func(c *Client) error {
+		return c.SubmitStatsWithAgent(context.Background(), "test-register-id", Trojan, &TrafficStats{})
+	}},
+	{"Heartbeat", true, func(c *Client) error {
+		return c.Heartbeat(context.Background(), "test-register-id", Trojan, "")
+	}},
+	{"Verify", true, func(c *Client) error {
+		_, err := c.Verify(context.Background(), "test-register-id", Trojan)
+		return err
+	}},
+	{"SubmitOnlineUsers", true, func(c *Client) error {
+		return c.SubmitOnlineUsers(context.Background(), "test-register-id", Trojan, map[int][]string{1: {"1.2.3.4"}})
+	}},
+	{"SubmitNodeStatus", true, func(c *Client) error {
+		return c.SubmitNodeStatus(context.Background(), "test-register-id", Trojan, &NodeStatus{})
+	}},
+	{"SubmitViolations", true, func(c *Client) error {
+		return c.SubmitViolations(context.Background(), "test-register-id", Trojan, []Violation{{UID: 1}})
+	}},
+	{"AuditRules", true, func(c *Client) error {
+		_, err := c.AuditRules(context.Background(), 1, Trojan)
+		return err
+	}},
+	{"NodeCert", true, func(c *Client) error {
+		_, err := c.NodeCert(context.Background(), 1, Trojan)
+		return err
+	}},
+	{"SyncUsers", true, func(c *Client) error {
+		_, err := c.SyncUsers(context.Background(), "test-register-id", Trojan, NewUserSet())
+		return err
+	}},
+	// the batch calls fall back to per-node calls on a 404, whose errors are in the results
+	{"HeartbeatBatch", true, func(c *Client) error {
+		results, err := c.HeartbeatBatch(context.Background(), []NodeHeartbeat{{RegisterId: "a", NodeType: Trojan}})
+		return cmp.Or(err, results["a"])
+	}},
+	{"UsersBatch", true, func(c *Client) error {
+		node := NodeKey{NodeId: 1, NodeType: Trojan}
+		results, err := c.UsersBatch(context.Background(), []NodeKey{node})
+		return cmp.Or(err, results[node].Err)
+	}},
+}
+
+func TestClientErrorMatrix(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	rawServer := func(status int, body string) string {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte(body))
+		}))
+		t.Cleanup(server.Close)
+		return server.URL
+	}
+
+	scenarios := []struct {
+		name     string
+		host     string
+		wantType ErrorType
+		classify func(e *APIError) bool
+		// parseOnly scenario only fails for methods that decode the body
+		parseOnly bool
+	}{
+		{"network", down.URL, ErrorTypeNetworkError, (*APIError).IsNetworkError, false},
+		{"4xx", rawServer(http.StatusNotFound, `{"message":"not found"}`), ErrorTypeClientError, (*APIError).IsClientError, false},
+		{"5xx", rawServer(http.StatusInternalServerError, "boom"), ErrorTypeServerError, (*APIError).IsServerError, false},
+		{"invalid json", rawServer(http.StatusOK, "{invalid"), ErrorTypeParseError, (*APIError).IsParseError, true},
+	}
+
+	for _, sc := range scenarios {
+		client := newTestClientWith(t, sc.host, Config{
+			Retry: &RetryPolicy{MaxAttempts: 1},
+		})
+		for _, cc := range clientCalls {
+			if sc.parseOnly && !cc.parses {
+				continue
+			}
+			t.Run(sc.name+"/"+cc.name, func(t *testing.T) {
+				err := cc.call(client)
+				var apiErr *APIError
+				if !errors.As(err, &apiErr) {
+					t.Fatalf("Expected *APIError, got %T %v", err, err)
+				}
+				if apiErr.Type != sc.wantType || !sc.classify(apiErr) {
+					t.Fatalf("Type = %v, want %v", apiErr.Type, sc.wantType)
+				}
+			})
+		}
+	}
+}
+
+func TestHelperErrorMatrix(t *testing.T) {
+	tests := []struct {
+		name     string
+		call     func() error
+		wantType ErrorType
+	}{
+		{"AsConfig nil", func() error {
+			_, err := AsConfig[*TrojanConfig]((*TrojanConfig)(nil))
+			return err
+		}, ErrorTypeInvalidInput},
+		{"AsConfig mismatch", func() error {
+			_, err := AsConfig[*TrojanConfig](&VMessConfig{})
+			return err
+		}, ErrorTypeInvalidInput},
+		{"AsVMessConfig", func() error {
+			_, err := AsVMessConfig(&TrojanConfig{})
+			return err
+		}, ErrorTypeInvalidInput},
+		{"AsHysteriaConfig", func() error {
+			_, err := AsHysteriaConfig(&TrojanConfig{})
+			return err
+		}, ErrorTypeInvalidInput},
+		{"AsHysteria2Config", func() error {
+			_, err := AsHysteria2Config(&TrojanConfig{})
+			return err
+		}, ErrorTypeInvalidInput},
+		{"AsTrojanConfig", func() error {
+			_, err := AsTrojanConfig(&VMessConfig{})
+			return err
+		}, ErrorTypeInvalidInput},
+		{"AsShadowsocksConfig", func() error {
+			_, err := AsShadowsocksConfig(&TrojanConfig{})
+			return err
+		}, ErrorTypeInvalidInput},
+		{"AsAnyTLSConfig", func() error {
+			_, err := AsAnyTLSConfig(&TrojanConfig{})
+			return err
+		}, ErrorTypeInvalidInput},
+		{"AsTuicConfig", func() error {
+			_, err := AsTuicConfig(&TrojanConfig{})
+			return err
+		}, ErrorTypeInvalidInput},
+		{"UnmarshalConfig", func() error {
+			_, err := UnmarshalConfig[TrojanConfig]([]byte("{invalid"))
+			return err
+		}, ErrorTypeParseError},
+		{"UnmarshalHysteria2Config", func() error {
+			_, err := UnmarshalHysteria2Config([]byte("{invalid"))
+			return err
+		}, ErrorTypeParseError},
+		{"UnmarshalHysteriaConfig", func() error {
+			_, err := UnmarshalHysteriaConfig([]byte("{invalid"))
+			return err
+		}, ErrorTypeParseError},
+		{"UnmarshalTrojanConfig", func() error {
+			_, err := UnmarshalTrojanConfig([]byte("{invalid"))
+			return err
+		}, ErrorTypeParseError},
+		{"UnmarshalShadowsocksConfig", func() error {
+			_, err := UnmarshalShadowsocksConfig([]byte("{invalid"))
+			return err
+		}, ErrorTypeParseError},
+		{"UnmarshalVMessConfig", func() error {
+			_, err := UnmarshalVMessConfig([]byte("{invalid"))
+			return err
+		}, ErrorTypeParseError},
+		{"UnmarshalAnyTLSConfig", func() error {
+			_, err := UnmarshalAnyTLSConfig([]byte("{invalid"))
+			return err
+		}, ErrorTypeParseError},
+		{"UnmarshalTuicConfig", func() error {
+			_, err := UnmarshalTuicConfig([]byte("{invalid"))
+			return err
+		}, ErrorTypeParseError},
+		{"UnmarshalUsers", func() error {
+			_, err := UnmarshalUsers([]byte("{invalid"))
+			return err
+		}, ErrorTypeParseError},
+		{"ParseDestination without port", func() error {
+			_, err := ParseDestination("example.com")
+			return err
+		}, ErrorTypeInvalidInput},
+		{"ParseDestination invalid port", func() error {
+			_, err := ParseDestination("example.com:http")
+			return err
+		}, ErrorTypeInvalidInput},
+		{"Config invalid node type", func() error {
+			client := newTestClient(t, "http://127.0.0.1:1")
+			_, err := client.Config(context.Background(), 1, NodeType("unknown"))
+			return err
+		}, ErrorTypeInvalidInput},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.call()
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("Expected *APIError, got %T %v", err, err)
+			}
+			if apiErr.Type != tt.wantType {
+				t.Fatalf("Type = %v, want %v", apiErr.Type, tt.wantType)
+			}
+			if apiErr.IsServerError() || apiErr.IsNetworkError() {
+				t.Fatalf("Expected a local error, got %v", apiErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package pkg
+
+import (
+	"context"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Host a panel endpoint used for failover
+type Host struct {
+	// URL base URL of the panel, same format as Config.APIHost
+	URL string
+	// Weight relative share of requests when no host is preferred yet or the
+	// preferred one failed. When all weights are zero hosts are tried in order.
+	Weight int
+}
+
+// FailoverConfig multi-host failover options, zero fields use the defaults
+type FailoverConfig struct {
+	// ProbeInterval how often failed hosts are probed, defaults to 30s
+	ProbeInterval time.Duration
+	// ProbePath path requested when probing, defaults to "/".
+	// Any response below 500 marks the host healthy again.
+	ProbePath string
+	// ProbeTimeout timeout of a single probe, defaults to 5s
+	ProbeTimeout time.Duration
+}
+
+func (f *FailoverConfig) withDefaults() FailoverConfig {
+	var config FailoverConfig
+	if f != nil {
+		config = *f
+	}
+	if config.ProbeInterval <= 0 {
+		config.ProbeInterval = 30 * time.Second
+	}
+	if config.ProbePath == "" {
+		config.ProbePath = "/"
+	}
+	if config.ProbeTimeout <= 0 {
+		config.ProbeTimeout = 5 * time.Second
+	}
+	return config
+}
+
+// hostState health of a single host
+type hostState struct {
+	url     string
+	weight  int
+	healthy atomic.Bool
+}
+
+// hostPool tracks the health of the panel hosts and picks the order to try them in
+type hostPool struct {
+	hosts    []*hostState
+	weighted bool
+	config   FailoverConfig
+	probe    func(ctx context.Context, url string) bool
+
+	preferred atomic.Pointer[hostState]
+
+	mu      sync.Mutex
+	probing bool
+	done    chan struct{}
+	closed  bool
+}
+
+func newHostPool(apiHost string, hosts []Host, config *FailoverConfig, probe func(ctx context.Context, url string) bool) *hostPool {
+	if len(hosts) == 0 {
+		hosts = []Host{{URL: apiHost}}
+	}
+	p := &hostPool{
+		config: config.withDefaults(),
+		probe:  probe,
+		done:   make(chan struct{}),
+	}
+	for _, h := range hosts {
+		state := &hostState{url: h.URL, weight: h.Weight}
+		state.healthy.Store(true)
+		p.hosts = append(p.hosts, state)
+		if h.Weight > 0 {
+			p.weighted = true
+		}
+	}
+	return p
+}
+
+// primary return the host reported when no request was made
+func (p *hostPool) primary() string {
+	if h := p.preferred.Load(); h != nil {
+		return h.url
+	}
+	return p.hosts[0].url
+}
+
+// candidates return the hosts to try for a request: the preferred host,
+// then the other healthy hosts. When no host is healthy all are returned.
+func (p *hostPool) candidates() []*hostState {
+	if len(p.hosts) == 1 {
+		return p.hosts
+	}
+	preferred := p.preferred.Load()
+	if preferred != nil && !preferred.healthy.Load() {
+		preferred = nil
+	}
+
+	healthy := make([]*hostState, 0, len(p.hosts))
+	for _, h := range p.hosts {
+		if h != preferred && h.healthy.Load() {
+			healthy = append(healthy, h)
+		}
+	}
+	if p.weighted {
+		healthy = weightedShuffle(healthy)
+	}
+	if preferred != nil {
+		healthy = append([]*hostState{preferred}, healthy...)
+	}
+	if len(healthy) == 0 {
+		return p.hosts
+	}
+	return healthy
+}
+
+// markHealthy record a successful request to h, which becomes the preferred host
+func (p *hostPool) markHealthy(h *hostState) {
+	h.healthy.Store(true)
+	p.preferred.Store(h)
+}
+
+// markFailed record a failed request to h and start probing it
+func (p *hostPool) markFailed(h *hostState) {
+	if len(p.hosts) == 1 || !h.healthy.Swap(false) {
+		return
+	}
+	p.preferred.CompareAndSwap(h, nil)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.probing || p.closed {
+		return
+	}
+	p.probing = true
+	go p.probeLoop()
+}
+
+// probeLoop probe the failed hosts until all are healthy again or the pool is closed
+func (p *hostPool) probeLoop() {
+	ticker := time.NewTicker(p.config.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+
+		failed := 0
+		for _, h := range p.hosts {
+			if h.healthy.Load() {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), p.config.ProbeTimeout)
+			ok := p.probe(ctx, h.url+p.config.ProbePath)
+			cancel()
+			if ok {
+				h.healthy.Store(true)
+			} else {
+				failed++
+			}
+		}
+
+		if failed == 0 {
+			p.mu.Lock()
+			// a host may have failed again between the check and the lock
+			if !slices.ContainsFunc(p.hosts, func(h *hostState) bool { return !h.healthy.Load() }) {
+				p.probing = false
+				p.mu.Unlock()
+				return
+			}
+			p.mu.Unlock()
+		}
+	}
+}
+
+// close stop probing
+func (p *hostPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.closed {
+		p.closed = true
+		close(p.done)
+	}
+}
+
+// weightedShuffle order hosts randomly, each position picked proportionally to weight
+func weightedShuffle(hosts []*hostState) []*hostState {
+	total := 0
+	for _, h := range hosts {
+		total += max(h.weight, 0)
+	}
+	rest := slices.Clone(hosts)
+	ordered := make([]*hostState, 0, len(hosts))
+	for total > 0 {
+		n := rand.IntN(total)
+		for i, h := range rest {
+			w := max(h.weight, 0)
+			if n < w {
+				ordered = append(ordered, h)
+				rest = slices.Delete(rest, i, i+1)
+				total -= w
+				break
+			}
+			n -= w
+		}
+	}
+	// hosts without weight go last, in order
+	return append(ordered, rest...)
+}
@@ -0,0 +1,269 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newSwitchServer answers with the status stored in status and counts requests
+func newSwitchServer(t *testing.T, status *atomic.Int32, hits *atomic.Int32) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		code := int(status.Load())
+		w.WriteHeader(code)
+		if code < 400 {
+			_, _ = w.Write([]byte(`{"data":true,"message":"success"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"message":"failed"}`))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestFailoverOnServerError(t *testing.T) {
+	var status1, status2, hits1, hits2 atomic.Int32
+	status1.Store(500)
+	status2.Store(200)
+	server1 := newSwitchServer(t, &status1, &hits1)
+	server2 := newSwitchServer(t, &status2, &hits2)
+	client := newTestClientWith(t, "", Config{
+		APIHosts: []Host{{URL: server1.URL}, {URL: server2.URL}},
+		Retry:    &RetryPolicy{MaxAttempts: 1},
+		Failover: &FailoverConfig{ProbeInterval: time.Hour},
+	})
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if err := client.Heartbeat(ctx, "test-register-id", Trojan, ""); err != nil {
+			t.Fatalf("Heartbeat() unexpected error: %v", err)
+		}
+	}
+	// the failed host is skipped once the second one is preferred
+	if hits1.Load() != 1 || hits2.Load() != 3 {
+		t.Fatalf("Expected 1 and 3 requests, got %d and %d", hits1.Load(), hits2.Load())
+	}
+}
+
+func TestFailoverOnNetworkError(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	var status, hits atomic.Int32
+	status.Store(200)
+	server := newSwitchServer(t, &status, &hits)
+	client := newTestClientWith(t, "", Config{
+		APIHosts: []Host{{URL: down.URL}, {URL: server.URL}},
+		Retry:    &RetryPolicy{MaxAttempts: 1},
+		Failover: &FailoverConfig{ProbeInterval: time.Hour},
+	})
+
+	if err := client.Heartbeat(context.Background(), "test-register-id", Trojan, ""); err != nil {
+		t.Fatalf("Heartbeat() unexpected error: %v", err)
+	}
+	if hits.Load() != 1 {
+		t.Fatalf("Expected the healthy host to serve the request, got %d requests", hits.Load())
+	}
+}
+
+func TestFailoverErrorURL(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	var status, hits atomic.Int32
+	status.Store(404)
+	server := newSwitchServer(t, &status, &hits)
+	client := newTestClientWith(t, "", Config{
+		APIHosts: []Host{{URL: down.URL}, {URL: server.URL}},
+		Retry:    &RetryPolicy{MaxAttempts: 1},
+		Failover: &FailoverConfig{ProbeInterval: time.Hour},
+	})
+
+	err := client.Heartbeat(context.Background(), "test-register-id", Trojan, "")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || !apiErr.IsClientError() {
+		t.Fatalf("Expected client error, got %v", err)
+	}
+	if !strings.HasPrefix(apiErr.URL, server.URL) {
+		t.Fatalf("Expected URL of the host that answered %s, got %s", server.URL, apiErr.URL)
+	}
+}
+
+func TestFailoverNonIdempotent(t *testing.T) {
+	var status1, status2, hits1, hits2 atomic.Int32
+	status1.Store(500)
+	status2.Store(200)
+	server1 := newSwitchServer(t, &status1, &hits1)
+	server2 := newSwitchServer(t, &status2, &hits2)
+	client := newTestClientWith(t, "", Config{
+		APIHosts: []Host{{URL: server1.URL}, {URL: server2.URL}},
+		Retry:    &RetryPolicy{MaxAttempts: 1},
+		Failover: &FailoverConfig{ProbeInterval: time.Hour},
+	})
+
+	err := client.Submit(context.Background(), "test-register-id", Trojan, nil)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || !apiErr.IsServerError() {
+		t.Fatalf("Expected server error, got %v", err)
+	}
+	if hits2.Load() != 0 {
+		t.Fatal("Expected Submit not to be resent to another host after a 5xx")
+	}
+}
+
+func TestFailoverNonIdempotentTimeout(t *testing.T) {
+	var slowHits, fastHits, status atomic.Int32
+	status.Store(200)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slowHits.Add(1)
+		time.Sleep(700 * time.Millisecond)
+		_, _ = w.Write([]byte(`{"data":true}`))
+	}))
+	t.Cleanup(slow.Close)
+	fast := newSwitchServer(t, &status, &fastHits)
+	client := newTestClientWith(t, "", Config{
+		APIHosts: []Host{{URL: slow.URL}, {URL: fast.URL}},
+		Timeout:  300 * time.Millisecond,
+		Retry:    &RetryPolicy{MaxAttempts: 1},
+		Failover: &FailoverConfig{ProbeInterval: time.Hour},
+	})
+
+	// the slow host may have counted the traffic, it must not be sent again
+	err := client.Submit(context.Background(), "test-register-id", Trojan, []*UserTraffic{{UID: 1, Upload: 1}})
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || !apiErr.IsNetworkError() {
+		t.Fatalf("Expected network error, got %v", err)
+	}
+	if slowHits.Load() != 1 || fastHits.Load() != 0 {
+		t.Fatalf("Expected Submit sent to one host only, got slow %d fast %d", slowHits.Load(), fastHits.Load())
+	}
+
+	// a host that cannot be connected to never saw the request
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	client = newTestClientWith(t, "", Config{
+		APIHosts: []Host{{URL: down.URL}, {URL: fast.URL}},
+		Retry:    &RetryPolicy{MaxAttempts: 1},
+		Failover: &FailoverConfig{ProbeInterval: time.Hour},
+	})
+	if err := client.Submit(context.Background(), "test-register-id", Trojan, []*UserTraffic{{UID: 1, Upload: 1}}); err != nil {
+		t.Fatalf("Expected Submit to fail over after a refused connection, got %v", err)
+	}
+	if fastHits.Load() != 1 {
+		t.Fatalf("Expected the second host to get Submit, got %d", fastHits.Load())
+	}
+}
+
+func TestFailoverProbeRecovers(t *testing.T) {
+	var status1, status2, hits1, hits2 atomic.Int32
+	status1.Store(503)
+	status2.Store(200)
+	server1 := newSwitchServer(t, &status1, &hits1)
+	server2 := newSwitchServer(t, &status2, &hits2)
+	client := newTestClientWith(t, "", Config{
+		APIHosts: []Host{{URL: server1.URL}, {URL: server2.URL}},
+		Retry:    &RetryPolicy{MaxAttempts: 1},
+		Failover: &FailoverConfig{ProbeInterval: 10 * time.Millisecond},
+	})
+
+	ctx := context.Background()
+	if err := client.Heartbeat(ctx, "test-register-id", Trojan, ""); err != nil {
+		t.Fatalf("Heartbeat() unexpected error: %v", err)
+	}
+	first := client.hosts.hosts[0]
+	if first.healthy.Load() {
+		t.Fatal("Expected the first host to be marked failed")
+	}
+
+	status1.Store(200)
+	deadline := time.Now().Add(2 * time.Second)
+	for !first.healthy.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected probing to mark the first host healthy")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// the recovered host is healthy again, but the last healthy host stays preferred
+	before := hits1.Load()
+	if err := client.Heartbeat(ctx, "test-register-id", Trojan, ""); err != nil {
+		t.Fatalf("Heartbeat() unexpected error: %v", err)
+	}
+	if hits1.Load() != before {
+		t.Fatal("Expected the sticky host to be used")
+	}
+
+	// when the sticky host fails, the recovered one takes over
+	status2.Store(500)
+	if err := client.Heartbeat(ctx, "test-register-id", Trojan, ""); err != nil {
+		t.Fatalf("Heartbeat() unexpected error: %v", err)
+	}
+	if hits1.Load() != before+1 {
+		t.Fatal("Expected failover back to the recovered host")
+	}
+}
+
+func TestFailoverAllHostsDown(t *testing.T) {
+	var status1, status2, hits1, hits2 atomic.Int32
+	status1.Store(500)
+	status2.Store(500)
+	server1 := newSwitchServer(t, &status1, &hits1)
+	server2 := newSwitchServer(t, &status2, &hits2)
+	client := newTestClientWith(t, "", Config{
+		APIHosts: []Host{{URL: server1.URL}, {URL: server2.URL}},
+		Retry:    &RetryPolicy{MaxAttempts: 1},
+		Failover: &FailoverConfig{ProbeInterval: time.Hour},
+	})
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := client.Heartbeat(ctx, "test-register-id", Trojan, ""); err == nil {
+			t.Fatal("Expected error, got nil")
+		}
+	}
+	// with no healthy host left every host is still tried
+	if hits1.Load() != 2 || hits2.Load() != 2 {
+		t.Fatalf("Expected 2 requests per host, got %d and %d", hits1.Load(), hits2.Load())
+	}
+}
+
+func TestWeightedShuffle(t *testing.T) {
+	heavy := &hostState{url: "heavy", weight: 9}
+	light := &hostState{url: "light", weight: 1}
+	none := &hostState{url: "none"}
+
+	firsts := map[string]int{}
+	for i := 0; i < 2000; i++ {
+		ordered := weightedShuffle([]*hostState{none, light, heavy})
+		if len(ordered) != 3 {
+			t.Fatalf("Expected 3 hosts, got %d", len(ordered))
+		}
+		if ordered[2] != none {
+			t.Fatal("Expected hosts without weight to go last")
+		}
+		firsts[ordered[0].url]++
+	}
+	if firsts["heavy"] < 1600 || firsts["light"] < 100 {
+		t.Fatalf("Unexpected distribution %v", firsts)
+	}
+}
+
+func TestSingleHostCompat(t *testing.T) {
+	server := newTestServer(t, 500, map[string]any{"message": "internal server error"})
+	client := newTestClient(t, server.URL)
+
+	_, err := client.Config(context.Background(), 1, Trojan)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || !strings.HasPrefix(apiErr.URL, server.URL) {
+		t.Fatalf("Expected error with URL of APIHost, got %v", err)
+	}
+	if !client.hosts.hosts[0].healthy.Load() {
+		t.Fatal("Expected a single host never to be marked failed")
+	}
+}
@@ -70,14 +70,14 @@ func AsConfig[T NodeConfig](nc NodeConfig) (T, error) {
 	val := reflect.ValueOf(nc)
 	if val.Kind() == reflect.Ptr && val.IsNil() {
 		// 如果 nc 是 nil 指针，则返回零值和错误
-		return zero, fmt.Errorf("nil cannot be converted to type %v", reflect.TypeOf(zero))
+		return zero, NewInvalidInputError(fmt.Sprintf("nil cannot be converted to type %v", reflect.TypeOf(zero)), nil)
 	}
 
 	// 使用类型断言尝试将 nc 转换为具体的类型 T
 	tConfig, ok := nc.(T)
 	if !ok {
 		// 如果断言失败，返回零值和错误
-		return zero, fmt.Errorf("cannot assert type %v to type %v", reflect.TypeOf(nc), reflect.TypeOf(zero))
+		return zero, NewInvalidInputError(fmt.Sprintf("cannot assert type %v to type %v", reflect.TypeOf(nc), reflect.TypeOf(zero)), nil)
 	}
 
 	// 如果断言成功，返回结果
@@ -92,7 +92,7 @@ func UnmarshalConfig[T any](data []byte) (*T, error) {
 	}
 	err := json.Unmarshal(data, &resp)
 	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal: %w", err)
+		return nil, NewParseError("failed to unmarshal config", err)
 	}
 	return resp.Data, nil
 }
@@ -130,15 +130,23 @@ func UnmarshalUsers(data []byte) (*[]User, error) {
 	var resp RespUsers
 	err := json.Unmarshal(data, &resp)
 	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal: %w", err)
+		return nil, NewParseError("failed to unmarshal users", err)
 	}
 	return resp.Data, nil
 }
 
 func MarshalTraffics(traffics []*UserTraffic) ([]byte, error) {
-	return json.Marshal(traffics)
+	data, err := json.Marshal(traffics)
+	if err != nil {
+		return nil, NewInvalidInputError("failed to marshal traffics", err)
+	}
+	return data, nil
 }
 
 func MarshalTrafficStats(stats *TrafficStats) ([]byte, error) {
-	return json.Marshal(stats)
+	data, err := json.Marshal(stats)
+	if err != nil {
+		return nil, NewInvalidInputError("failed to marshal traffic stats", err)
+	}
+	return data, nil
 }
@@ -0,0 +1,75 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	resty "github.com/go-resty/resty/v2"
+)
+
+// logAttempt log a failed attempt of op. A failure is a transport error, a
+// 5xx response or a retried response, other statuses are results for the
+// caller to handle. retryIn is the backoff before the next attempt, zero when
+// the call gives up.
+func (c *Client) logAttempt(ctx context.Context, op operation, url string, attempt int, res *resty.Response, err error, retryIn time.Duration) {
+	if err == nil && retryIn == 0 && res.StatusCode() < http.StatusInternalServerError {
+		return
+	}
+	level := slog.LevelError
+	msg := "panel request failed"
+	if retryIn > 0 {
+		level = slog.LevelWarn
+		msg = "panel request failed, retrying"
+	}
+	if !c.logger.Enabled(ctx, level) {
+		return
+	}
+
+	attrs := make([]slog.Attr, 0, 9)
+	attrs = append(attrs,
+		slog.String("operation", op.name),
+		slog.String("url", url),
+		slog.Int("attempt", attempt),
+	)
+	if op.nodeType != "" {
+		attrs = append(attrs, slog.String("node_type", string(op.nodeType)))
+	}
+	if op.nodeId != 0 {
+		attrs = append(attrs, slog.Int("node_id", int(op.nodeId)))
+	}
+	if op.registerId != "" {
+		attrs = append(attrs, slog.String("register_id", op.registerId))
+	}
+	if res != nil {
+		attrs = append(attrs, slog.Int("status", res.StatusCode()))
+	}
+	if err != nil {
+		attrs = append(attrs, slog.Any("error", err))
+	}
+	if retryIn > 0 {
+		attrs = append(attrs, slog.Duration("retry_in", retryIn))
+	}
+	c.logger.LogAttrs(ctx, level, msg, attrs...)
+}
+
+// restyLogger route the resty debug and error output to slog
+type restyLogger struct {
+	logger *slog.Logger
+}
+
+func (l restyLogger) Errorf(format string, v ...any) {
+	l.logger.Error(fmt.Sprintf(format, v...))
+}
+
+func (l restyLogger) Warnf(format string, v ...any) {
+	l.logger.Warn(fmt.Sprintf(format, v...))
+}
+
+// Debugf resty only writes debug output when Config.Debug is set, so it is
+// logged at info level to show with the default handler
+func (l restyLogger) Debugf(format string, v ...any) {
+	l.logger.Info(fmt.Sprintf(format, v...))
+}
@@ -0,0 +1,118 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// logBuffer collects JSON log records
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) records(t *testing.T) []map[string]any {
+	t.Helper()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var records []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("invalid log line %q: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// logger a debug logger writing JSON records to b
+func (b *logBuffer) logger() *slog.Logger {
+	return slog.New(slog.NewJSONHandler(b, &slog.HandlerOptions{Level: slog.LevelDebug}))
+}
+
+func TestLoggerRetryFields(t *testing.T) {
+	var hits atomic.Int32
+	server := newFlakyServer(t, 1, http.StatusServiceUnavailable, nil, &hits)
+	buf := &logBuffer{}
+	client := newTestClientWith(t, server.URL, Config{Retry: &RetryPolicy{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}, Logger: buf.logger()})
+
+	if err := heartbeatCall(client); err != nil {
+		t.Fatalf("Heartbeat() unexpected error: %v", err)
+	}
+	records := buf.records(t)
+	if len(records) != 1 {
+		t.Fatalf("Expected only the failed attempt to be logged, got %v", records)
+	}
+	r := records[0]
+	if r["level"] != "WARN" || r["operation"] != OpHeartbeat || r["node_type"] != "trojan" ||
+		r["register_id"] != "test-register-id" || r["status"] != float64(503) || r["attempt"] != float64(1) {
+		t.Fatalf("Unexpected record %v", r)
+	}
+	if !strings.HasSuffix(r["url"].(string), "/api/v1/server/enhanced/trojan/heartbeat") {
+		t.Fatalf("Unexpected url %v", r["url"])
+	}
+}
+
+func TestLoggerFinalError(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	buf := &logBuffer{}
+	client := newTestClientWith(t, down.URL, Config{Retry: &RetryPolicy{MaxAttempts: 1}, Logger: buf.logger()})
+
+	if _, err := client.Config(context.Background(), 3, Trojan); err == nil {
+		t.Fatal("Expected error, got nil")
+	}
+	var found bool
+	for _, r := range buf.records(t) {
+		if r["level"] == "ERROR" && r["operation"] == OpConfig {
+			found = r["node_id"] == float64(3) && r["error"] != nil
+		}
+	}
+	if !found {
+		t.Fatalf("Expected an error record with node id and error, got %v", buf.records(t))
+	}
+}
+
+func TestLoggerClientErrorNotLogged(t *testing.T) {
+	server := newTestServer(t, 404, map[string]any{"message": "not found"})
+	buf := &logBuffer{}
+	client := newTestClientWith(t, server.URL, Config{Logger: buf.logger()})
+
+	if _, err := client.Config(context.Background(), 1, Trojan); err == nil {
+		t.Fatal("Expected error, got nil")
+	}
+	if records := buf.records(t); len(records) != 0 {
+		t.Fatalf("Expected 4xx results not to be logged, got %v", records)
+	}
+}
+
+func TestLoggerDiscard(t *testing.T) {
+	var hits atomic.Int32
+	server := newFlakyServer(t, 5, http.StatusInternalServerError, nil, &hits)
+	client := newTestClientWith(t, server.URL, Config{
+		Retry:  &RetryPolicy{MaxAttempts: 1},
+		Logger: slog.New(slog.DiscardHandler),
+	})
+	if err := heartbeatCall(client); err == nil {
+		t.Fatal("Expected error, got nil")
+	}
+}
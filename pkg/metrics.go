@@ -0,0 +1,74 @@
+package pkg
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	resty "github.com/go-resty/resty/v2"
+)
+
+// Metrics receives measurements of the panel calls made by a Client.
+// Implementations must be safe for concurrent use, see the prommetrics
+// package for a Prometheus implementation.
+type Metrics interface {
+	// ObserveRequest called once per Client call, after retries and failover
+	ObserveRequest(m RequestMetrics)
+	// ObserveRetry called before every retry of a call
+	ObserveRetry(op string, nodeType NodeType)
+}
+
+// RequestMetrics measurements of one Client call
+type RequestMetrics struct {
+	// Operation name of the Client method, e.g. OpRawUsers
+	Operation string
+	NodeType  NodeType
+	// StatusCode HTTP status of the last attempt, 0 when no response was received
+	StatusCode int
+	// ErrorType classification of the result, empty on success and
+	// ErrorTypeNotModified when an ETag saved the download
+	ErrorType ErrorType
+	// Duration total time spent including retries and backoff
+	Duration time.Duration
+	// ResponseSize body size of the last response in bytes
+	ResponseSize int
+	// Attempts requests sent, or tried to send, for the call
+	Attempts int
+	// Conditional the request carried an ETag in If-None-Match
+	Conditional bool
+}
+
+// observeRequest report the result of a call to the metrics hook
+func (c *Client) observeRequest(op operation, start time.Time, attempts int, res *resty.Response, err error) {
+	if c.config.Metrics == nil {
+		return
+	}
+	m := RequestMetrics{
+		Operation: op.name,
+		NodeType:  op.nodeType,
+		ErrorType: resultErrorType(res, err),
+		Duration:  time.Since(start),
+		Attempts:  attempts,
+	}
+	if res != nil {
+		m.StatusCode = res.StatusCode()
+		m.ResponseSize = len(res.Body())
+		m.Conditional = res.Request != nil && res.Request.Header.Get("If-None-Match") != ""
+	}
+	c.config.Metrics.ObserveRequest(m)
+}
+
+// resultErrorType classify the result of a request, empty on success
+func resultErrorType(res *resty.Response, err error) ErrorType {
+	if err != nil {
+		var apiErr *APIError
+		if errors.As(err, &apiErr) {
+			return apiErr.Type
+		}
+		return ErrorTypeNetworkError
+	}
+	if res.StatusCode() >= http.StatusMultipleChoices {
+		return getErrorTypeFromStatusCode(res.StatusCode())
+	}
+	return ""
+}
@@ -0,0 +1,117 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// recordingMetrics keeps every observation in memory
+type recordingMetrics struct {
+	mu       sync.Mutex
+	requests []RequestMetrics
+	retries  []string
+}
+
+func (m *recordingMetrics) ObserveRequest(r RequestMetrics) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests = append(m.requests, r)
+}
+
+func (m *recordingMetrics) ObserveRetry(op string, nodeType NodeType) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.retries = append(m.retries, op)
+}
+
+func TestMetricsSuccessAfterRetry(t *testing.T) {
+	var hits atomic.Int32
+	server := newFlakyServer(t, 1, http.StatusServiceUnavailable, nil, &hits)
+	metrics := &recordingMetrics{}
+	client := newTestClientWith(t, server.URL, Config{
+		Retry:   &RetryPolicy{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+		Metrics: metrics,
+	})
+
+	if err := heartbeatCall(client); err != nil {
+		t.Fatalf("Heartbeat() unexpected error: %v", err)
+	}
+	if len(metrics.requests) != 1 {
+		t.Fatalf("Expected a single observation per call, got %d", len(metrics.requests))
+	}
+	m := metrics.requests[0]
+	if m.Operation != OpHeartbeat || m.NodeType != Trojan {
+		t.Errorf("Unexpected labels %s %s", m.Operation, m.NodeType)
+	}
+	if m.StatusCode != 200 || m.ErrorType != "" {
+		t.Errorf("Expected success, got status %d error type %q", m.StatusCode, m.ErrorType)
+	}
+	if m.Attempts != 2 || m.ResponseSize == 0 || m.Duration <= 0 {
+		t.Errorf("Unexpected measurements %+v", m)
+	}
+	if len(metrics.retries) != 1 || metrics.retries[0] != OpHeartbeat {
+		t.Errorf("Expected one retry, got %v", metrics.retries)
+	}
+}
+
+func TestMetricsETag(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte(`{"data":[]}`))
+	}))
+	t.Cleanup(server.Close)
+	metrics := &recordingMetrics{}
+	client := newTestClientWith(t, server.URL, Config{Metrics: metrics})
+
+	ctx := context.Background()
+	if _, err := client.RawUsers(ctx, "test-register-id", Trojan); err != nil {
+		t.Fatalf("RawUsers() unexpected error: %v", err)
+	}
+	if _, err := client.RawUsers(ctx, "test-register-id", Trojan); !errors.Is(err, ErrorUserNotModified) {
+		t.Fatalf("Expected not modified, got %v", err)
+	}
+
+	first, second := metrics.requests[0], metrics.requests[1]
+	if first.Conditional || first.ErrorType != "" {
+		t.Errorf("Expected first request to download, got %+v", first)
+	}
+	if !second.Conditional || second.StatusCode != 304 || second.ErrorType != ErrorTypeNotModified {
+		t.Errorf("Expected second request to hit the ETag, got %+v", second)
+	}
+}
+
+func TestMetricsErrors(t *testing.T) {
+	server := newTestServer(t, 404, map[string]any{"message": "not found"})
+	metrics := &recordingMetrics{}
+	client := newTestClientWith(t, server.URL, Config{Metrics: metrics})
+	if _, err := client.Config(context.Background(), 1, Trojan); err == nil {
+		t.Fatal("Expected error, got nil")
+	}
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	client = newTestClientWith(t, down.URL, Config{
+		Retry:   &RetryPolicy{MaxAttempts: 1},
+		Metrics: metrics,
+	})
+	if err := heartbeatCall(client); err == nil {
+		t.Fatal("Expected error, got nil")
+	}
+
+	if m := metrics.requests[0]; m.StatusCode != 404 || m.ErrorType != ErrorTypeClientError {
+		t.Errorf("Expected client error, got %+v", m)
+	}
+	if m := metrics.requests[1]; m.StatusCode != 0 || m.ErrorType != ErrorTypeNetworkError {
+		t.Errorf("Expected network error, got %+v", m)
+	}
+}
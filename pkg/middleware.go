@@ -0,0 +1,96 @@
+package pkg
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	resty "github.com/go-resty/resty/v2"
+)
+
+// RequestInfo identifies the Client call a hook runs for
+type RequestInfo struct {
+	// Operation name of the Client method, e.g. OpSubmit
+	Operation  string
+	NodeType   NodeType
+	NodeId     NodeId
+	RegisterId string
+}
+
+// BeforeRequestHook runs before every request sent to the panel, retries and
+// failover included. It may change the request, e.g. add headers. Returning an
+// error aborts the call with ErrorTypeAborted, the request is not sent.
+type BeforeRequestHook func(ctx context.Context, info RequestInfo, req *resty.Request) error
+
+// AfterResponseHook runs after every request sent to the panel. res is nil when
+// no response was received, err is the transport error if any.
+type AfterResponseHook func(ctx context.Context, info RequestInfo, req *resty.Request, res *resty.Response, err error)
+
+// middleware hooks of a Client. Hooks run in the order they were added;
+// adding hooks is safe while requests are in flight, which keep the hooks
+// they started with.
+type middleware struct {
+	mu     sync.Mutex
+	before atomic.Pointer[[]BeforeRequestHook]
+	after  atomic.Pointer[[]AfterResponseHook]
+}
+
+// OnBeforeRequest add hooks run before each request, after the ones already added
+func (c *Client) OnBeforeRequest(hooks ...BeforeRequestHook) {
+	c.middleware.mu.Lock()
+	defer c.middleware.mu.Unlock()
+	c.middleware.before.Store(appendHooks(c.middleware.before.Load(), hooks))
+}
+
+// OnAfterResponse add hooks run after each response, after the ones already added
+func (c *Client) OnAfterResponse(hooks ...AfterResponseHook) {
+	c.middleware.mu.Lock()
+	defer c.middleware.mu.Unlock()
+	c.middleware.after.Store(appendHooks(c.middleware.after.Load(), hooks))
+}
+
+// appendHooks copy on write, so snapshots held by running requests never change
+func appendHooks[T any](current *[]T, hooks []T) *[]T {
+	var next []T
+	if current != nil {
+		next = append(next, *current...)
+	}
+	next = append(next, hooks...)
+	return &next
+}
+
+// beforeRequest run the before hooks, stopping at the first error
+func (m *middleware) beforeRequest(ctx context.Context, op operation, req *resty.Request) error {
+	hooks := m.before.Load()
+	if hooks == nil {
+		return nil
+	}
+	info := op.info()
+	for _, hook := range *hooks {
+		if err := hook(ctx, info, req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// afterResponse run the after hooks
+func (m *middleware) afterResponse(ctx context.Context, op operation, req *resty.Request, res *resty.Response, err error) {
+	hooks := m.after.Load()
+	if hooks == nil {
+		return
+	}
+	info := op.info()
+	for _, hook := range *hooks {
+		hook(ctx, info, req, res, err)
+	}
+}
+
+func (op operation) info() RequestInfo {
+	return RequestInfo{
+		Operation:  op.name,
+		NodeType:   op.nodeType,
+		NodeId:     op.nodeId,
+		RegisterId: op.registerId,
+	}
+}
@@ -0,0 +1,154 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	resty "github.com/go-resty/resty/v2"
+)
+
+func TestMiddlewareOrderAndInfo(t *testing.T) {
+	var header atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header.Store(r.Header.Get("X-Node-Version"))
+		_, _ = w.Write([]byte(`{"data":true,"message":"success"}`))
+	}))
+	t.Cleanup(server.Close)
+	client := newTestClient(t, server.URL)
+
+	var order []string
+	var infos []RequestInfo
+	var size int
+	client.OnBeforeRequest(
+		func(ctx context.Context, info RequestInfo, req *resty.Request) error {
+			order = append(order, "before1")
+			infos = append(infos, info)
+			req.SetHeader("X-Node-Version", "v1")
+			return nil
+		},
+		func(ctx context.Context, info RequestInfo, req *resty.Request) error {
+			order = append(order, "before2")
+			// later hooks see and override earlier changes
+			req.SetHeader("X-Node-Version", req.Header.Get("X-Node-Version")+"-build")
+			return nil
+		},
+	)
+	client.OnAfterResponse(func(ctx context.Context, info RequestInfo, req *resty.Request, res *resty.Response, err error) {
+		order = append(order, "after1")
+		size = len(res.Body())
+	})
+	client.OnAfterResponse(func(ctx context.Context, info RequestInfo, req *resty.Request, res *resty.Response, err error) {
+		order = append(order, "after2")
+	})
+
+	if err := heartbeatCall(client); err != nil {
+		t.Fatalf("Heartbeat() unexpected error: %v", err)
+	}
+	if got := header.Load(); got != "v1-build" {
+		t.Errorf("Expected hooks to set the header, got %v", got)
+	}
+	want := []string{"before1", "before2", "after1", "after2"}
+	if len(order) != len(want) {
+		t.Fatalf("Expected order %v, got %v", want, order)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("Expected order %v, got %v", want, order)
+		}
+	}
+	if infos[0] != (RequestInfo{Operation: OpHeartbeat, NodeType: Trojan, RegisterId: "test-register-id"}) {
+		t.Errorf("Unexpected info %+v", infos[0])
+	}
+	if size == 0 {
+		t.Error("Expected the after hook to see the response body")
+	}
+}
+
+func TestMiddlewareAbort(t *testing.T) {
+	var hits atomic.Int32
+	server := newFlakyServer(t, 0, 200, nil, &hits)
+	client := newTestClient(t, server.URL)
+
+	denied := errors.New("denied")
+	client.OnBeforeRequest(func(ctx context.Context, info RequestInfo, req *resty.Request) error {
+		return denied
+	})
+	var afterCalls int
+	client.OnAfterResponse(func(ctx context.Context, info RequestInfo, req *resty.Request, res *resty.Response, err error) {
+		afterCalls++
+	})
+
+	err := heartbeatCall(client)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || !apiErr.IsAborted() || !errors.Is(err, denied) {
+		t.Fatalf("Expected aborted error wrapping the hook error, got %v", err)
+	}
+	if hits.Load() != 0 || afterCalls != 0 {
+		t.Fatalf("Expected the request not to be sent, got %d requests and %d after hooks", hits.Load(), afterCalls)
+	}
+}
+
+func TestMiddlewareEveryAttempt(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	client := newTestClientWith(t, down.URL, Config{
+		Retry: &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+	})
+
+	var before, after atomic.Int32
+	client.OnBeforeRequest(func(ctx context.Context, info RequestInfo, req *resty.Request) error {
+		before.Add(1)
+		return nil
+	})
+	client.OnAfterResponse(func(ctx context.Context, info RequestInfo, req *resty.Request, res *resty.Response, err error) {
+		if res != nil || err == nil {
+			t.Errorf("Expected a transport error without response, got %v %v", res, err)
+		}
+		after.Add(1)
+	})
+
+	if _, err := client.Config(context.Background(), 1, Trojan); err == nil {
+		t.Fatal("Expected error, got nil")
+	}
+	if before.Load() != 3 || after.Load() != 3 {
+		t.Fatalf("Expected hooks on each of the 3 attempts, got %d and %d", before.Load(), after.Load())
+	}
+}
+
+func TestMiddlewareConcurrentRegistration(t *testing.T) {
+	var hits atomic.Int32
+	server := newFlakyServer(t, 0, 200, nil, &hits)
+	client := newTestClient(t, server.URL)
+
+	var calls atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			client.OnBeforeRequest(func(ctx context.Context, info RequestInfo, req *resty.Request) error {
+				calls.Add(1)
+				return nil
+			})
+		}()
+		go func() {
+			defer wg.Done()
+			_ = heartbeatCall(client)
+		}()
+	}
+	wg.Wait()
+
+	calls.Store(0)
+	if err := heartbeatCall(client); err != nil {
+		t.Fatalf("Heartbeat() unexpected error: %v", err)
+	}
+	if calls.Load() != 8 {
+		t.Fatalf("Expected all 8 hooks to run, got %d", calls.Load())
+	}
+}
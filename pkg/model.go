@@ -2,6 +2,7 @@ package pkg
 
 import (
 	"fmt"
+	"net/netip"
 	"strings"
 
 	"github.com/xflash-panda/server-client/pkg/xray"
@@ -22,6 +23,12 @@ const (
 // ErrorUserNotModified 用户数据未修改错误 (304)
 var ErrorUserNotModified = NewNotModifiedError()
 
+// ErrorAuditRulesNotModified 审计规则未修改错误 (304)
+var ErrorAuditRulesNotModified = NewNotModifiedError()
+
+// ErrorCertNotModified 证书未修改错误 (304)
+var ErrorCertNotModified = NewNotModifiedError()
+
 type NodeType string
 
 func (n NodeType) String() string {
@@ -55,6 +62,90 @@ type UserTraffic struct {
 	Count    uint64 `json:"n"`
 }
 
+// OnlineUser IPs a user is connected from, reported by SubmitOnlineUsers
+type OnlineUser struct {
+	UID int      `json:"user_id"`
+	IPs []string `json:"ips"`
+}
+
+// NodeStatus system status of a node, reported by SubmitNodeStatus.
+// Sizes are in bytes, speeds in bytes per second.
+type NodeStatus struct {
+	// CPU usage in percent of all cores, 0-100
+	CPU         float64 `json:"cpu"`
+	MemTotal    uint64  `json:"mem_total"`
+	MemUsed     uint64  `json:"mem_used"`
+	SwapTotal   uint64  `json:"swap_total"`
+	SwapUsed    uint64  `json:"swap_used"`
+	DiskTotal   uint64  `json:"disk_total"`
+	DiskUsed    uint64  `json:"disk_used"`
+	Load1       float64 `json:"load1"`
+	Load5       float64 `json:"load5"`
+	Load15      float64 `json:"load15"`
+	Uptime      uint64  `json:"uptime"`
+	TCPConns    int     `json:"tcp_conns"`
+	UDPConns    int     `json:"udp_conns"`
+	NetInSpeed  uint64  `json:"net_in_speed"`
+	NetOutSpeed uint64  `json:"net_out_speed"`
+	NetInTotal  uint64  `json:"net_in_total"`
+	NetOutTotal uint64  `json:"net_out_total"`
+}
+
+// AuditRule destinations users of the node must not reach, see AuditMatcher.
+// A connection hits the rule when it matches every criterion the rule sets.
+type AuditRule struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	// Domains matched by suffix, "full:" matches the exact domain and
+	// "keyword:" any domain containing the keyword
+	Domains []string `json:"domains,omitempty"`
+	// CIDRs destination networks, checked with Domains: either may match
+	CIDRs []netip.Prefix `json:"cidrs,omitempty"`
+	// Ports destination ports
+	Ports []PortRange `json:"ports,omitempty"`
+	// Protocols sniffed application protocols, e.g. "bittorrent"
+	Protocols []string `json:"protocols,omitempty"`
+}
+
+// Violation a connection of a user that hit an audit rule
+type Violation struct {
+	UID    int `json:"user_id"`
+	RuleID int `json:"rule_id"`
+	// Target the destination, host:port
+	Target string `json:"target"`
+	// Timestamp unix seconds
+	Timestamp int64 `json:"timestamp"`
+}
+
+// NodeCert TLS certificate of a node, see CertManager
+type NodeCert struct {
+	// Domain the certificate was issued for
+	Domain string `json:"domain"`
+	// CertPEM certificate chain, leaf first
+	CertPEM string `json:"certificate"`
+	KeyPEM  string `json:"key"`
+}
+
+// NodeKey identifies a node across node types
+type NodeKey struct {
+	NodeId   NodeId   `json:"node_id"`
+	NodeType NodeType `json:"node_type"`
+}
+
+// NodeHeartbeat one node of a HeartbeatBatch
+type NodeHeartbeat struct {
+	RegisterId string   `json:"register_id"`
+	NodeType   NodeType `json:"node_type"`
+	NodeIp     string   `json:"node_ip,omitempty"`
+}
+
+// NodeUsers users of one node of a UsersBatch. Err is ErrorUserNotModified
+// when the users have not changed since the previous fetch.
+type NodeUsers struct {
+	Users []User
+	Err   error
+}
+
 type Hysteria2Config struct {
 	ID                 int    `json:"id"`
 	ServerPort         int    `json:"server_port"`
@@ -179,9 +270,19 @@ func (n *TuicConfig) TypeName() string {
 	return string(Tuic)
 }
 
+// User a user allowed on the node. Fields other than ID and UUID are optional,
+// their zero value means the panel sets no limit, see user.go.
 type User struct {
 	ID   int    `json:"id"`
 	UUID string `json:"uuid"`
+	// Password secret of password based protocols, empty when they use the UUID
+	Password string `json:"password,omitempty"`
+	// SpeedLimit in Mbps, 0 is unlimited
+	SpeedLimit int64 `json:"speed_limit,omitempty"`
+	// DeviceLimit concurrent devices (client IPs), 0 is unlimited
+	DeviceLimit int `json:"device_limit,omitempty"`
+	// ExpiredAt unix seconds, 0 never expires
+	ExpiredAt int64 `json:"expired_at,omitempty"`
 }
 
 type TrafficStats struct {
@@ -196,6 +297,32 @@ type RespUsers struct {
 	Message string  `json:"message"`
 }
 
+// UsersDelta changes of the user list since a revision
+type UsersDelta struct {
+	Revision int64 `json:"revision"`
+	// Full the panel sent the whole list in Users instead of changes
+	Full    bool   `json:"full"`
+	Users   []User `json:"users"`
+	Added   []User `json:"added"`
+	Updated []User `json:"updated"`
+	Removed []int  `json:"removed"`
+}
+
+type RespUsersDelta struct {
+	Data    *UsersDelta `json:"data"`
+	Message string      `json:"message"`
+}
+
+type RespAuditRules struct {
+	Data    []AuditRule `json:"data"`
+	Message string      `json:"message"`
+}
+
+type RespNodeCert struct {
+	Data    *NodeCert `json:"data"`
+	Message string    `json:"message"`
+}
+
 type RespConfig struct {
 	Data    NodeConfig `json:"data"`
 	Message string     `json:"message"`
@@ -217,6 +344,9 @@ type (
 	RespHeartBeat            RespSubmit
 	RespSubmitWithAgent      RespSubmit
 	RespSubmitStatsWithAgent RespSubmit
+	RespSubmitOnlineUsers    RespSubmit
+	RespSubmitNodeStatus     RespSubmit
+	RespSubmitViolations     RespSubmit
 	RespUnregister           RespSubmit
 	RespVerify               RespSubmit
 )
@@ -0,0 +1,464 @@
+package pkg
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+)
+
+// NodeSpec a node run by a NodeManager, the fields after NodeType are sent to Register
+type NodeSpec struct {
+	NodeId   NodeId
+	NodeType NodeType
+	Hostname string
+	Port     int
+	NodeIp   string
+}
+
+func (s NodeSpec) String() string {
+	return fmt.Sprintf("%s/%d", s.NodeType, s.NodeId)
+}
+
+// NodeManagerConfig intervals and callbacks of a NodeManager, zero fields use the defaults.
+// Callbacks run on the worker of the node and must not block for long.
+type NodeManagerConfig struct {
+	// ConfigInterval how often the node config is polled, defaults to 60s
+	ConfigInterval time.Duration
+	// UsersInterval how often users are synced, defaults to 60s
+	UsersInterval time.Duration
+	// HeartbeatInterval defaults to 30s
+	HeartbeatInterval time.Duration
+	// SubmitInterval how often traffic is collected and submitted, defaults to 60s
+	SubmitInterval time.Duration
+	// Jitter fraction of each interval added at random, defaults to 0.1
+	Jitter float64
+	// StartSpread nodes start evenly spread over this window, defaults to 10s
+	StartSpread time.Duration
+	// RestartDelay first delay before restarting a failed node, doubled up to
+	// MaxRestartDelay, defaults to 1s and 1m
+	RestartDelay    time.Duration
+	MaxRestartDelay time.Duration
+
+	// OnConfig called with the node config when it is first fetched and when it changes
+	OnConfig func(NodeSpec, NodeConfig)
+	// OnUsers called with the changes of every user sync that changed something
+	OnUsers func(NodeSpec, UserChanges)
+	// Traffic returns the traffic collected since the previous call, nil skips the submission.
+	// A batch that fails to submit is sent again unchanged under the same batch id,
+	// traffic collected meanwhile is merged per user and sent after it.
+	Traffic func(NodeSpec) []*UserTraffic
+	// MaxPendingTraffic users whose traffic is kept while a batch fails to
+	// submit, traffic of further users is dropped. Defaults to 100000.
+	MaxPendingTraffic int
+}
+
+func (c *NodeManagerConfig) withDefaults() NodeManagerConfig {
+	config := *c
+	config.ConfigInterval = cmp.Or(config.ConfigInterval, 60*time.Second)
+	config.UsersInterval = cmp.Or(config.UsersInterval, 60*time.Second)
+	config.HeartbeatInterval = cmp.Or(config.HeartbeatInterval, 30*time.Second)
+	config.SubmitInterval = cmp.Or(config.SubmitInterval, 60*time.Second)
+	config.Jitter = cmp.Or(config.Jitter, 0.1)
+	config.StartSpread = cmp.Or(config.StartSpread, 10*time.Second)
+	config.RestartDelay = cmp.Or(config.RestartDelay, time.Second)
+	config.MaxRestartDelay = cmp.Or(config.MaxRestartDelay, time.Minute)
+	config.MaxPendingTraffic = cmp.Or(config.MaxPendingTraffic, 100000)
+	return config
+}
+
+// NodeState lifecycle state of a node in a NodeManager
+type NodeState string
+
+const (
+	NodeStarting NodeState = "starting" // waiting for its start slot or registering
+	NodeRunning  NodeState = "running"  // registered, polling
+	NodeFailed   NodeState = "failed"   // waiting to restart after a failure
+	NodeStopped  NodeState = "stopped"  // the manager stopped
+)
+
+// NodeSnapshot status of a node at the time of NodeManager.Snapshot.
+// The Last* times are those of the last successful call.
+type NodeSnapshot struct {
+	NodeId     NodeId
+	NodeType   NodeType
+	State      NodeState
+	RegisterId string
+	// Restarts times the node was restarted after a failure
+	Restarts      int
+	Users         int
+	LastConfig    time.Time
+	LastUsers     time.Time
+	LastHeartbeat time.Time
+	LastSubmit    time.Time
+	// LastError the last error of any task, kept after later successes
+	LastError   error
+	LastErrorAt time.Time
+}
+
+// NodeManager runs many nodes against a shared Client. Each node gets a
+// supervised worker that registers it and then polls its config and users,
+// sends heartbeats and submits traffic. A failing node is restarted with
+// backoff without affecting the others.
+type NodeManager struct {
+	client  *Client
+	config  NodeManagerConfig
+	workers []*nodeWorker
+}
+
+// NewNodeManager create a manager for nodes, a (NodeId, NodeType) pair listed
+// twice runs once
+func NewNodeManager(client *Client, nodes []NodeSpec, config NodeManagerConfig) *NodeManager {
+	m := &NodeManager{client: client, config: config.withDefaults()}
+	seen := make(map[NodeSpec]bool)
+	for _, spec := range nodes {
+		key := NodeSpec{NodeId: spec.NodeId, NodeType: spec.NodeType}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		m.workers = append(m.workers, &nodeWorker{
+			spec:  spec,
+			users: NewUserSet(),
+			snap:  NodeSnapshot{NodeId: spec.NodeId, NodeType: spec.NodeType, State: NodeStarting},
+		})
+	}
+	return m
+}
+
+// Run the nodes until ctx is done, then unregister them
+func (m *NodeManager) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for i, w := range m.workers {
+		offset := m.config.StartSpread * time.Duration(i) / time.Duration(len(m.workers))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.supervise(ctx, w, offset)
+		}()
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+// Snapshot status of every node, ordered by type then id
+func (m *NodeManager) Snapshot() []NodeSnapshot {
+	snaps := make([]NodeSnapshot, 0, len(m.workers))
+	for _, w := range m.workers {
+		snaps = append(snaps, w.snapshot())
+	}
+	slices.SortFunc(snaps, func(a, b NodeSnapshot) int {
+		return cmp.Or(cmp.Compare(a.NodeType, b.NodeType), cmp.Compare(a.NodeId, b.NodeId))
+	})
+	return snaps
+}
+
+// Node status of one node
+func (m *NodeManager) Node(nodeId NodeId, nodeType NodeType) (NodeSnapshot, bool) {
+	if w := m.worker(nodeId, nodeType); w != nil {
+		return w.snapshot(), true
+	}
+	return NodeSnapshot{}, false
+}
+
+// Users the user set of a node, kept in sync while the manager runs
+func (m *NodeManager) Users(nodeId NodeId, nodeType NodeType) (*UserSet, bool) {
+	if w := m.worker(nodeId, nodeType); w != nil {
+		return w.users, true
+	}
+	return nil, false
+}
+
+func (m *NodeManager) worker(nodeId NodeId, nodeType NodeType) *nodeWorker {
+	for _, w := range m.workers {
+		if w.spec.NodeId == nodeId && w.spec.NodeType == nodeType {
+			return w
+		}
+	}
+	return nil
+}
+
+// supervise run the node, restarting it with backoff until ctx is done
+func (m *NodeManager) supervise(ctx context.Context, w *nodeWorker, offset time.Duration) {
+	defer w.update(func(s *NodeSnapshot) { s.State = NodeStopped })
+	if !sleepContext(ctx, offset) {
+		return
+	}
+	delay := m.config.RestartDelay
+	for {
+		started := time.Now()
+		err := m.runNode(ctx, w)
+		if ctx.Err() != nil {
+			return
+		}
+		// a node that ran for a while starts over with the shortest delay
+		if time.Since(started) > m.config.MaxRestartDelay {
+			delay = m.config.RestartDelay
+		}
+		w.update(func(s *NodeSnapshot) {
+			s.State = NodeFailed
+			s.RegisterId = ""
+			s.Restarts++
+		})
+		w.fail(err)
+		m.client.logger.WarnContext(ctx, "node worker failed, restarting",
+			"node_id", int(w.spec.NodeId), "node_type", string(w.spec.NodeType), "error", err, "retry_in", delay)
+		if !sleepContext(ctx, m.jitter(delay)) {
+			return
+		}
+		delay = min(delay*2, m.config.MaxRestartDelay)
+		w.update(func(s *NodeSnapshot) { s.State = NodeStarting })
+	}
+}
+
+// nodeTask a periodic call of a running node
+type nodeTask struct {
+	interval time.Duration
+	next     time.Time
+	run      func(ctx context.Context, registerId string) error
+}
+
+// runNode register the node and run its tasks until ctx is done or the
+// registration is no longer valid. Panics of callbacks are returned as errors.
+func (m *NodeManager) runNode(ctx context.Context, w *nodeWorker) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("node %s panicked: %v", w.spec, r)
+		}
+	}()
+
+	spec := w.spec
+	registerId, err := m.client.Register(ctx, spec.NodeId, spec.NodeType, spec.Hostname, spec.Port, spec.NodeIp)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// unregister with a fresh context, ctx is usually done by now
+		unregisterCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+		defer cancel()
+		_ = m.client.Unregister(unregisterCtx, spec.NodeType, registerId)
+	}()
+	w.update(func(s *NodeSnapshot) {
+		s.State = NodeRunning
+		s.RegisterId = registerId
+	})
+
+	now := time.Now()
+	tasks := []*nodeTask{
+		{interval: m.config.HeartbeatInterval, next: now, run: func(ctx context.Context, registerId string) error {
+			return m.heartbeat(ctx, w, registerId)
+		}},
+		{interval: m.config.ConfigInterval, next: now, run: func(ctx context.Context, _ string) error {
+			return m.pollConfig(ctx, w)
+		}},
+		{interval: m.config.UsersInterval, next: now, run: func(ctx context.Context, registerId string) error {
+			return m.syncUsers(ctx, w, registerId)
+		}},
+		{interval: m.config.SubmitInterval, next: now.Add(m.jitter(m.config.SubmitInterval)), run: func(ctx context.Context, registerId string) error {
+			return m.submit(ctx, w, registerId)
+		}},
+	}
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		task := slices.MinFunc(tasks, func(a, b *nodeTask) int { return a.next.Compare(b.next) })
+		timer.Reset(time.Until(task.next))
+		select {
+		case <-ctx.Done():
+			// the last collected traffic is submitted before unregistering
+			submitCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+			defer cancel()
+			_ = m.submit(submitCtx, w, registerId)
+			return ctx.Err()
+		case <-timer.C:
+		}
+		err := task.run(ctx, registerId)
+		task.next = time.Now().Add(m.jitter(task.interval))
+		if err == nil || ctx.Err() != nil {
+			continue
+		}
+		if errors.Is(err, ErrRegisterExpired) || errors.Is(err, ErrNodeNotFound) || errors.Is(err, ErrUnauthorized) {
+			return err
+		}
+		w.fail(err)
+	}
+}
+
+func (m *NodeManager) heartbeat(ctx context.Context, w *nodeWorker, registerId string) error {
+	if err := m.client.Heartbeat(ctx, registerId, w.spec.NodeType, w.spec.NodeIp); err != nil {
+		return err
+	}
+	w.update(func(s *NodeSnapshot) { s.LastHeartbeat = time.Now() })
+	return nil
+}
+
+func (m *NodeManager) pollConfig(ctx context.Context, w *nodeWorker) error {
+	config, err := m.client.Config(ctx, w.spec.NodeId, w.spec.NodeType)
+	if err != nil {
+		return err
+	}
+	w.update(func(s *NodeSnapshot) { s.LastConfig = time.Now() })
+	if reflect.DeepEqual(config, w.config) {
+		return nil
+	}
+	if m.config.OnConfig != nil {
+		m.config.OnConfig(w.spec, config)
+	}
+	// recorded once handled, a callback that panicked sees the config again
+	w.config = config
+	return nil
+}
+
+func (m *NodeManager) syncUsers(ctx context.Context, w *nodeWorker, registerId string) error {
+	changes, err := m.client.SyncUsers(ctx, registerId, w.spec.NodeType, w.users)
+	if err != nil {
+		return err
+	}
+	w.update(func(s *NodeSnapshot) {
+		s.LastUsers = time.Now()
+		s.Users = w.users.Len()
+	})
+	if !changes.Empty() && m.config.OnUsers != nil {
+		m.config.OnUsers(w.spec, changes)
+	}
+	return nil
+}
+
+// submit send the traffic batch that failed before, or else a new batch of
+// the pending traffic. A failed batch is kept as it was, so the panel can
+// tell a resent batch by its id. Its traffic goes back to pending when the
+// panel rejected it with a 4xx, when its registration is no longer valid and
+// when it failed again after the node registered anew.
+func (m *NodeManager) submit(ctx context.Context, w *nodeWorker, registerId string) error {
+	if m.config.Traffic != nil {
+		if dropped := w.addPending(m.config.Traffic(w.spec), m.config.MaxPendingTraffic); dropped > 0 {
+			m.client.logger.WarnContext(ctx, "pending traffic full, dropping traffic",
+				"node_id", int(w.spec.NodeId), "node_type", string(w.spec.NodeType), "users", dropped)
+		}
+	}
+	if w.unsent == nil {
+		if len(w.pending) == 0 {
+			return nil
+		}
+		w.unsent = &trafficBatch{registerId: registerId, id: m.client.newBatchId(registerId), traffic: w.takePending()}
+	}
+
+	batch := w.unsent
+	err := m.client.submitBatch(ctx, batch.registerId, w.spec.NodeType, batch.id, batch.traffic)
+	var apiErr *APIError
+	switch {
+	case err == nil:
+		w.unsent = nil
+		w.update(func(s *NodeSnapshot) { s.LastSubmit = time.Now() })
+		return nil
+	case errors.As(err, &apiErr) && apiErr.IsClientError(), registrationInvalid(err), batch.registerId != registerId:
+		// the panel did not count the batch, or it can no longer be sent under
+		// its registration, its traffic goes into a batch of the current one
+		w.unsent = nil
+		w.addPending(batch.traffic, m.config.MaxPendingTraffic)
+	}
+	if batch.registerId != registerId {
+		// a batch of a previous registration must not fail the current one
+		return nil
+	}
+	return err
+}
+
+// jitter add up to Jitter of d at random
+func (m *NodeManager) jitter(d time.Duration) time.Duration {
+	return d + time.Duration(float64(d)*m.config.Jitter*rand.Float64())
+}
+
+// trafficBatch a traffic submission, sent again unchanged until it succeeds
+type trafficBatch struct {
+	registerId string
+	id         string
+	traffic    []*UserTraffic
+}
+
+// nodeWorker state of one node. config, pending and unsent are only used by
+// its worker goroutine, snap is read by Snapshot.
+type nodeWorker struct {
+	spec    NodeSpec
+	users   *UserSet
+	config  NodeConfig
+	pending map[int]*UserTraffic
+	unsent  *trafficBatch
+
+	mu   sync.Mutex
+	snap NodeSnapshot
+}
+
+// addPending merge traffic into pending per user, keeping at most limit
+// users. It returns how many users were dropped.
+func (w *nodeWorker) addPending(traffic []*UserTraffic, limit int) int {
+	if w.pending == nil {
+		w.pending = make(map[int]*UserTraffic, len(traffic))
+	}
+	dropped := 0
+	for _, t := range traffic {
+		if t == nil {
+			continue
+		}
+		pending, ok := w.pending[t.UID]
+		if !ok {
+			if len(w.pending) >= limit {
+				dropped++
+				continue
+			}
+			pending = &UserTraffic{UID: t.UID}
+			w.pending[t.UID] = pending
+		}
+		pending.Upload += t.Upload
+		pending.Download += t.Download
+		pending.Count += t.Count
+	}
+	return dropped
+}
+
+// takePending return the pending traffic ordered by user and clear it
+func (w *nodeWorker) takePending() []*UserTraffic {
+	traffic := slices.SortedFunc(maps.Values(w.pending), func(a, b *UserTraffic) int { return cmp.Compare(a.UID, b.UID) })
+	w.pending = nil
+	return traffic
+}
+
+func (w *nodeWorker) update(fn func(*NodeSnapshot)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	fn(&w.snap)
+}
+
+func (w *nodeWorker) fail(err error) {
+	w.update(func(s *NodeSnapshot) {
+		s.LastError = err
+		s.LastErrorAt = time.Now()
+	})
+}
+
+func (w *nodeWorker) snapshot() NodeSnapshot {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.snap
+}
+
+// sleepContext wait d, reporting false when ctx is done first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
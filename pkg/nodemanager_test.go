@@ -0,0 +1,409 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// managerPanel mock panel for several nodes. Register ids are "<type>-<id>-<n>".
+type managerPanel struct {
+	mu sync.Mutex
+	// registrations per node
+	registrations map[string]int
+	heartbeats    map[string]int
+	unregistered  map[string]bool
+	submitted     map[string]int
+	// failRegister nodes whose registration fails
+	failRegister map[string]bool
+	// expire register ids whose next heartbeat reports them expired
+	expire map[string]bool
+}
+
+func newManagerPanel() *managerPanel {
+	return &managerPanel{
+		registrations: map[string]int{},
+		heartbeats:    map[string]int{},
+		unregistered:  map[string]bool{},
+		submitted:     map[string]int{},
+		failRegister:  map[string]bool{},
+		expire:        map[string]bool{},
+	}
+}
+
+func (p *managerPanel) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/server/enhanced/"), "/")
+	nodeType, action := parts[0], strings.Join(parts[1:], "/")
+	node := nodeType + "-" + r.URL.Query().Get("node_id")
+	registerId := r.URL.Query().Get("register_id")
+	var body struct {
+		RegisterId string            `json:"register_id"`
+		Data       []json.RawMessage `json:"data"`
+	}
+	if r.Method == http.MethodPost {
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		registerId = body.RegisterId
+	}
+
+	switch action {
+	case "register":
+		if p.failRegister[node] {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`{"message":"database down"}`))
+			return
+		}
+		p.registrations[node]++
+		_ = json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"register_id": fmt.Sprintf("%s-%d", node, p.registrations[node])}})
+	case "unregister":
+		p.unregistered[r.URL.Query().Get("register_id")] = true
+		_, _ = w.Write([]byte(`{"data":true}`))
+	case "config":
+		_, _ = w.Write([]byte(`{"data":{"id":1,"server_port":443}}`))
+	case "users/delta":
+		_, _ = w.Write([]byte(`{"data":{"revision":1,"full":true,"users":[{"id":1,"uuid":"a"},{"id":2,"uuid":"b"}]}}`))
+	case "heartbeat":
+		if p.expire[registerId] {
+			delete(p.expire, registerId)
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"message":"register expired","code":"register_expired"}`))
+			return
+		}
+		p.heartbeats[registerId]++
+		_, _ = w.Write([]byte(`{"data":true}`))
+	case "submitWithAgent":
+		p.submitted[registerId] += len(body.Data)
+		_, _ = w.Write([]byte(`{"data":true}`))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (p *managerPanel) with(fn func(p *managerPanel)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fn(p)
+}
+
+// fastManagerConfig intervals short enough for tests
+func fastManagerConfig() NodeManagerConfig {
+	return NodeManagerConfig{
+		ConfigInterval:    20 * time.Millisecond,
+		UsersInterval:     20 * time.Millisecond,
+		HeartbeatInterval: 10 * time.Millisecond,
+		SubmitInterval:    10 * time.Millisecond,
+		StartSpread:       20 * time.Millisecond,
+		RestartDelay:      5 * time.Millisecond,
+		MaxRestartDelay:   20 * time.Millisecond,
+	}
+}
+
+// waitFor poll cond until it holds or the test times out
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestNodeManager(t *testing.T) {
+	panel := newManagerPanel()
+	panel.failRegister["vmess-3"] = true
+	server := httptest.NewServer(panel)
+	t.Cleanup(server.Close)
+
+	var (
+		mu      sync.Mutex
+		configs = map[string]int{}
+		users   = map[string]int{}
+	)
+	config := fastManagerConfig()
+	config.OnConfig = func(spec NodeSpec, _ NodeConfig) {
+		mu.Lock()
+		defer mu.Unlock()
+		configs[spec.String()]++
+	}
+	config.OnUsers = func(spec NodeSpec, changes UserChanges) {
+		mu.Lock()
+		defer mu.Unlock()
+		users[spec.String()] += len(changes.Added)
+	}
+	config.Traffic = func(spec NodeSpec) []*UserTraffic {
+		return []*UserTraffic{{UID: 1, Upload: 1}}
+	}
+	nodes := []NodeSpec{
+		{NodeId: 1, NodeType: Trojan},
+		{NodeId: 2, NodeType: Trojan},
+		{NodeId: 1, NodeType: Trojan}, // duplicate
+		{NodeId: 3, NodeType: VMess},
+	}
+	manager := NewNodeManager(newTestClient(t, server.URL), nodes, config)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- manager.Run(ctx) }()
+
+	waitFor(t, "healthy nodes to run", func() bool {
+		for _, id := range []NodeId{1, 2} {
+			snap, _ := manager.Node(id, Trojan)
+			if snap.State != NodeRunning || snap.LastSubmit.IsZero() || snap.LastUsers.IsZero() {
+				return false
+			}
+		}
+		snap, _ := manager.Node(3, VMess)
+		return snap.Restarts >= 2
+	})
+
+	snaps := manager.Snapshot()
+	if len(snaps) != 3 || snaps[0].NodeType != Trojan || snaps[0].NodeId != 1 || snaps[2].NodeType != VMess {
+		t.Fatalf("Expected 3 nodes ordered by type and id, got %+v", snaps)
+	}
+	if snaps[0].RegisterId != "trojan-1-1" || snaps[0].Users != 2 || snaps[0].LastError != nil {
+		t.Fatalf("Unexpected healthy node %+v", snaps[0])
+	}
+	if snaps[2].State == NodeRunning || snaps[2].LastError == nil || snaps[2].RegisterId != "" {
+		t.Fatalf("Expected the failing node to be restarting, got %+v", snaps[2])
+	}
+	if set, ok := manager.Users(2, Trojan); !ok || set.Len() != 2 {
+		t.Fatalf("Expected the user set of the node")
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("Expected Run to stop with the context, got %v", err)
+	}
+	for _, snap := range manager.Snapshot() {
+		if snap.State != NodeStopped {
+			t.Fatalf("Expected every node stopped, got %+v", snap)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if configs["trojan/1"] != 1 || configs["trojan/2"] != 1 || users["trojan/1"] != 2 {
+		t.Fatalf("Expected one config and one user change per node, got %v %v", configs, users)
+	}
+	panel.with(func(p *managerPanel) {
+		if p.registrations["trojan-1"] != 1 || !p.unregistered["trojan-1-1"] || !p.unregistered["trojan-2-1"] {
+			t.Fatalf("Expected each node registered once and unregistered, got %v %v", p.registrations, p.unregistered)
+		}
+		if p.submitted["trojan-1-1"] == 0 {
+			t.Fatalf("Expected traffic submitted")
+		}
+	})
+}
+
+func TestNodeManagerReregister(t *testing.T) {
+	panel := newManagerPanel()
+	panel.expire["trojan-1-1"] = true
+	server := httptest.NewServer(panel)
+	t.Cleanup(server.Close)
+
+	manager := NewNodeManager(newTestClient(t, server.URL), []NodeSpec{{NodeId: 1, NodeType: Trojan}}, fastManagerConfig())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = manager.Run(ctx) }()
+
+	waitFor(t, "the node to register again", func() bool {
+		snap, _ := manager.Node(1, Trojan)
+		return snap.State == NodeRunning && snap.RegisterId == "trojan-1-2"
+	})
+	if snap, _ := manager.Node(1, Trojan); snap.Restarts != 1 {
+		t.Fatalf("Expected one restart, got %+v", snap)
+	}
+}
+
+func TestNodeManagerRecoversPanics(t *testing.T) {
+	panel := newManagerPanel()
+	server := httptest.NewServer(panel)
+	t.Cleanup(server.Close)
+
+	var calls atomic.Int32
+	config := fastManagerConfig()
+	config.OnConfig = func(NodeSpec, NodeConfig) {
+		if calls.Add(1) == 1 {
+			panic("bad config")
+		}
+	}
+	manager := NewNodeManager(newTestClient(t, server.URL), []NodeSpec{{NodeId: 1, NodeType: Trojan}}, config)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = manager.Run(ctx) }()
+
+	waitFor(t, "the node to recover", func() bool {
+		snap, _ := manager.Node(1, Trojan)
+		return snap.State == NodeRunning && calls.Load() >= 2
+	})
+	snap, _ := manager.Node(1, Trojan)
+	if snap.Restarts != 1 || snap.LastError == nil || !strings.Contains(snap.LastError.Error(), "bad config") {
+		t.Fatalf("Expected the panic recorded as a restart, got %+v", snap)
+	}
+}
+
+func TestNodeManagerKeepsFailedTraffic(t *testing.T) {
+	var (
+		fail     atomic.Bool
+		mu       sync.Mutex
+		failed   []string
+		received = map[string][]UserTraffic{}
+	)
+	fail.Store(true)
+	panel := newManagerPanel()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/submitWithAgent") {
+			var body struct {
+				BatchId string        `json:"batch_id"`
+				Data    []UserTraffic `json:"data"`
+			}
+			_ = json.NewDecoder(r.Body).Decode(&body)
+			mu.Lock()
+			defer mu.Unlock()
+			if fail.Load() {
+				failed = append(failed, body.BatchId)
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			received[body.BatchId] = body.Data
+			_, _ = w.Write([]byte(`{"data":true}`))
+			return
+		}
+		panel.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	var batches atomic.Int32
+	config := fastManagerConfig()
+	config.Traffic = func(NodeSpec) []*UserTraffic {
+		if batches.Load() >= 3 {
+			return nil
+		}
+		batches.Add(1)
+		return []*UserTraffic{{UID: 1, Upload: 1}, {UID: 2, Download: 1}}
+	}
+	manager := NewNodeManager(newTestClient(t, server.URL), []NodeSpec{{NodeId: 1, NodeType: Trojan}}, config)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = manager.Run(ctx) }()
+
+	waitFor(t, "three failed batches", func() bool { return batches.Load() == 3 })
+	fail.Store(false)
+	waitFor(t, "the kept traffic", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received) == 2
+	})
+	if snap, _ := manager.Node(1, Trojan); snap.Restarts != 0 || snap.LastError == nil {
+		t.Fatalf("Expected submit failures recorded without restarts, got %+v", snap)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	// the failed batch is resent under its id, the traffic collected meanwhile is merged per user
+	first := failed[0]
+	for _, id := range failed {
+		if id != first {
+			t.Fatalf("Expected the failed batch resent unchanged, got batch ids %q", failed)
+		}
+	}
+	if got := received[first]; len(got) != 2 || got[0].Upload != 1 || got[1].Download != 1 {
+		t.Fatalf("Unexpected first batch %+v", got)
+	}
+	for id, got := range received {
+		if id != first && (len(got) != 2 || got[0].UID != 1 || got[0].Upload != 2 || got[1].Download != 2) {
+			t.Fatalf("Expected the later traffic merged per user, got %+v", got)
+		}
+	}
+}
+
+func TestNodeManagerFailedTrafficAfterRestart(t *testing.T) {
+	var (
+		fail     atomic.Bool
+		mu       sync.Mutex
+		accepted = map[string]uint64{}
+	)
+	fail.Store(true)
+	panel := newManagerPanel()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/submitWithAgent") {
+			panel.ServeHTTP(w, r)
+			return
+		}
+		var body struct {
+			RegisterId string        `json:"register_id"`
+			Data       []UserTraffic `json:"data"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		switch {
+		case fail.Load():
+			w.WriteHeader(http.StatusBadGateway)
+		case body.RegisterId == "trojan-1-1":
+			// the panel rejects the expired id inside a success response
+			_, _ = w.Write([]byte(`{"data":false,"message":"register expired","code":"register_expired"}`))
+		default:
+			mu.Lock()
+			defer mu.Unlock()
+			for _, traffic := range body.Data {
+				accepted[body.RegisterId] += traffic.Upload
+			}
+			_, _ = w.Write([]byte(`{"data":true}`))
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	var batches atomic.Int32
+	config := fastManagerConfig()
+	config.Traffic = func(NodeSpec) []*UserTraffic {
+		if batches.Load() >= 2 {
+			return nil
+		}
+		batches.Add(1)
+		return []*UserTraffic{{UID: 1, Upload: 1}}
+	}
+	manager := NewNodeManager(newTestClient(t, server.URL), []NodeSpec{{NodeId: 1, NodeType: Trojan}}, config)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = manager.Run(ctx) }()
+
+	// the batch fails under the first registration, which then expires
+	waitFor(t, "two failed batches", func() bool { return batches.Load() == 2 })
+	panel.with(func(p *managerPanel) { p.expire["trojan-1-1"] = true })
+	waitFor(t, "the node to register again", func() bool {
+		var registrations int
+		panel.with(func(p *managerPanel) { registrations = p.registrations["trojan-1"] })
+		return registrations == 2
+	})
+	fail.Store(false)
+	waitFor(t, "the traffic under the new registration", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return accepted["trojan-1-2"] == 2
+	})
+}
+
+func TestNodeManagerPendingTraffic(t *testing.T) {
+	w := &nodeWorker{}
+	if dropped := w.addPending([]*UserTraffic{{UID: 2, Upload: 1}, {UID: 1, Upload: 1}, nil}, 2); dropped != 0 {
+		t.Fatalf("Expected nothing dropped, got %d", dropped)
+	}
+	if dropped := w.addPending([]*UserTraffic{{UID: 1, Upload: 2, Count: 1}, {UID: 3, Upload: 1}}, 2); dropped != 1 {
+		t.Fatalf("Expected the third user dropped, got %d", dropped)
+	}
+	got := w.takePending()
+	if len(got) != 2 || got[0].UID != 1 || got[0].Upload != 3 || got[0].Count != 1 || got[1].UID != 2 {
+		t.Fatalf("Unexpected pending traffic %+v", got)
+	}
+	if len(w.pending) != 0 {
+		t.Fatalf("Expected the pending traffic cleared")
+	}
+}
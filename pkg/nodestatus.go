@@ -0,0 +1,300 @@
+package pkg
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StatusCollector collects the NodeStatus of a Linux host from procfs.
+// CPU usage and network speeds are computed between two calls of Collect,
+// the first call reports them as 0. It is safe for concurrent use.
+type StatusCollector struct {
+	// ProcPath root of procfs, defaults to /proc. Tests point it to a fake tree.
+	ProcPath string
+	// DiskPath a path on the filesystem whose usage is reported, defaults to /
+	DiskPath string
+	// Interfaces counted for network traffic, empty counts all but loopback
+	Interfaces []string
+
+	// now and statfs are replaced in tests
+	now    func() time.Time
+	statfs func(path string) (total, used uint64, err error)
+
+	mu   sync.Mutex
+	prev *statusSample
+}
+
+// statusSample counters kept between two collections
+type statusSample struct {
+	at       time.Time
+	cpuTotal uint64
+	cpuIdle  uint64
+	netIn    uint64
+	netOut   uint64
+}
+
+// NewStatusCollector create a collector reading /proc and the usage of /
+func NewStatusCollector() *StatusCollector {
+	return &StatusCollector{}
+}
+
+func (c *StatusCollector) path(name string) string {
+	root := c.ProcPath
+	if root == "" {
+		root = "/proc"
+	}
+	return filepath.Join(root, name)
+}
+
+// Collect read the current status
+func (c *StatusCollector) Collect() (*NodeStatus, error) {
+	now := time.Now
+	if c.now != nil {
+		now = c.now
+	}
+	statfs := diskUsage
+	if c.statfs != nil {
+		statfs = c.statfs
+	}
+	status := &NodeStatus{}
+
+	cpuTotal, cpuIdle, err := c.readCPU()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.readMemory(status); err != nil {
+		return nil, err
+	}
+	if err := c.readLoad(status); err != nil {
+		return nil, err
+	}
+	if err := c.readUptime(status); err != nil {
+		return nil, err
+	}
+	if err := c.readNetTraffic(status); err != nil {
+		return nil, err
+	}
+	status.TCPConns = c.countSockets("net/tcp", "net/tcp6")
+	status.UDPConns = c.countSockets("net/udp", "net/udp6")
+
+	diskPath := c.DiskPath
+	if diskPath == "" {
+		diskPath = "/"
+	}
+	total, used, err := statfs(diskPath)
+	switch {
+	case errors.Is(err, errors.ErrUnsupported):
+	case err != nil:
+		return nil, NewIOError("read disk usage failed", fmt.Errorf("%s: %w", diskPath, err))
+	default:
+		status.DiskTotal = total
+		status.DiskUsed = used
+	}
+
+	sample := &statusSample{at: now(), cpuTotal: cpuTotal, cpuIdle: cpuIdle, netIn: status.NetInTotal, netOut: status.NetOutTotal}
+	c.mu.Lock()
+	prev := c.prev
+	c.prev = sample
+	c.mu.Unlock()
+	if prev != nil {
+		if total := sample.cpuTotal - prev.cpuTotal; sample.cpuTotal > prev.cpuTotal {
+			idle := min(sample.cpuIdle-prev.cpuIdle, total)
+			status.CPU = float64(total-idle) / float64(total) * 100
+		}
+		if elapsed := sample.at.Sub(prev.at).Seconds(); elapsed > 0 {
+			// counters reset when an interface goes down, report 0 rather than a wrap
+			if sample.netIn >= prev.netIn {
+				status.NetInSpeed = uint64(float64(sample.netIn-prev.netIn) / elapsed)
+			}
+			if sample.netOut >= prev.netOut {
+				status.NetOutSpeed = uint64(float64(sample.netOut-prev.netOut) / elapsed)
+			}
+		}
+	}
+	return status, nil
+}
+
+// readCPU total and idle jiffies of all cores from the first line of stat
+func (c *StatusCollector) readCPU() (total, idle uint64, err error) {
+	data, err := os.ReadFile(c.path("stat"))
+	if err != nil {
+		return 0, 0, NewIOError("read procfs failed", err)
+	}
+	line, _, _ := strings.Cut(string(data), "\n")
+	fields := strings.Fields(line)
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return 0, 0, NewParseError("parse procfs failed", fmt.Errorf("unexpected %s line %q", c.path("stat"), line))
+	}
+	// user nice system idle iowait irq softirq steal, guest time is already in user
+	for i, field := range fields[1:min(len(fields), 9)] {
+		v, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return 0, 0, NewParseError("parse procfs failed", fmt.Errorf("%s: %w", c.path("stat"), err))
+		}
+		total += v
+		if i == 3 || i == 4 {
+			idle += v
+		}
+	}
+	return total, idle, nil
+}
+
+func (c *StatusCollector) readMemory(status *NodeStatus) error {
+	f, err := os.Open(c.path("meminfo"))
+	if err != nil {
+		return NewIOError("read procfs failed", err)
+	}
+	defer f.Close()
+	info := make(map[string]uint64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		// values are in kB
+		info[key] = v * 1024
+	}
+	if err := scanner.Err(); err != nil {
+		return NewIOError("read procfs failed", err)
+	}
+	available, ok := info["MemAvailable"]
+	if !ok {
+		// kernels before 3.14
+		available = info["MemFree"] + info["Buffers"] + info["Cached"]
+	}
+	status.MemTotal = info["MemTotal"]
+	status.MemUsed = info["MemTotal"] - min(available, info["MemTotal"])
+	status.SwapTotal = info["SwapTotal"]
+	status.SwapUsed = info["SwapTotal"] - min(info["SwapFree"], info["SwapTotal"])
+	return nil
+}
+
+func (c *StatusCollector) readLoad(status *NodeStatus) error {
+	data, err := os.ReadFile(c.path("loadavg"))
+	if err != nil {
+		return NewIOError("read procfs failed", err)
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 3 {
+		return NewParseError("parse procfs failed", fmt.Errorf("unexpected %s content %q", c.path("loadavg"), data))
+	}
+	loads := make([]float64, 3)
+	for i := range loads {
+		if loads[i], err = strconv.ParseFloat(fields[i], 64); err != nil {
+			return NewParseError("parse procfs failed", fmt.Errorf("%s: %w", c.path("loadavg"), err))
+		}
+	}
+	status.Load1, status.Load5, status.Load15 = loads[0], loads[1], loads[2]
+	return nil
+}
+
+func (c *StatusCollector) readUptime(status *NodeStatus) error {
+	data, err := os.ReadFile(c.path("uptime"))
+	if err != nil {
+		return NewIOError("read procfs failed", err)
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return NewParseError("parse procfs failed", fmt.Errorf("unexpected %s content %q", c.path("uptime"), data))
+	}
+	uptime, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return NewParseError("parse procfs failed", fmt.Errorf("%s: %w", c.path("uptime"), err))
+	}
+	status.Uptime = uint64(uptime)
+	return nil
+}
+
+// readNetTraffic sum the received and transmitted bytes of the counted interfaces
+func (c *StatusCollector) readNetTraffic(status *NodeStatus) error {
+	f, err := os.Open(c.path("net/dev"))
+	if err != nil {
+		return NewIOError("read procfs failed", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		name, counters, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			// the two header lines
+			continue
+		}
+		name = strings.TrimSpace(name)
+		if !c.countInterface(name) {
+			continue
+		}
+		// receive bytes is the 1st field, transmit bytes the 9th
+		fields := strings.Fields(counters)
+		if len(fields) < 9 {
+			continue
+		}
+		in, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			return NewParseError("parse procfs failed", fmt.Errorf("%s: %w", c.path("net/dev"), err))
+		}
+		out, err := strconv.ParseUint(fields[8], 10, 64)
+		if err != nil {
+			return NewParseError("parse procfs failed", fmt.Errorf("%s: %w", c.path("net/dev"), err))
+		}
+		status.NetInTotal += in
+		status.NetOutTotal += out
+	}
+	if err := scanner.Err(); err != nil {
+		return NewIOError("read procfs failed", err)
+	}
+	return nil
+}
+
+func (c *StatusCollector) countInterface(name string) bool {
+	if len(c.Interfaces) == 0 {
+		return name != "lo"
+	}
+	return slices.Contains(c.Interfaces, name)
+}
+
+// countSockets count the sockets listed in the procfs socket tables, leaving out
+// listening TCP sockets. Missing tables, e.g. without IPv6, count as empty.
+func (c *StatusCollector) countSockets(names ...string) int {
+	count := 0
+	for _, name := range names {
+		f, err := os.Open(c.path(name))
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Scan() // header
+		for scanner.Scan() {
+			// sl local_address rem_address st ...
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 4 {
+				continue
+			}
+			if strings.HasPrefix(name, "net/tcp") && fields[3] == tcpListen {
+				continue
+			}
+			count++
+		}
+		_ = f.Close()
+	}
+	return count
+}
+
+// tcpListen TCP_LISTEN state in the st column of /proc/net/tcp
+const tcpListen = "0A"
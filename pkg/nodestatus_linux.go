@@ -0,0 +1,12 @@
+package pkg
+
+import "syscall"
+
+// diskUsage total and used bytes of the filesystem holding path, like df
+func diskUsage(path string) (total, used uint64, err error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, 0, err
+	}
+	return stat.Blocks * uint64(stat.Bsize), (stat.Blocks - stat.Bfree) * uint64(stat.Bsize), nil
+}
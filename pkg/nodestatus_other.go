@@ -0,0 +1,10 @@
+//go:build !linux
+
+package pkg
+
+import "errors"
+
+// diskUsage is only implemented on Linux, the status then reports no disk
+func diskUsage(string) (total, used uint64, err error) {
+	return 0, 0, errors.ErrUnsupported
+}
@@ -0,0 +1,221 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeProc write files of a fake procfs tree under dir
+func writeProc(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+const netDevHeader = `Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+`
+
+func fakeProc(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	writeProc(t, dir, map[string]string{
+		"stat": "cpu  100 0 100 700 100 0 0 0 0 0\ncpu0 50 0 50 350 50 0 0 0 0 0\n",
+		"meminfo": "MemTotal:        1000 kB\nMemFree:          100 kB\nMemAvailable:     400 kB\n" +
+			"SwapTotal:        200 kB\nSwapFree:         150 kB\n",
+		"loadavg": "0.50 0.25 0.10 1/123 4567\n",
+		"uptime":  "3600.42 7000.00\n",
+		"net/dev": netDevHeader +
+			"    lo: 5000 10 0 0 0 0 0 0 5000 10 0 0 0 0 0 0\n" +
+			"  eth0: 1000 10 0 0 0 0 0 0 2000 20 0 0 0 0 0 0\n" +
+			"  eth1: 100 1 0 0 0 0 0 0 200 2 0 0 0 0 0 0\n",
+		"net/tcp": "  sl  local_address rem_address   st tx_queue rx_queue\n" +
+			"   0: 00000000:01BB 00000000:0000 0A 00000000:00000000\n" +
+			"   1: 0100007F:01BB 0100007F:D431 01 00000000:00000000\n" +
+			"   2: 0100007F:01BB 0100007F:D432 01 00000000:00000000\n",
+		"net/tcp6": "  sl  local_address rem_address   st tx_queue rx_queue\n" +
+			"   0: 00000000000000000000000000000000:01BB 00000000000000000000000000000000:0000 0A 00000000:00000000\n" +
+			"   1: 00000000000000000000000001000000:01BB 00000000000000000000000001000000:D433 01 00000000:00000000\n",
+		"net/udp": "  sl  local_address rem_address   st tx_queue rx_queue\n" +
+			"   0: 00000000:0035 00000000:0000 07 00000000:00000000\n",
+		// no net/udp6, as on hosts without IPv6
+	})
+	return dir
+}
+
+func TestStatusCollector(t *testing.T) {
+	dir := fakeProc(t)
+	now := time.Unix(1700000000, 0)
+	collector := &StatusCollector{
+		ProcPath: dir,
+		now:      func() time.Time { return now },
+		statfs: func(path string) (uint64, uint64, error) {
+			if path != "/" {
+				t.Fatalf("Expected the usage of /, got %s", path)
+			}
+			return 10000, 2500, nil
+		},
+	}
+
+	status, err := collector.Collect()
+	if err != nil {
+		t.Fatalf("Collect() unexpected error: %v", err)
+	}
+	want := NodeStatus{
+		MemTotal: 1000 * 1024, MemUsed: 600 * 1024,
+		SwapTotal: 200 * 1024, SwapUsed: 50 * 1024,
+		DiskTotal: 10000, DiskUsed: 2500,
+		Load1: 0.5, Load5: 0.25, Load15: 0.1,
+		Uptime:   3600,
+		TCPConns: 3, UDPConns: 1,
+		NetInTotal: 1100, NetOutTotal: 2200,
+	}
+	if *status != want {
+		t.Fatalf("Unexpected first status\n got %+v\nwant %+v", *status, want)
+	}
+
+	// 10s later: 1000 more jiffies of which 250 idle, 10000/5000 more bytes
+	now = now.Add(10 * time.Second)
+	writeProc(t, dir, map[string]string{
+		"stat": "cpu  500 0 450 900 150 0 0 0 0 0\n",
+		"net/dev": netDevHeader +
+			"  eth0: 11000 10 0 0 0 0 0 0 7000 20 0 0 0 0 0 0\n" +
+			"  eth1: 100 1 0 0 0 0 0 0 200 2 0 0 0 0 0 0\n",
+	})
+	status, err = collector.Collect()
+	if err != nil {
+		t.Fatalf("Collect() unexpected error: %v", err)
+	}
+	if status.CPU != 75 {
+		t.Fatalf("Expected 75%% CPU, got %v", status.CPU)
+	}
+	if status.NetInSpeed != 1000 || status.NetOutSpeed != 500 {
+		t.Fatalf("Expected 1000/500 B/s, got %d/%d", status.NetInSpeed, status.NetOutSpeed)
+	}
+}
+
+func TestStatusCollectorOptions(t *testing.T) {
+	dir := fakeProc(t)
+	// kernels without MemAvailable
+	writeProc(t, dir, map[string]string{
+		"meminfo": "MemTotal: 1000 kB\nMemFree: 100 kB\nBuffers: 50 kB\nCached: 250 kB\n",
+	})
+	collector := &StatusCollector{
+		ProcPath:   dir,
+		DiskPath:   "/data",
+		Interfaces: []string{"eth1"},
+		statfs: func(path string) (uint64, uint64, error) {
+			if path != "/data" {
+				t.Fatalf("Expected the usage of /data, got %s", path)
+			}
+			return 0, 0, errors.ErrUnsupported
+		},
+	}
+	status, err := collector.Collect()
+	if err != nil {
+		t.Fatalf("Collect() unexpected error: %v", err)
+	}
+	if status.MemUsed != 600*1024 {
+		t.Fatalf("Expected used memory from free, buffers and cached, got %d", status.MemUsed)
+	}
+	if status.NetInTotal != 100 || status.NetOutTotal != 200 {
+		t.Fatalf("Expected only eth1 traffic, got %d/%d", status.NetInTotal, status.NetOutTotal)
+	}
+	if status.DiskTotal != 0 {
+		t.Fatalf("Expected no disk usage when unsupported, got %d", status.DiskTotal)
+	}
+
+	collector.statfs = func(string) (uint64, uint64, error) { return 0, 0, os.ErrPermission }
+	if _, err := collector.Collect(); !errors.Is(err, os.ErrPermission) {
+		t.Fatalf("Expected the disk error, got %v", err)
+	}
+}
+
+func TestStatusCollectorErrors(t *testing.T) {
+	for _, name := range []string{"stat", "meminfo", "loadavg", "uptime", "net/dev"} {
+		t.Run(name, func(t *testing.T) {
+			dir := fakeProc(t)
+			if err := os.Remove(filepath.Join(dir, name)); err != nil {
+				t.Fatal(err)
+			}
+			collector := &StatusCollector{ProcPath: dir, statfs: func(string) (uint64, uint64, error) { return 0, 0, nil }}
+			_, err := collector.Collect()
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) || !apiErr.IsIOError() || !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("Expected a missing %s error, got %v", name, err)
+			}
+		})
+	}
+
+	dir := fakeProc(t)
+	writeProc(t, dir, map[string]string{"loadavg": "high\n"})
+	collector := &StatusCollector{ProcPath: dir, statfs: func(string) (uint64, uint64, error) { return 0, 0, nil }}
+	_, err := collector.Collect()
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || !apiErr.IsParseError() {
+		t.Fatalf("Expected a parse error, got %v", err)
+	}
+}
+
+func TestStatusCollectorHost(t *testing.T) {
+	if _, err := os.Stat("/proc/stat"); err != nil {
+		t.Skip("no procfs")
+	}
+	status, err := NewStatusCollector().Collect()
+	if err != nil {
+		t.Fatalf("Collect() unexpected error: %v", err)
+	}
+	if status.MemTotal == 0 || status.Uptime == 0 {
+		t.Fatalf("Expected the host status, got %+v", status)
+	}
+}
+
+func TestSubmitNodeStatus(t *testing.T) {
+	var (
+		path string
+		body struct {
+			RegisterId string     `json:"register_id"`
+			Data       NodeStatus `json:"data"`
+		}
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		raw, _ := io.ReadAll(r.Body)
+		_ = json.Unmarshal(raw, &body)
+		_, _ = w.Write([]byte(`{"data":true,"message":"success"}`))
+	}))
+	t.Cleanup(server.Close)
+	client := newTestClient(t, server.URL)
+
+	status := &NodeStatus{CPU: 12.5, MemTotal: 1 << 30, TCPConns: 42}
+	if err := client.SubmitNodeStatus(context.Background(), "test-register-id", Trojan, status); err != nil {
+		t.Fatalf("SubmitNodeStatus() unexpected error: %v", err)
+	}
+	if path != "/api/v1/server/enhanced/trojan/status" {
+		t.Fatalf("Unexpected path %s", path)
+	}
+	if body.RegisterId != "test-register-id" || body.Data != *status {
+		t.Fatalf("Unexpected body %+v", body)
+	}
+
+	err := client.SubmitNodeStatus(context.Background(), "test-register-id", Trojan, nil)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || !apiErr.IsInvalidInput() {
+		t.Fatalf("Expected an invalid input error for a nil status, got %v", err)
+	}
+}
@@ -0,0 +1,180 @@
+package pkg
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MaxOnlineIPsPerUser upper bound of the IPs reported per user, enough to
+// enforce any device limit while keeping reports of abused accounts small
+const MaxOnlineIPsPerUser = 64
+
+// MaxOnlineIPs upper bound of the IPs in one online report, about 3MB of JSON
+const MaxOnlineIPs = 100000
+
+// normalizeIP strip the port and zone of an address and canonicalize it, so
+// the same client is counted once. Addresses that do not parse are kept trimmed.
+func normalizeIP(addr string) string {
+	addr = strings.TrimSpace(addr)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	ip, err := netip.ParseAddr(strings.Trim(addr, "[]"))
+	if err != nil {
+		return addr
+	}
+	return ip.Unmap().WithZone("").String()
+}
+
+// onlineUsers the request model of an online report, ordered by user id with
+// normalized, deduplicated and capped IPs. Users without IPs are left out.
+// It also returns how many IPs capOnlineIPs left out to stay within MaxOnlineIPs.
+func onlineUsers(online map[int][]string) ([]OnlineUser, int) {
+	users := make([]OnlineUser, 0, len(online))
+	for uid, addrs := range online {
+		ips := make([]string, 0, len(addrs))
+		for _, addr := range addrs {
+			if ip := normalizeIP(addr); ip != "" {
+				ips = append(ips, ip)
+			}
+		}
+		slices.Sort(ips)
+		ips = slices.Compact(ips)
+		if len(ips) == 0 {
+			continue
+		}
+		if len(ips) > MaxOnlineIPsPerUser {
+			ips = ips[:MaxOnlineIPsPerUser]
+		}
+		users = append(users, OnlineUser{UID: uid, IPs: ips})
+	}
+	slices.SortFunc(users, func(a, b OnlineUser) int { return a.UID - b.UID })
+	users, dropped := capOnlineIPs(users, MaxOnlineIPs)
+	return users, dropped
+}
+
+// capOnlineIPs keep at most limit IPs in total. The IPs per user are lowered
+// to the highest bound that fits, so the users with the most IPs are trimmed
+// first and every user keeps at least one IP. Only when there are more users
+// than limit, the users with the highest ids are left out. It returns the
+// users and how many IPs were left out.
+func capOnlineIPs(users []OnlineUser, limit int) ([]OnlineUser, int) {
+	count := func(perUser int) int {
+		total := 0
+		for _, user := range users {
+			total += min(len(user.IPs), perUser)
+		}
+		return total
+	}
+	total := count(MaxOnlineIPsPerUser)
+	if total <= limit {
+		return users, 0
+	}
+	if len(users) > limit {
+		users = users[:limit]
+	}
+	// the highest bound whose total fits, 1 always does now
+	perUser := sort.Search(MaxOnlineIPsPerUser, func(n int) bool { return count(n+1) > limit })
+	for i := range users {
+		if len(users[i].IPs) > perUser {
+			users[i].IPs = users[i].IPs[:perUser]
+		}
+	}
+	return users, total - count(perUser)
+}
+
+// OnlineTracker tracks the IPs users are connected from, fed by the proxy core
+// with connection events. Report gives the map SubmitOnlineUsers expects.
+// It is safe for concurrent use.
+type OnlineTracker struct {
+	mu sync.Mutex
+	// connections open connections per user and IP
+	connections map[int]map[string]int
+	// recent IPs whose connections all closed since the last report
+	recent map[int]map[string]struct{}
+}
+
+// NewOnlineTracker create an empty tracker
+func NewOnlineTracker() *OnlineTracker {
+	return &OnlineTracker{
+		connections: make(map[int]map[string]int),
+		recent:      make(map[int]map[string]struct{}),
+	}
+}
+
+// Connect record a connection of user uid from addr, an IP with or without port
+func (t *OnlineTracker) Connect(uid int, addr string) {
+	ip := normalizeIP(addr)
+	if ip == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ips, ok := t.connections[uid]
+	if !ok {
+		ips = make(map[string]int)
+		t.connections[uid] = ips
+	}
+	ips[ip]++
+}
+
+// Disconnect record the end of a connection recorded by Connect. The IP stays
+// in the next report so short connections between reports are not missed.
+func (t *OnlineTracker) Disconnect(uid int, addr string) {
+	ip := normalizeIP(addr)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ips, ok := t.connections[uid]
+	if !ok || ips[ip] == 0 {
+		return
+	}
+	if ips[ip]--; ips[ip] > 0 {
+		return
+	}
+	delete(ips, ip)
+	if len(ips) == 0 {
+		delete(t.connections, uid)
+	}
+	recent, ok := t.recent[uid]
+	if !ok {
+		recent = make(map[string]struct{})
+		t.recent[uid] = recent
+	}
+	recent[ip] = struct{}{}
+}
+
+// Online number of users with open connections
+func (t *OnlineTracker) Online() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.connections)
+}
+
+// Report the IPs of each user connected since the previous report: open
+// connections and those closed in between. It starts a new report period.
+func (t *OnlineTracker) Report() map[int][]string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	report := make(map[int][]string, len(t.connections)+len(t.recent))
+	for uid, ips := range t.connections {
+		for ip := range ips {
+			report[uid] = append(report[uid], ip)
+		}
+	}
+	for uid, ips := range t.recent {
+		for ip := range ips {
+			if _, open := t.connections[uid][ip]; !open {
+				report[uid] = append(report[uid], ip)
+			}
+		}
+	}
+	for _, ips := range report {
+		slices.Sort(ips)
+	}
+	t.recent = make(map[int]map[string]struct{})
+	return report
+}
@@ -0,0 +1,206 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestNormalizeIP(t *testing.T) {
+	tests := map[string]string{
+		"1.2.3.4":           "1.2.3.4",
+		" 1.2.3.4:5678 ":    "1.2.3.4",
+		"[2001:db8::1]:443": "2001:db8::1",
+		"2001:DB8:0::1":     "2001:db8::1",
+		"::ffff:1.2.3.4":    "1.2.3.4",
+		"fe80::1%eth0":      "fe80::1",
+		"not-an-ip":         "not-an-ip",
+		"":                  "",
+	}
+	for addr, want := range tests {
+		if got := normalizeIP(addr); got != want {
+			t.Errorf("normalizeIP(%q) = %q, want %q", addr, got, want)
+		}
+	}
+}
+
+func TestOnlineUsers(t *testing.T) {
+	many := make([]string, MaxOnlineIPsPerUser+10)
+	for i := range many {
+		many[i] = fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+	}
+	got, dropped := onlineUsers(map[int][]string{
+		2: {"1.1.1.1:1000", "1.1.1.1:2000", "::ffff:1.1.1.1", "2.2.2.2"},
+		1: {"3.3.3.3"},
+		3: {"", " "},
+		4: many,
+	})
+	if len(got) != 3 || dropped != 0 {
+		t.Fatalf("Expected users without IPs to be left out, got %v", got)
+	}
+	if got[0].UID != 1 || got[1].UID != 2 || got[2].UID != 4 {
+		t.Fatalf("Expected users ordered by id, got %v", got)
+	}
+	if !reflect.DeepEqual(got[1].IPs, []string{"1.1.1.1", "2.2.2.2"}) {
+		t.Fatalf("Expected deduplicated IPs, got %v", got[1].IPs)
+	}
+	if len(got[2].IPs) != MaxOnlineIPsPerUser {
+		t.Fatalf("Expected %d IPs at most, got %d", MaxOnlineIPsPerUser, len(got[2].IPs))
+	}
+}
+
+func TestCapOnlineIPs(t *testing.T) {
+	users := func(counts ...int) []OnlineUser {
+		list := make([]OnlineUser, len(counts))
+		for i, n := range counts {
+			list[i].UID = i + 1
+			for j := range n {
+				list[i].IPs = append(list[i].IPs, fmt.Sprintf("10.0.%d.%d", i, j))
+			}
+		}
+		return list
+	}
+	ipCounts := func(list []OnlineUser) []int {
+		counts := make([]int, len(list))
+		for i, user := range list {
+			counts[i] = len(user.IPs)
+		}
+		return counts
+	}
+
+	tests := []struct {
+		name        string
+		counts      []int
+		limit       int
+		want        []int
+		wantDropped int
+	}{
+		{"fits", []int{3, 1, 2}, 6, []int{3, 1, 2}, 0},
+		{"largest trimmed first", []int{10, 1, 4}, 8, []int{3, 1, 3}, 8},
+		{"one IP each", []int{5, 5, 5}, 4, []int{1, 1, 1}, 12},
+		{"more users than the limit", []int{2, 2, 2}, 2, []int{1, 1}, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, dropped := capOnlineIPs(users(tt.counts...), tt.limit)
+			if !reflect.DeepEqual(ipCounts(got), tt.want) || dropped != tt.wantDropped {
+				t.Fatalf("capOnlineIPs() = %v dropping %d, want %v dropping %d", ipCounts(got), dropped, tt.want, tt.wantDropped)
+			}
+		})
+	}
+
+	// a report of many users with the maximum of IPs stays within MaxOnlineIPs
+	online := make(map[int][]string, 2*MaxOnlineIPs/MaxOnlineIPsPerUser)
+	for uid := range 2 * MaxOnlineIPs / MaxOnlineIPsPerUser {
+		ips := make([]string, MaxOnlineIPsPerUser)
+		for i := range ips {
+			ips[i] = fmt.Sprintf("10.%d.%d.%d", uid/256, uid%256, i)
+		}
+		online[uid] = ips
+	}
+	report, dropped := onlineUsers(online)
+	total := 0
+	for _, user := range report {
+		total += len(user.IPs)
+	}
+	if len(report) != len(online) || total > MaxOnlineIPs || dropped == 0 {
+		t.Fatalf("Expected every user kept within %d IPs, got %d users with %d IPs", MaxOnlineIPs, len(report), total)
+	}
+}
+
+func TestSubmitOnlineUsers(t *testing.T) {
+	var (
+		path string
+		body struct {
+			RegisterId string       `json:"register_id"`
+			Data       []OnlineUser `json:"data"`
+		}
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		raw, _ := io.ReadAll(r.Body)
+		_ = json.Unmarshal(raw, &body)
+		_, _ = w.Write([]byte(`{"data":true,"message":"success"}`))
+	}))
+	t.Cleanup(server.Close)
+	client := newTestClient(t, server.URL)
+
+	err := client.SubmitOnlineUsers(context.Background(), "test-register-id", Trojan, map[int][]string{
+		1: {"1.1.1.1:443", "1.1.1.1:444"},
+	})
+	if err != nil {
+		t.Fatalf("SubmitOnlineUsers() unexpected error: %v", err)
+	}
+	if path != "/api/v1/server/enhanced/trojan/submitOnlineUsers" {
+		t.Fatalf("Unexpected path %s", path)
+	}
+	want := []OnlineUser{{UID: 1, IPs: []string{"1.1.1.1"}}}
+	if body.RegisterId != "test-register-id" || !reflect.DeepEqual(body.Data, want) {
+		t.Fatalf("Unexpected body %+v", body)
+	}
+
+	// an empty report is still sent, as an empty list
+	if err := client.SubmitOnlineUsers(context.Background(), "test-register-id", Trojan, nil); err != nil {
+		t.Fatalf("SubmitOnlineUsers() unexpected error: %v", err)
+	}
+	if body.Data == nil || len(body.Data) != 0 {
+		t.Fatalf("Expected an empty list, got %v", body.Data)
+	}
+}
+
+func TestOnlineTracker(t *testing.T) {
+	tracker := NewOnlineTracker()
+	tracker.Connect(1, "1.1.1.1:1000")
+	tracker.Connect(1, "1.1.1.1:2000")
+	tracker.Connect(1, "2.2.2.2:1000")
+	tracker.Connect(2, "3.3.3.3:1000")
+	tracker.Disconnect(2, "3.3.3.3:1000")
+	tracker.Disconnect(3, "4.4.4.4") // never connected
+
+	if tracker.Online() != 1 {
+		t.Fatalf("Expected 1 online user, got %d", tracker.Online())
+	}
+	want := map[int][]string{1: {"1.1.1.1", "2.2.2.2"}, 2: {"3.3.3.3"}}
+	if got := tracker.Report(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected closed connections in the first report, got %v", got)
+	}
+
+	// one of two connections from 1.1.1.1 closes, the IP is still online
+	tracker.Disconnect(1, "1.1.1.1:2000")
+	tracker.Disconnect(1, "2.2.2.2:1000")
+	want = map[int][]string{1: {"1.1.1.1", "2.2.2.2"}}
+	if got := tracker.Report(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Unexpected second report %v", got)
+	}
+	want = map[int][]string{1: {"1.1.1.1"}}
+	if got := tracker.Report(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected only open connections once reported, got %v", got)
+	}
+}
+
+func TestOnlineTrackerConcurrent(t *testing.T) {
+	tracker := NewOnlineTracker()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(uid int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				addr := fmt.Sprintf("10.0.0.%d:%d", j%4, j)
+				tracker.Connect(uid, addr)
+				_ = tracker.Report()
+				tracker.Disconnect(uid, addr)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if tracker.Online() != 0 {
+		t.Fatalf("Expected every connection closed, got %d online", tracker.Online())
+	}
+}
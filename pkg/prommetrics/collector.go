@@ -0,0 +1,138 @@
+// Package prommetrics exports panel client metrics to Prometheus.
+//
+//	collector := prommetrics.New(prommetrics.Options{})
+//	prometheus.MustRegister(collector)
+//	client := pkg.New(&pkg.Config{..., Metrics: collector})
+//
+// The ETag hit ratio of an operation is
+//
+//	rate(panel_client_etag_requests_total{result="hit"}[5m])
+//	  / rate(panel_client_etag_requests_total[5m])
+package prommetrics
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/xflash-panda/server-client/pkg"
+)
+
+// Options collector options, zero fields use the defaults
+type Options struct {
+	// Namespace metric name prefix, defaults to "panel_client"
+	Namespace string
+	// ConstLabels added to every metric, e.g. the node name
+	ConstLabels prometheus.Labels
+	// DurationBuckets request duration buckets in seconds, defaults to prometheus.DefBuckets
+	DurationBuckets []float64
+	// SizeBuckets response size buckets in bytes, defaults to 64B..16MB
+	SizeBuckets []float64
+}
+
+// Collector implements pkg.Metrics and prometheus.Collector
+type Collector struct {
+	requests     *prometheus.CounterVec
+	duration     *prometheus.HistogramVec
+	responseSize *prometheus.HistogramVec
+	etag         *prometheus.CounterVec
+	retries      *prometheus.CounterVec
+}
+
+var _ pkg.Metrics = (*Collector)(nil)
+var _ prometheus.Collector = (*Collector)(nil)
+
+// New create a collector, register it with a prometheus.Registerer to export it
+func New(opts Options) *Collector {
+	if opts.Namespace == "" {
+		opts.Namespace = "panel_client"
+	}
+	if opts.DurationBuckets == nil {
+		opts.DurationBuckets = prometheus.DefBuckets
+	}
+	if opts.SizeBuckets == nil {
+		opts.SizeBuckets = prometheus.ExponentialBuckets(64, 4, 10)
+	}
+	labels := []string{"operation", "node_type"}
+	return &Collector{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   opts.Namespace,
+			Name:        "requests_total",
+			Help:        "Panel calls by operation, node type, HTTP status and error type.",
+			ConstLabels: opts.ConstLabels,
+		}, []string{"operation", "node_type", "status", "error_type"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   opts.Namespace,
+			Name:        "request_duration_seconds",
+			Help:        "Duration of panel calls including retries.",
+			ConstLabels: opts.ConstLabels,
+			Buckets:     opts.DurationBuckets,
+		}, labels),
+		responseSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   opts.Namespace,
+			Name:        "response_size_bytes",
+			Help:        "Size of panel response bodies.",
+			ConstLabels: opts.ConstLabels,
+			Buckets:     opts.SizeBuckets,
+		}, labels),
+		etag: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   opts.Namespace,
+			Name:        "etag_requests_total",
+			Help:        "Conditional panel calls by result, hit when the panel answered 304.",
+			ConstLabels: opts.ConstLabels,
+		}, []string{"operation", "node_type", "result"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   opts.Namespace,
+			Name:        "retries_total",
+			Help:        "Retried panel calls.",
+			ConstLabels: opts.ConstLabels,
+		}, labels),
+	}
+}
+
+// ObserveRequest implements pkg.Metrics
+func (c *Collector) ObserveRequest(m pkg.RequestMetrics) {
+	nodeType := string(m.NodeType)
+	status := "none"
+	if m.StatusCode > 0 {
+		status = strconv.Itoa(m.StatusCode)
+	}
+	errorType := string(m.ErrorType)
+	if errorType == "" {
+		errorType = "none"
+	}
+	c.requests.WithLabelValues(m.Operation, nodeType, status, errorType).Inc()
+	c.duration.WithLabelValues(m.Operation, nodeType).Observe(m.Duration.Seconds())
+	if m.StatusCode > 0 {
+		c.responseSize.WithLabelValues(m.Operation, nodeType).Observe(float64(m.ResponseSize))
+	}
+	if m.Conditional {
+		result := "miss"
+		if m.ErrorType == pkg.ErrorTypeNotModified {
+			result = "hit"
+		}
+		c.etag.WithLabelValues(m.Operation, nodeType, result).Inc()
+	}
+}
+
+// ObserveRetry implements pkg.Metrics
+func (c *Collector) ObserveRetry(op string, nodeType pkg.NodeType) {
+	c.retries.WithLabelValues(op, string(nodeType)).Inc()
+}
+
+// Describe implements prometheus.Collector
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	c.requests.Describe(ch)
+	c.duration.Describe(ch)
+	c.responseSize.Describe(ch)
+	c.etag.Describe(ch)
+	c.retries.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.requests.Collect(ch)
+	c.duration.Collect(ch)
+	c.responseSize.Collect(ch)
+	c.etag.Collect(ch)
+	c.retries.Collect(ch)
+}
@@ -0,0 +1,72 @@
+package prommetrics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/xflash-panda/server-client/pkg"
+)
+
+func TestCollector(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte(`{"data":[]}`))
+	}))
+	t.Cleanup(server.Close)
+
+	collector := New(Options{})
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(collector)
+	client := pkg.New(&pkg.Config{APIHost: server.URL, Token: "test-token", Timeout: 5 * time.Second, Metrics: collector})
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		_, _ = client.RawUsers(ctx, "test-register-id", pkg.Trojan)
+	}
+
+	expected := `
+# HELP panel_client_requests_total Panel calls by operation, node type, HTTP status and error type.
+# TYPE panel_client_requests_total counter
+panel_client_requests_total{error_type="NotModified",node_type="trojan",operation="RawUsers",status="304"} 2
+panel_client_requests_total{error_type="none",node_type="trojan",operation="RawUsers",status="200"} 1
+# HELP panel_client_etag_requests_total Conditional panel calls by result, hit when the panel answered 304.
+# TYPE panel_client_etag_requests_total counter
+panel_client_etag_requests_total{node_type="trojan",operation="RawUsers",result="hit"} 2
+`
+	err := testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"panel_client_requests_total", "panel_client_etag_requests_total")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := testutil.CollectAndCount(collector, "panel_client_request_duration_seconds"); n != 1 {
+		t.Fatalf("Expected one duration series, got %d", n)
+	}
+}
+
+func TestCollectorRetries(t *testing.T) {
+	collector := New(Options{Namespace: "test"})
+	collector.ObserveRetry(pkg.OpHeartbeat, pkg.Trojan)
+	collector.ObserveRetry(pkg.OpHeartbeat, pkg.Trojan)
+	collector.ObserveRequest(pkg.RequestMetrics{Operation: pkg.OpHeartbeat, NodeType: pkg.Trojan, ErrorType: pkg.ErrorTypeNetworkError})
+
+	if got := testutil.ToFloat64(collector.retries.WithLabelValues(pkg.OpHeartbeat, "trojan")); got != 2 {
+		t.Fatalf("Expected 2 retries, got %v", got)
+	}
+	if got := testutil.ToFloat64(collector.requests.WithLabelValues(pkg.OpHeartbeat, "trojan", "none", "NetworkError")); got != 1 {
+		t.Fatalf("Expected a network error without status, got %v", got)
+	}
+	// no response, no size
+	if n := testutil.CollectAndCount(collector, "test_response_size_bytes"); n != 0 {
+		t.Fatalf("Expected no size observation, got %d", n)
+	}
+}
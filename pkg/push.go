@@ -0,0 +1,329 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	resty "github.com/go-resty/resty/v2"
+)
+
+// Event types of the push stream
+const (
+	EventUsers  = "users"
+	EventConfig = "config"
+)
+
+// maxPushLine longest line accepted from the push stream
+const maxPushLine = 1 << 20
+
+// errPushIdle cancels a push stream that stayed silent for IdleTimeout
+var errPushIdle = errors.New("push stream idle")
+
+// PushEvent a change notification received over the push stream
+type PushEvent struct {
+	// ID last event id the panel set, sent back as Last-Event-ID on reconnect
+	ID string
+	// Type EventUsers, EventConfig or a type the panel added, "message" when unset
+	Type string
+	Data []byte
+}
+
+// PushWatcherConfig node and callbacks of a PushWatcher, zero durations use the defaults.
+// Callbacks run on the goroutine of Run and must not block for long.
+type PushWatcherConfig struct {
+	RegisterId string
+	NodeId     NodeId
+	NodeType   NodeType
+	// PollInterval how often users and config are polled while the stream is down, defaults to 60s
+	PollInterval time.Duration
+	// IdleTimeout the stream is reconnected when nothing, keepalive comments
+	// included, arrives for this long, defaults to 90s
+	IdleTimeout time.Duration
+	// ReconnectDelay first delay before reconnecting the stream, doubled up to
+	// MaxReconnectDelay, defaults to 1s and 1m
+	ReconnectDelay    time.Duration
+	MaxReconnectDelay time.Duration
+
+	// OnUsers called with the changes of every user sync that changed something
+	OnUsers func(UserChanges)
+	// OnConfig called with the node config when it is first fetched and when it changes
+	OnConfig func(NodeConfig)
+	// OnEvent called with every event received, after users and config events were handled
+	OnEvent func(PushEvent)
+}
+
+func (c *PushWatcherConfig) withDefaults() PushWatcherConfig {
+	config := *c
+	config.PollInterval = cmp.Or(config.PollInterval, 60*time.Second)
+	config.IdleTimeout = cmp.Or(config.IdleTimeout, 90*time.Second)
+	config.ReconnectDelay = cmp.Or(config.ReconnectDelay, time.Second)
+	config.MaxReconnectDelay = cmp.Or(config.MaxReconnectDelay, time.Minute)
+	return config
+}
+
+// PushWatcher keeps the users and config of a node up to date through the
+// Server-Sent Events stream of the panel. Every connect syncs once to catch
+// the changes made while it was down. While the stream is down it is
+// reconnected with backoff and users and config are polled, the users
+// through SyncUsers, which fetches only the changes when the panel serves
+// the delta route.
+type PushWatcher struct {
+	client    *Client
+	config    PushWatcherConfig
+	users     *UserSet
+	connected atomic.Bool
+
+	// used by the goroutine of Run only
+	nodeConfig  NodeConfig
+	lastEventId string
+	lastPoll    time.Time
+}
+
+// NewPushWatcher create a watcher, Run starts it
+func NewPushWatcher(client *Client, config PushWatcherConfig) *PushWatcher {
+	return &PushWatcher{client: client, config: config.withDefaults(), users: NewUserSet()}
+}
+
+// Users the user set kept in sync
+func (w *PushWatcher) Users() *UserSet {
+	return w.users
+}
+
+// Connected report whether the push stream is up
+func (w *PushWatcher) Connected() bool {
+	return w.connected.Load()
+}
+
+// Run keep the node in sync until ctx is done or the registration is no
+// longer valid. ErrRegisterExpired, ErrNodeNotFound and ErrUnauthorized are
+// returned so the caller can register again, other failures are logged and retried.
+func (w *PushWatcher) Run(ctx context.Context) error {
+	delay := w.config.ReconnectDelay
+	for {
+		connectedAt, err := w.stream(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if registrationInvalid(err) {
+			return err
+		}
+		// a stream that stayed up for a while reconnects with the shortest delay
+		if !connectedAt.IsZero() && time.Since(connectedAt) > w.config.MaxReconnectDelay {
+			delay = w.config.ReconnectDelay
+		}
+		w.client.logger.WarnContext(ctx, "push stream down, polling",
+			"node_id", int(w.config.NodeId), "node_type", string(w.config.NodeType), "error", err, "retry_in", delay)
+		if err := w.pollUntil(ctx, time.Now().Add(delay)); err != nil {
+			return err
+		}
+		delay = min(delay*2, w.config.MaxReconnectDelay)
+	}
+}
+
+// stream connect and handle events until the stream ends. It returns when
+// the stream was connected, zero when the connection failed.
+func (w *PushWatcher) stream(ctx context.Context) (time.Time, error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	body, url, err := w.client.openEvents(ctx, w.config.RegisterId, w.config.NodeType, w.lastEventId)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer body.Close()
+	connectedAt := time.Now()
+	w.connected.Store(true)
+	defer w.connected.Store(false)
+
+	if err := w.sync(ctx); registrationInvalid(err) {
+		return connectedAt, err
+	} else if err != nil {
+		w.client.logger.WarnContext(ctx, "push stream sync failed",
+			"node_id", int(w.config.NodeId), "node_type", string(w.config.NodeType), "error", err)
+	}
+	idle := time.AfterFunc(w.config.IdleTimeout, func() { cancel(errPushIdle) })
+	defer idle.Stop()
+	err = readEvents(body, func() { idle.Reset(w.config.IdleTimeout) }, func(event PushEvent) error {
+		return w.handle(ctx, event)
+	})
+	if registrationInvalid(err) {
+		return connectedAt, err
+	}
+	if cause := context.Cause(ctx); cause == errPushIdle {
+		err = cause
+	}
+	if err == nil {
+		err = io.EOF
+	}
+	return connectedAt, NewNetworkError("push stream closed", url, err)
+}
+
+// handle an event, only errors invalidating the registration end the stream
+func (w *PushWatcher) handle(ctx context.Context, event PushEvent) error {
+	w.lastEventId = event.ID
+	var err error
+	switch event.Type {
+	case EventUsers:
+		err = w.syncUsers(ctx)
+	case EventConfig:
+		err = w.syncConfig(ctx)
+	}
+	if registrationInvalid(err) {
+		return err
+	}
+	if err != nil {
+		w.client.logger.WarnContext(ctx, "push event sync failed",
+			"node_id", int(w.config.NodeId), "node_type", string(w.config.NodeType), "event", event.Type, "error", err)
+	}
+	if w.config.OnEvent != nil {
+		w.config.OnEvent(event)
+	}
+	return nil
+}
+
+// pollUntil poll every PollInterval until deadline
+func (w *PushWatcher) pollUntil(ctx context.Context, deadline time.Time) error {
+	for {
+		if time.Since(w.lastPoll) >= w.config.PollInterval {
+			if err := w.sync(ctx); registrationInvalid(err) {
+				return err
+			} else if err != nil && ctx.Err() == nil {
+				w.client.logger.WarnContext(ctx, "push fallback poll failed",
+					"node_id", int(w.config.NodeId), "node_type", string(w.config.NodeType), "error", err)
+			}
+		}
+		wake := w.lastPoll.Add(w.config.PollInterval)
+		if !wake.Before(deadline) {
+			wake = deadline
+		}
+		if !sleepContext(ctx, time.Until(wake)) {
+			return ctx.Err()
+		}
+		if !time.Now().Before(deadline) {
+			return nil
+		}
+	}
+}
+
+// sync users and config, it counts as a poll
+func (w *PushWatcher) sync(ctx context.Context) error {
+	w.lastPoll = time.Now()
+	usersErr := w.syncUsers(ctx)
+	if registrationInvalid(usersErr) {
+		return usersErr
+	}
+	return errors.Join(usersErr, w.syncConfig(ctx))
+}
+
+func (w *PushWatcher) syncUsers(ctx context.Context) error {
+	changes, err := w.client.SyncUsers(ctx, w.config.RegisterId, w.config.NodeType, w.users)
+	if err != nil {
+		return err
+	}
+	if !changes.Empty() && w.config.OnUsers != nil {
+		w.config.OnUsers(changes)
+	}
+	return nil
+}
+
+func (w *PushWatcher) syncConfig(ctx context.Context) error {
+	config, err := w.client.Config(ctx, w.config.NodeId, w.config.NodeType)
+	if err != nil {
+		return err
+	}
+	if reflect.DeepEqual(config, w.nodeConfig) {
+		return nil
+	}
+	if w.config.OnConfig != nil {
+		w.config.OnConfig(config)
+	}
+	w.nodeConfig = config
+	return nil
+}
+
+// registrationInvalid report whether err means the node has to register again
+func registrationInvalid(err error) bool {
+	return errors.Is(err, ErrRegisterExpired) || errors.Is(err, ErrNodeNotFound) || errors.Is(err, ErrUnauthorized)
+}
+
+// openEvents open the Server-Sent Events stream of registerId. The client
+// timeout only covers the response headers, the caller closes the returned body.
+func (c *Client) openEvents(ctx context.Context, registerId string, nodeType NodeType, lastEventId string) (io.ReadCloser, string, error) {
+	path := fmt.Sprintf("/api/v1/server/enhanced/%s/events", nodeType)
+	op := operation{name: OpEvents, nodeType: nodeType, registerId: registerId, stream: true, longLived: true}
+	res, url, err := c.execute(ctx, op, resty.MethodGet, path, func(r *resty.Request) {
+		r.SetQueryParam("register_id", registerId).
+			SetHeader("Accept", "text/event-stream").
+			SetHeader("Cache-Control", "no-cache").
+			// a compressed stream would be buffered by the panel
+			SetHeader("Accept-Encoding", "identity")
+		if lastEventId != "" {
+			r.SetHeader("Last-Event-ID", lastEventId)
+		}
+	})
+	if err != nil {
+		return nil, url, requestError(url, err)
+	}
+	if res.StatusCode() >= 400 {
+		return nil, url, NewAPIErrorFromResponse(res.StatusCode(), res.Body(), url)
+	}
+
+	body := res.RawBody()
+	if mediaType, _, _ := mime.ParseMediaType(res.Header().Get("Content-Type")); mediaType != "text/event-stream" || res.StatusCode() != 200 {
+		body.Close()
+		return nil, url, NewParseError("parse response failed",
+			fmt.Errorf("expected an event stream, got status %d with content type %q", res.StatusCode(), res.Header().Get("Content-Type")))
+	}
+	return body, url, nil
+}
+
+// readEvents parse Server-Sent Events from r until it ends or dispatch fails.
+// activity is called for every line, keepalive comments included. The retry
+// field is ignored, reconnects follow the backoff of the watcher.
+func readEvents(r io.Reader, activity func(), dispatch func(PushEvent) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), maxPushLine)
+	var (
+		lastId    string
+		eventType string
+		data      []byte
+	)
+	for scanner.Scan() {
+		activity()
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			if data != nil {
+				event := PushEvent{ID: lastId, Type: cmp.Or(eventType, "message"), Data: bytes.TrimSuffix(data, []byte("\n"))}
+				if err := dispatch(event); err != nil {
+					return err
+				}
+			}
+			eventType, data = "", nil
+			continue
+		}
+		if line[0] == ':' {
+			continue
+		}
+		field, value, _ := bytes.Cut(line, []byte(":"))
+		value = bytes.TrimPrefix(value, []byte(" "))
+		switch string(field) {
+		case "event":
+			eventType = string(value)
+		case "data":
+			data = append(append(data, value...), '\n')
+		case "id":
+			if bytes.IndexByte(value, 0) < 0 {
+				lastId = string(value)
+			}
+		}
+	}
+	return scanner.Err()
+}
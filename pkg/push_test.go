@@ -0,0 +1,362 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pushPanel mock panel with a controllable event stream. The users have no
+// delta endpoint, so they are synced with the full list and its ETag.
+type pushPanel struct {
+	mu      sync.Mutex
+	users   []string
+	port    int
+	expired bool
+	// noEvents answer 404 for the event stream
+	noEvents bool
+	// silent keep the stream open without sending anything
+	silent       bool
+	lastEventIds []string
+
+	connects    atomic.Int32
+	notModified atomic.Int32
+	events      chan string
+	closeStream chan struct{}
+}
+
+func newPushPanel() *pushPanel {
+	return &pushPanel{
+		users:       []string{"a", "b"},
+		port:        443,
+		events:      make(chan string),
+		closeStream: make(chan struct{}),
+	}
+}
+
+func (p *pushPanel) with(fn func(p *pushPanel)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fn(p)
+}
+
+func (p *pushPanel) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/v1/server/enhanced/trojan/")
+	if path == "events" {
+		p.serveEvents(w, r)
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case p.expired:
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"message":"register expired","code":"register_expired"}`))
+	case path == "users":
+		etag := fmt.Sprintf(`"%d"`, len(p.users))
+		if r.Header.Get("If-None-Match") == etag {
+			p.notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		users := make([]string, len(p.users))
+		for i, uuid := range p.users {
+			users[i] = fmt.Sprintf(`{"id":%d,"uuid":%q}`, i+1, uuid)
+		}
+		w.Header().Set("ETag", etag)
+		_, _ = fmt.Fprintf(w, `{"data":[%s]}`, strings.Join(users, ","))
+	case path == "config":
+		_, _ = fmt.Fprintf(w, `{"data":{"id":1,"server_port":%d}}`, p.port)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (p *pushPanel) serveEvents(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	noEvents, silent := p.noEvents, p.silent
+	p.lastEventIds = append(p.lastEventIds, r.Header.Get("Last-Event-ID"))
+	p.mu.Unlock()
+	if noEvents {
+		http.NotFound(w, r)
+		return
+	}
+	p.connects.Add(1)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	if silent {
+		<-r.Context().Done()
+		return
+	}
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-p.closeStream:
+			return
+		case event := <-p.events:
+			_, _ = w.Write([]byte(event))
+			w.(http.Flusher).Flush()
+		}
+	}
+}
+
+// send an event, waiting for a connected stream
+func (p *pushPanel) send(t *testing.T, event string) {
+	t.Helper()
+	select {
+	case p.events <- event:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out sending %q", event)
+	}
+}
+
+func fastPushConfig() PushWatcherConfig {
+	return PushWatcherConfig{
+		RegisterId:        "r1",
+		NodeId:            1,
+		NodeType:          Trojan,
+		PollInterval:      20 * time.Millisecond,
+		ReconnectDelay:    5 * time.Millisecond,
+		MaxReconnectDelay: 20 * time.Millisecond,
+	}
+}
+
+func TestPushWatcher(t *testing.T) {
+	panel := newPushPanel()
+	server := httptest.NewServer(panel)
+	t.Cleanup(server.Close)
+
+	var (
+		mu      sync.Mutex
+		added   []User
+		ports   []int
+		events  []PushEvent
+		handled = make(chan struct{}, 10)
+	)
+	config := fastPushConfig()
+	config.OnUsers = func(changes UserChanges) {
+		mu.Lock()
+		defer mu.Unlock()
+		added = append(added, changes.Added...)
+	}
+	config.OnConfig = func(c NodeConfig) {
+		mu.Lock()
+		defer mu.Unlock()
+		ports = append(ports, c.(*TrojanConfig).ServerPort)
+	}
+	config.OnEvent = func(event PushEvent) {
+		mu.Lock()
+		events = append(events, event)
+		mu.Unlock()
+		handled <- struct{}{}
+	}
+	watcher := NewPushWatcher(newTestClient(t, server.URL), config)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- watcher.Run(ctx) }()
+
+	waitFor(t, "the stream and the first sync", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return watcher.Connected() && watcher.Users().Len() == 2 && len(ports) == 1
+	})
+	panel.with(func(p *pushPanel) {
+		p.users = append(p.users, "c")
+		p.port = 8443
+	})
+	panel.send(t, "event: users\nid: 7\ndata: {}\n\n")
+	<-handled
+	panel.send(t, ": keepalive\n\nevent: config\ndata: {}\n\n")
+	<-handled
+
+	mu.Lock()
+	gotAdded, gotPorts, gotEvents := added, ports, events
+	mu.Unlock()
+	if len(gotAdded) != 3 || gotAdded[2].UUID != "c" {
+		t.Fatalf("Expected the new user pushed, got %+v", gotAdded)
+	}
+	if !slices.Equal(gotPorts, []int{443, 8443}) {
+		t.Fatalf("Expected the initial and the pushed config, got %v", gotPorts)
+	}
+	if len(gotEvents) != 2 || gotEvents[0].ID != "7" || gotEvents[1].ID != "7" || gotEvents[1].Type != EventConfig {
+		t.Fatalf("Unexpected events %+v", gotEvents)
+	}
+
+	// the panel ends the stream, the watcher resumes from the last event
+	panel.closeStream <- struct{}{}
+	waitFor(t, "the stream to reconnect", func() bool {
+		return panel.connects.Load() == 2 && watcher.Connected()
+	})
+	panel.with(func(p *pushPanel) {
+		if !slices.Equal(p.lastEventIds, []string{"", "7"}) {
+			t.Fatalf("Expected Last-Event-ID sent on reconnect, got %q", p.lastEventIds)
+		}
+	})
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected Run to stop with the context, got %v", err)
+	}
+	if watcher.Connected() {
+		t.Fatalf("Expected the stream closed")
+	}
+}
+
+func TestPushWatcherFallback(t *testing.T) {
+	panel := newPushPanel()
+	panel.noEvents = true
+	server := httptest.NewServer(panel)
+	t.Cleanup(server.Close)
+
+	watcher := NewPushWatcher(newTestClient(t, server.URL), fastPushConfig())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = watcher.Run(ctx) }()
+
+	waitFor(t, "the first poll", func() bool { return watcher.Users().Len() == 2 })
+	waitFor(t, "a poll answered by the ETag", func() bool { return panel.notModified.Load() > 0 })
+	panel.with(func(p *pushPanel) { p.users = append(p.users, "c") })
+	waitFor(t, "the new user polled", func() bool { return watcher.Users().Len() == 3 })
+	if watcher.Connected() {
+		t.Fatalf("Expected no stream")
+	}
+
+	// the stream comes back
+	panel.with(func(p *pushPanel) { p.noEvents = false })
+	waitFor(t, "the stream to connect", func() bool { return watcher.Connected() })
+}
+
+func TestPushWatcherIdle(t *testing.T) {
+	panel := newPushPanel()
+	panel.silent = true
+	server := httptest.NewServer(panel)
+	t.Cleanup(server.Close)
+
+	config := fastPushConfig()
+	config.IdleTimeout = 30 * time.Millisecond
+	watcher := NewPushWatcher(newTestClient(t, server.URL), config)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = watcher.Run(ctx) }()
+
+	waitFor(t, "a silent stream to be replaced", func() bool { return panel.connects.Load() >= 2 })
+}
+
+func TestPushWatcherOutlivesTimeout(t *testing.T) {
+	panel := newPushPanel()
+	server := httptest.NewServer(panel)
+	t.Cleanup(server.Close)
+
+	client := newTestClientWith(t, server.URL, Config{Timeout: 50 * time.Millisecond})
+	received := make(chan PushEvent, 1)
+	config := fastPushConfig()
+	config.OnEvent = func(event PushEvent) { received <- event }
+	watcher := NewPushWatcher(client, config)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = watcher.Run(ctx) }()
+
+	waitFor(t, "the stream", watcher.Connected)
+	time.Sleep(150 * time.Millisecond)
+	panel.send(t, "data: late\n\n")
+	if event := <-received; string(event.Data) != "late" || panel.connects.Load() != 1 {
+		t.Fatalf("Expected the stream to outlive the request timeout, got %+v after %d connects", event, panel.connects.Load())
+	}
+}
+
+func TestPushWatcherRegisterExpired(t *testing.T) {
+	panel := newPushPanel()
+	server := httptest.NewServer(panel)
+	t.Cleanup(server.Close)
+
+	watcher := NewPushWatcher(newTestClient(t, server.URL), fastPushConfig())
+	done := make(chan error, 1)
+	go func() { done <- watcher.Run(context.Background()) }()
+
+	waitFor(t, "the first sync", func() bool { return watcher.Users().Len() == 2 })
+	panel.with(func(p *pushPanel) { p.expired = true })
+	panel.send(t, "event: users\ndata: {}\n\n")
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrRegisterExpired) {
+			t.Fatalf("Expected ErrRegisterExpired, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected Run to stop")
+	}
+}
+
+func TestPushWatcherContentType(t *testing.T) {
+	server := newTestServer(t, http.StatusOK, map[string]any{"data": true})
+	client := newTestClient(t, server.URL)
+	_, _, err := client.openEvents(context.Background(), "r1", Trojan, "")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || !apiErr.IsParseError() {
+		t.Fatalf("Expected a parse error for a JSON response, got %v", err)
+	}
+}
+
+func TestReadEvents(t *testing.T) {
+	stream := strings.Join([]string{
+		": comment",
+		"retry: 1000",
+		"id: 1",
+		"event: users",
+		"data: {\"a\":",
+		"data:1}",
+		"",
+		"data: plain\r",
+		"\r",
+		"id: 2",
+		"",
+		"event: config",
+		"data",
+		"",
+		"data: unterminated",
+	}, "\n")
+	var (
+		events []PushEvent
+		lines  int
+	)
+	err := readEvents(strings.NewReader(stream), func() { lines++ }, func(event PushEvent) error {
+		events = append(events, event)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("readEvents() unexpected error: %v", err)
+	}
+	want := []PushEvent{
+		{ID: "1", Type: EventUsers, Data: []byte("{\"a\":\n1}")},
+		{ID: "1", Type: "message", Data: []byte("plain")},
+		{ID: "2", Type: EventConfig, Data: []byte{}},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("Expected %d events, got %+v", len(want), events)
+	}
+	for i := range want {
+		if events[i].ID != want[i].ID || events[i].Type != want[i].Type || string(events[i].Data) != string(want[i].Data) {
+			t.Fatalf("Event %d = %+v, want %+v", i, events[i], want[i])
+		}
+	}
+	if lines != 15 {
+		t.Fatalf("Expected activity for every line, got %d", lines)
+	}
+
+	stop := errors.New("stop")
+	err = readEvents(strings.NewReader("data: 1\n\ndata: 2\n\n"), func() {}, func(PushEvent) error { return stop })
+	if err != stop {
+		t.Fatalf("Expected the dispatch error returned, got %v", err)
+	}
+}
@@ -0,0 +1,200 @@
+package pkg
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Endpoint groups operations that share a rate limit budget
+type Endpoint string
+
+const (
+	EndpointUsers     Endpoint = "users"     // RawUsers, RawUsersByNodeId, UsersIter, SyncUsers, UsersBatch, the push stream and the helpers built on them
+	EndpointConfig    Endpoint = "config"    // RawConfig, Config, AuditRules, NodeCert
+	EndpointSubmit    Endpoint = "submit"    // Submit, SubmitWithAgent, SubmitStatsWithAgent, SubmitOnlineUsers, SubmitViolations
+	EndpointHeartbeat Endpoint = "heartbeat" // Heartbeat, HeartbeatBatch, SubmitNodeStatus
+	EndpointRegister  Endpoint = "register"  // Register, Unregister, Verify
+)
+
+// operationEndpoints map operation names to their rate limit endpoint
+var operationEndpoints = map[string]Endpoint{
+	OpRawUsers:             EndpointUsers,
+	OpRawUsersByNodeId:     EndpointUsers,
+	OpUsersIter:            EndpointUsers,
+	OpUsersDelta:           EndpointUsers,
+	OpUsersBatch:           EndpointUsers,
+	OpEvents:               EndpointUsers,
+	OpRawConfig:            EndpointConfig,
+	OpConfig:               EndpointConfig,
+	OpAuditRules:           EndpointConfig,
+	OpNodeCert:             EndpointConfig,
+	OpSubmit:               EndpointSubmit,
+	OpSubmitWithAgent:      EndpointSubmit,
+	OpSubmitStatsWithAgent: EndpointSubmit,
+	OpSubmitOnlineUsers:    EndpointSubmit,
+	OpSubmitViolations:     EndpointSubmit,
+	OpHeartbeat:            EndpointHeartbeat,
+	OpSubmitNodeStatus:     EndpointHeartbeat,
+	OpHeartbeatBatch:       EndpointHeartbeat,
+	OpRegister:             EndpointRegister,
+	OpUnregister:           EndpointRegister,
+	OpVerify:               EndpointRegister,
+}
+
+// RateLimit token bucket budget
+type RateLimit struct {
+	// Rate tokens added per second
+	Rate float64
+	// Burst bucket size, at least 1
+	Burst int
+}
+
+// RateLimitConfig client-side rate limiting.
+// A request waits for a token when its context allows it and fails fast with
+// ErrorTypeRateLimited when the wait would exceed the context deadline.
+type RateLimitConfig struct {
+	// Endpoints budget of each endpoint for this client
+	Endpoints map[Endpoint]RateLimit
+	// Global ceiling over all requests, share it between clients to cap a whole process
+	Global *RateLimiter
+}
+
+// rateLimiters limiters of a Client
+type rateLimiters struct {
+	endpoints map[Endpoint]*RateLimiter
+	global    *RateLimiter
+}
+
+func newRateLimiters(config *RateLimitConfig) *rateLimiters {
+	if config == nil {
+		return nil
+	}
+	l := &rateLimiters{
+		endpoints: make(map[Endpoint]*RateLimiter, len(config.Endpoints)),
+		global:    config.Global,
+	}
+	for endpoint, limit := range config.Endpoints {
+		l.endpoints[endpoint] = NewRateLimiter(limit.Rate, limit.Burst)
+	}
+	return l
+}
+
+// wait block until op may send a request, it returns false when the context
+// deadline does not leave enough time or the context is done
+func (l *rateLimiters) wait(ctx context.Context, op string) bool {
+	endpoint := l.endpoints[operationEndpoints[op]]
+	if !endpoint.Wait(ctx) {
+		return false
+	}
+	if !l.global.Wait(ctx) {
+		endpoint.release()
+		return false
+	}
+	return true
+}
+
+// RateLimiter token bucket limiter, safe for concurrent use. A nil limiter never limits.
+type RateLimiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter create a limiter adding rate tokens per second up to burst.
+// It returns nil, meaning unlimited, when rate is not positive.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	burst = max(burst, 1)
+	return &RateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		now:    time.Now,
+		tokens: float64(burst),
+	}
+}
+
+// Allow take a token if one is available now
+func (l *RateLimiter) Allow() bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(l.now())
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// Wait take a token, blocking until one is available. It returns false without
+// waiting when the token would only be available after the context deadline,
+// and false when the context is done while waiting.
+func (l *RateLimiter) Wait(ctx context.Context) bool {
+	if l == nil {
+		return true
+	}
+	wait, ok := l.reserve(ctx)
+	if !ok {
+		return false
+	}
+	if wait <= 0 {
+		return true
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		l.release()
+		return false
+	}
+}
+
+// reserve take a token ahead of time and return how long to wait for it
+func (l *RateLimiter) reserve(ctx context.Context) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.refill(now)
+
+	var wait time.Duration
+	if l.tokens < 1 {
+		wait = time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+	}
+	if deadline, ok := ctx.Deadline(); ok && now.Add(wait).After(deadline) {
+		return 0, false
+	}
+	l.tokens--
+	return wait, true
+}
+
+// release return a token that was reserved but not used
+func (l *RateLimiter) release() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens = min(l.tokens+1, l.burst)
+}
+
+// refill add the tokens earned since the last call, l.mu must be held
+func (l *RateLimiter) refill(now time.Time) {
+	if !l.last.IsZero() {
+		elapsed := now.Sub(l.last).Seconds()
+		if elapsed > 0 {
+			l.tokens = min(l.tokens+elapsed*l.rate, l.burst)
+		}
+	}
+	l.last = now
+}
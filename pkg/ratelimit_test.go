@@ -0,0 +1,164 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	l := NewRateLimiter(2, 3)
+	l.now = clock.Now
+
+	for i := 0; i < 3; i++ {
+		if !l.Allow() {
+			t.Fatalf("Expected burst token %d to be allowed", i)
+		}
+	}
+	if l.Allow() {
+		t.Fatal("Expected empty bucket to reject")
+	}
+
+	clock.Advance(500 * time.Millisecond)
+	if !l.Allow() {
+		t.Fatal("Expected a token after refill")
+	}
+	if l.Allow() {
+		t.Fatal("Expected a single token after half a second at rate 2")
+	}
+
+	// the bucket never holds more than burst tokens
+	clock.Advance(time.Hour)
+	allowed := 0
+	for l.Allow() {
+		allowed++
+	}
+	if allowed != 3 {
+		t.Fatalf("Expected 3 tokens after a long pause, got %d", allowed)
+	}
+}
+
+func TestRateLimiterNil(t *testing.T) {
+	l := NewRateLimiter(0, 10)
+	if l != nil {
+		t.Fatal("Expected nil limiter for a non-positive rate")
+	}
+	if !l.Allow() || !l.Wait(context.Background()) {
+		t.Fatal("Expected nil limiter never to limit")
+	}
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	l := NewRateLimiter(20, 1)
+	ctx := context.Background()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if !l.Wait(ctx) {
+			t.Fatal("Expected Wait to succeed without deadline")
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Fatalf("Expected Wait to block for about 100ms, took %v", elapsed)
+	}
+}
+
+func TestRateLimiterWaitDeadline(t *testing.T) {
+	l := NewRateLimiter(1, 1)
+	if !l.Allow() {
+		t.Fatal("Expected first token")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if l.Wait(ctx) {
+		t.Fatal("Expected Wait to fail when the token comes after the deadline")
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Fatalf("Expected Wait to fail fast, took %v", elapsed)
+	}
+}
+
+func TestRateLimiterCancelReleasesToken(t *testing.T) {
+	l := NewRateLimiter(10, 1)
+	if !l.Allow() {
+		t.Fatal("Expected first token")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	if l.Wait(ctx) {
+		t.Fatal("Expected Wait to fail after cancel")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if !l.Allow() {
+		t.Fatal("Expected the canceled reservation to be returned")
+	}
+}
+
+func TestClientRateLimit(t *testing.T) {
+	var hits atomic.Int32
+	server := newFlakyServer(t, 0, 200, nil, &hits)
+	client := newTestClientWith(t, server.URL, Config{
+		RateLimit: &RateLimitConfig{
+			Endpoints: map[Endpoint]RateLimit{
+				EndpointHeartbeat: {Rate: 1, Burst: 1},
+			},
+		},
+	})
+
+	if err := heartbeatCall(client); err != nil {
+		t.Fatalf("Heartbeat() unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := client.Heartbeat(ctx, "test-register-id", Trojan, "")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || !apiErr.IsRateLimited() {
+		t.Fatalf("Expected rate limited error, got %v", err)
+	}
+	if hits.Load() != 1 {
+		t.Fatalf("Expected the limited request not to reach the panel, got %d requests", hits.Load())
+	}
+
+	// other endpoints have their own budget
+	if _, err := client.Verify(context.Background(), "test-register-id", Trojan); err != nil {
+		t.Fatalf("Verify() unexpected error: %v", err)
+	}
+}
+
+func TestClientGlobalRateLimit(t *testing.T) {
+	var hits atomic.Int32
+	server := newFlakyServer(t, 0, 200, nil, &hits)
+	global := NewRateLimiter(1, 2)
+	newClient := func() *Client {
+		return newTestClientWith(t, server.URL, Config{
+			RateLimit: &RateLimitConfig{Global: global},
+		})
+	}
+	client1, client2 := newClient(), newClient()
+
+	if err := heartbeatCall(client1); err != nil {
+		t.Fatalf("Heartbeat() unexpected error: %v", err)
+	}
+	if err := heartbeatCall(client2); err != nil {
+		t.Fatalf("Heartbeat() unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := client1.Heartbeat(ctx, "test-register-id", Trojan, "")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || !apiErr.IsRateLimited() {
+		t.Fatalf("Expected rate limited error from the shared ceiling, got %v", err)
+	}
+}
@@ -0,0 +1,164 @@
+package pkg
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	resty "github.com/go-resty/resty/v2"
+)
+
+// DefaultRetryPolicy is used when Config.Retry is nil
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:      4,
+	BaseDelay:        100 * time.Millisecond,
+	MaxDelay:         2 * time.Second,
+	Jitter:           0.5,
+	MaxRetryAfter:    30 * time.Second,
+	RetryOn:          []ErrorType{ErrorTypeNetworkError},
+	RetryStatusCodes: []int{http.StatusTooManyRequests, http.StatusServiceUnavailable},
+}
+
+// nonIdempotentOps repeat side effects on the panel when retried, so they are
+// only retried when RetryPolicy.Methods has an entry for them
+var nonIdempotentOps = map[string]bool{
+	OpRegister:             true,
+	OpSubmit:               true,
+	OpSubmitStatsWithAgent: true,
+	OpSubmitViolations:     true,
+}
+
+// RetryPolicy controls how failed requests are retried.
+// Zero fields take their value from DefaultRetryPolicy.
+type RetryPolicy struct {
+	// MaxAttempts total attempts including the first one, 1 disables retries
+	MaxAttempts int
+	// BaseDelay delay before the first retry, doubled on every attempt
+	BaseDelay time.Duration
+	// MaxDelay upper bound of the backoff delay
+	MaxDelay time.Duration
+	// Jitter fraction of the delay that is randomized, between 0 and 1; negative disables it
+	Jitter float64
+	// RetryOn error types that are retried, an empty non-nil slice retries none
+	RetryOn []ErrorType
+	// RetryStatusCodes status codes that are retried regardless of RetryOn.
+	// The Retry-After header is honored for 429 and 503.
+	RetryStatusCodes []int
+	// MaxRetryAfter longest Retry-After that is waited for, the error is
+	// returned when the panel asks for more
+	MaxRetryAfter time.Duration
+	// Methods per-operation overrides keyed by operation name, e.g. OpRegister.
+	// Zero fields of an override take their value from the enclosing policy.
+	Methods map[string]RetryPolicy
+}
+
+// withDefaults return a copy of the policy with zero fields filled from DefaultRetryPolicy
+func (p *RetryPolicy) withDefaults() *RetryPolicy {
+	if p == nil {
+		policy := DefaultRetryPolicy
+		return &policy
+	}
+	policy := p.inherit(DefaultRetryPolicy)
+	return &policy
+}
+
+// inherit fill the zero fields of p from parent
+func (p RetryPolicy) inherit(parent RetryPolicy) RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = parent.MaxAttempts
+	}
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = parent.BaseDelay
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = parent.MaxDelay
+	}
+	if p.Jitter == 0 {
+		p.Jitter = parent.Jitter
+	}
+	if p.MaxRetryAfter <= 0 {
+		p.MaxRetryAfter = parent.MaxRetryAfter
+	}
+	if p.RetryOn == nil {
+		p.RetryOn = parent.RetryOn
+	}
+	if p.RetryStatusCodes == nil {
+		p.RetryStatusCodes = parent.RetryStatusCodes
+	}
+	return p
+}
+
+// forOperation return the policy that applies to op
+func (p *RetryPolicy) forOperation(op string) RetryPolicy {
+	if override, ok := p.Methods[op]; ok {
+		return override.inherit(*p)
+	}
+	if nonIdempotentOps[op] {
+		return RetryPolicy{MaxAttempts: 1}
+	}
+	return *p
+}
+
+// shouldRetry report whether the result of an attempt is retryable
+func (p RetryPolicy) shouldRetry(res *resty.Response, err error) bool {
+	if err != nil {
+		var apiErr *APIError
+		if errors.As(err, &apiErr) {
+			return slices.Contains(p.RetryOn, apiErr.Type)
+		}
+		return slices.Contains(p.RetryOn, ErrorTypeNetworkError)
+	}
+	status := res.StatusCode()
+	if slices.Contains(p.RetryStatusCodes, status) {
+		return true
+	}
+	return status >= 400 && slices.Contains(p.RetryOn, getErrorTypeFromStatusCode(status))
+}
+
+// backoff return the delay before the next attempt, attempt starts at 1.
+// It reports false when Retry-After asks for longer than MaxRetryAfter.
+func (p RetryPolicy) backoff(attempt int, res *resty.Response) (time.Duration, bool) {
+	delay := p.MaxDelay
+	if shift := attempt - 1; shift < 32 {
+		delay = p.BaseDelay << shift
+	}
+	if delay <= 0 || delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if p.Jitter > 0 {
+		jitter := min(p.Jitter, 1)
+		delay -= time.Duration(float64(delay) * jitter * rand.Float64())
+	}
+	if res != nil {
+		switch res.StatusCode() {
+		case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+			if retryAfter, ok := parseRetryAfter(res.Header().Get("Retry-After")); ok && retryAfter > delay {
+				if retryAfter > p.MaxRetryAfter {
+					return 0, false
+				}
+				delay = retryAfter
+			}
+		}
+	}
+	return delay, true
+}
+
+// parseRetryAfter parse a Retry-After header given in seconds or as an HTTP date
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(time.Until(at), 0), true
+	}
+	return 0, false
+}
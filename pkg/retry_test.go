@@ -0,0 +1,291 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newFlakyServer fails the first failures requests with statusCode and counts all requests
+func newFlakyServer(t *testing.T, failures int32, statusCode int, header http.Header, hits *atomic.Int32) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := hits.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		if n <= failures {
+			for k, v := range header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(statusCode)
+			_, _ = w.Write([]byte(`{"message":"try again"}`))
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/register") {
+			_, _ = w.Write([]byte(`{"data":{"register_id":"test-register-id"},"message":"success"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"data":true,"message":"success"}`))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestRetryPolicy(t *testing.T) {
+	fast := RetryPolicy{BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+
+	tests := []struct {
+		name       string
+		policy     *RetryPolicy
+		failures   int32
+		statusCode int
+		call       func(c *Client) error
+		wantHits   int32
+		wantErr    bool
+	}{
+		{
+			name:       "503 is retried by default",
+			policy:     &fast,
+			failures:   2,
+			statusCode: 503,
+			call:       heartbeatCall,
+			wantHits:   3,
+		},
+		{
+			name:       "500 is not retried by default",
+			policy:     &fast,
+			failures:   1,
+			statusCode: 500,
+			call:       heartbeatCall,
+			wantHits:   1,
+			wantErr:    true,
+		},
+		{
+			name: "server errors retried when configured",
+			policy: &RetryPolicy{
+				BaseDelay: time.Millisecond,
+				RetryOn:   []ErrorType{ErrorTypeServerError},
+			},
+			failures:   2,
+			statusCode: 500,
+			call:       heartbeatCall,
+			wantHits:   3,
+		},
+		{
+			name: "status code retried when configured",
+			policy: &RetryPolicy{
+				BaseDelay:        time.Millisecond,
+				RetryStatusCodes: []int{502},
+			},
+			failures:   1,
+			statusCode: 502,
+			call:       heartbeatCall,
+			wantHits:   2,
+		},
+		{
+			name:       "attempts are bounded",
+			policy:     &RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond},
+			failures:   5,
+			statusCode: 503,
+			call:       heartbeatCall,
+			wantHits:   2,
+			wantErr:    true,
+		},
+		{
+			name:       "retries disabled",
+			policy:     &RetryPolicy{MaxAttempts: 1},
+			failures:   1,
+			statusCode: 503,
+			call:       heartbeatCall,
+			wantHits:   1,
+			wantErr:    true,
+		},
+		{
+			name:       "register is never retried by default",
+			policy:     &fast,
+			failures:   1,
+			statusCode: 503,
+			call:       registerCall,
+			wantHits:   1,
+			wantErr:    true,
+		},
+		{
+			name: "register retried with method override",
+			policy: &RetryPolicy{
+				BaseDelay: time.Millisecond,
+				Methods:   map[string]RetryPolicy{OpRegister: {MaxAttempts: 3}},
+			},
+			failures:   2,
+			statusCode: 503,
+			call:       registerCall,
+			wantHits:   3,
+		},
+		{
+			name: "method override disables retries",
+			policy: &RetryPolicy{
+				BaseDelay: time.Millisecond,
+				Methods:   map[string]RetryPolicy{OpHeartbeat: {MaxAttempts: 1}},
+			},
+			failures:   1,
+			statusCode: 503,
+			call:       heartbeatCall,
+			wantHits:   1,
+			wantErr:    true,
+		},
+		{
+			name:       "submit is never retried by default",
+			policy:     &fast,
+			failures:   1,
+			statusCode: 503,
+			call: func(c *Client) error {
+				return c.Submit(context.Background(), "test-register-id", Trojan, nil)
+			},
+			wantHits: 1,
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hits atomic.Int32
+			server := newFlakyServer(t, tt.failures, tt.statusCode, nil, &hits)
+			client := newTestClientWith(t, server.URL, Config{Retry: tt.policy})
+
+			err := tt.call(client)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := hits.Load(); got != tt.wantHits {
+				t.Fatalf("Expected %d requests, got %d", tt.wantHits, got)
+			}
+		})
+	}
+}
+
+func heartbeatCall(c *Client) error {
+	return c.Heartbeat(context.Background(), "test-register-id", Trojan, "")
+}
+
+func registerCall(c *Client) error {
+	_, err := c.Register(context.Background(), 1, Trojan, "test-hostname", 443, "")
+	return err
+}
+
+func TestRetryAfter(t *testing.T) {
+	var hits atomic.Int32
+	header := http.Header{"Retry-After": []string{"1"}}
+	server := newFlakyServer(t, 1, http.StatusTooManyRequests, header, &hits)
+	client := newTestClientWith(t, server.URL, Config{Retry: &RetryPolicy{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}})
+
+	start := time.Now()
+	if err := heartbeatCall(client); err != nil {
+		t.Fatalf("Heartbeat() unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Fatalf("Expected Retry-After to delay the retry, took %v", elapsed)
+	}
+	if got := hits.Load(); got != 2 {
+		t.Fatalf("Expected 2 requests, got %d", got)
+	}
+}
+
+func TestRetryAfterBeyondDeadline(t *testing.T) {
+	var hits atomic.Int32
+	header := http.Header{"Retry-After": []string{"30"}}
+	server := newFlakyServer(t, 1, http.StatusServiceUnavailable, header, &hits)
+	client := newTestClient(t, server.URL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	err := client.Heartbeat(ctx, "test-register-id", Trojan, "")
+	if err == nil {
+		t.Fatal("Expected error, got nil")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("Expected to give up without waiting, took %v", elapsed)
+	}
+	if got := hits.Load(); got != 1 {
+		t.Fatalf("Expected 1 request, got %d", got)
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	want := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	}
+	for i, w := range want {
+		if got, _ := policy.backoff(i+1, nil); got != w {
+			t.Errorf("backoff(%d) = %v, want %v", i+1, got, w)
+		}
+	}
+
+	policy.Jitter = 0.5
+	for attempt := 1; attempt <= 10; attempt++ {
+		upper := min(policy.BaseDelay<<(attempt-1), policy.MaxDelay)
+		got, _ := policy.backoff(attempt, nil)
+		if got < upper/2 || got > upper {
+			t.Errorf("backoff(%d) = %v, want within [%v, %v]", attempt, got, upper/2, upper)
+		}
+	}
+}
+
+func TestRetryAfterBeyondMax(t *testing.T) {
+	var hits atomic.Int32
+	header := http.Header{"Retry-After": []string{"3600"}}
+	server := newFlakyServer(t, 1, http.StatusTooManyRequests, header, &hits)
+	client := newTestClientWith(t, server.URL, Config{Retry: &RetryPolicy{MaxRetryAfter: time.Minute}})
+
+	start := time.Now()
+	err := heartbeatCall(client)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("Expected the 429 returned, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("Expected to give up without waiting, took %v", elapsed)
+	}
+	if got := hits.Load(); got != 1 {
+		t.Fatalf("Expected 1 request, got %d", got)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  string
+		want   time.Duration
+		wantOk bool
+	}{
+		{"seconds", "3", 3 * time.Second, true},
+		{"zero", "0", 0, true},
+		{"negative", "-1", 0, false},
+		{"empty", "", 0, false},
+		{"garbage", "soon", 0, false},
+		{"past date", "Wed, 21 Oct 2015 07:28:00 GMT", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseRetryAfter(tt.value)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("parseRetryAfter(%q) = %v, %v, want %v, %v", tt.value, got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+
+	future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	got, ok := parseRetryAfter(future)
+	if !ok || got < 59*time.Minute || got > time.Hour {
+		t.Errorf("parseRetryAfter(%q) = %v, %v, want about 1h", future, got, ok)
+	}
+}
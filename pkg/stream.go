@@ -0,0 +1,197 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"time"
+
+	resty "github.com/go-resty/resty/v2"
+)
+
+// UsersIter stream the users of registerId, decoding the data array one user
+// at a time instead of loading the whole list like Users. The request is sent
+// when the iteration starts and the response stays open until it ends. The
+// client timeout only covers the wait for the response headers, reading the
+// list is bounded by ctx.
+//
+// A failure is yielded once with the error and ends the iteration, an unchanged
+// list yields ErrorUserNotModified. The ETag shared with RawUsers is only
+// updated once the whole list has been read.
+func (c *Client) UsersIter(ctx context.Context, registerId string, nodeType NodeType) iter.Seq2[User, error] {
+	return func(yield func(User, error) bool) {
+		path := fmt.Sprintf("/api/v1/server/enhanced/%s/users", nodeType)
+		eTagKey := fmt.Sprintf("users_%s_%s", nodeType, registerId)
+		var eTagValue string
+		if value, ok := c.eTags.Load(eTagKey); ok {
+			eTagValue = value.(string)
+		}
+		op := operation{name: OpUsersIter, nodeType: nodeType, registerId: registerId, stream: true, longLived: true}
+		res, url, err := c.execute(ctx, op, resty.MethodGet, path, func(r *resty.Request) {
+			r.SetQueryParam("register_id", registerId).
+				SetHeader("If-None-Match", eTagValue)
+		})
+		if err != nil {
+			yield(User{}, requestError(url, err))
+			return
+		}
+		if body := res.RawBody(); body != nil {
+			defer body.Close()
+		}
+
+		if res.StatusCode() == 304 {
+			yield(User{}, ErrorUserNotModified)
+			return
+		}
+		if res.StatusCode() >= 400 {
+			yield(User{}, NewAPIErrorFromResponse(res.StatusCode(), res.Body(), url))
+			return
+		}
+
+		body := &readErrorReader{r: res.RawBody()}
+		complete, err := decodeUsers(body, yield)
+		if body.err != nil && body.err != io.EOF {
+			// the connection failed, not the response
+			err = NewNetworkError("read response failed", url, body.err)
+		}
+		if err != nil {
+			yield(User{}, err)
+			return
+		}
+		if complete {
+			c.eTags.Store(eTagKey, res.Header().Get("Etag"))
+		}
+	}
+}
+
+// decodeUsers decode the data array of a users response from r, passing each
+// user to yield. It returns false when yield stopped the iteration.
+func decodeUsers(r io.Reader, yield func(User, error) bool) (bool, error) {
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return false, err
+	}
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return false, NewParseError("parse response failed", err)
+		}
+		if key, _ := token.(string); key != "data" {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return false, NewParseError("parse response failed", err)
+			}
+			continue
+		}
+
+		token, err = dec.Token()
+		if err != nil {
+			return false, NewParseError("parse response failed", err)
+		}
+		if token == nil {
+			// "data": null, no users
+			continue
+		}
+		if token != json.Delim('[') {
+			return false, NewParseError("parse response failed", fmt.Errorf("unexpected token %v for data", token))
+		}
+		for dec.More() {
+			var user User
+			if err := dec.Decode(&user); err != nil {
+				return false, NewParseError("parse user failed", err)
+			}
+			if !yield(user, nil) {
+				return false, nil
+			}
+		}
+		if err := expectDelim(dec, ']'); err != nil {
+			return false, err
+		}
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return NewParseError("parse response failed", err)
+	}
+	if token != delim {
+		return NewParseError("parse response failed", fmt.Errorf("expected %v, got %v", delim, token))
+	}
+	return nil
+}
+
+// readErrorReader remember the error of the underlying reader, so a failed
+// connection can be told apart from a malformed body
+type readErrorReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *readErrorReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// errHeaderTimeout cancels a long-lived request whose response headers took
+// longer than the client timeout
+var errHeaderTimeout = errors.New("timeout awaiting response headers")
+
+// headerDeadline derive the context of a long-lived request, canceled when
+// the response headers take longer than timeout. release stops the deadline
+// once the request returned and reports a timeout as its cause. The context
+// of a response stays alive until its body is closed.
+func headerDeadline(ctx context.Context, timeout time.Duration) (context.Context, func(*resty.Response, error) error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	timer := time.AfterFunc(timeout, func() { cancel(errHeaderTimeout) })
+	return ctx, func(res *resty.Response, err error) error {
+		timer.Stop()
+		if err == nil && res != nil && res.RawResponse != nil {
+			res.RawResponse.Body = &cancelOnClose{ReadCloser: res.RawResponse.Body, cancel: func() { cancel(nil) }}
+			return nil
+		}
+		if context.Cause(ctx) == errHeaderTimeout {
+			err = fmt.Errorf("%w: %w", errHeaderTimeout, err)
+		}
+		cancel(nil)
+		return err
+	}
+}
+
+// cancelOnClose release the request context when the body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel func()
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// bufferBody read and close the body of a streamed response so that Body
+// returns it like for any other request
+func bufferBody(res *resty.Response) error {
+	body := res.RawBody()
+	if body == nil {
+		return nil
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	res.SetBody(data)
+	return nil
+}
@@ -0,0 +1,313 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"runtime/metrics"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// usersBody a users response with n users
+func usersBody(n int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`{"message":"success","data":[`)
+	for i := 1; i <= n; i++ {
+		if i > 1 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(&buf, `{"id":%d,"uuid":"00000000-0000-0000-0000-%012d"}`, i, i)
+	}
+	buf.WriteString(`]}`)
+	return buf.Bytes()
+}
+
+// newUsersServer serve body with an ETag and answer 304 when it matches
+func newUsersServer(tb testing.TB, body []byte) *httptest.Server {
+	tb.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write(body)
+	}))
+	tb.Cleanup(server.Close)
+	return server
+}
+
+func TestUsersIter(t *testing.T) {
+	server := newUsersServer(t, usersBody(1000))
+	client := newTestClient(t, server.URL)
+	ctx := context.Background()
+
+	count := 0
+	for user, err := range client.UsersIter(ctx, "test-register-id", Trojan) {
+		if err != nil {
+			t.Fatalf("UsersIter() unexpected error: %v", err)
+		}
+		count++
+		if user.ID != count {
+			t.Fatalf("Expected user %d, got %d", count, user.ID)
+		}
+	}
+	if count != 1000 {
+		t.Fatalf("Expected 1000 users, got %d", count)
+	}
+
+	// the ETag is stored after a full read and shared with RawUsers
+	for _, err := range client.UsersIter(ctx, "test-register-id", Trojan) {
+		if !errors.Is(err, ErrorUserNotModified) {
+			t.Fatalf("Expected not modified, got %v", err)
+		}
+	}
+	if _, err := client.RawUsers(ctx, "test-register-id", Trojan); !errors.Is(err, ErrorUserNotModified) {
+		t.Fatalf("Expected RawUsers to reuse the ETag, got %v", err)
+	}
+}
+
+func TestUsersIterBreak(t *testing.T) {
+	server := newUsersServer(t, usersBody(100))
+	client := newTestClient(t, server.URL)
+	ctx := context.Background()
+
+	for user, err := range client.UsersIter(ctx, "test-register-id", Trojan) {
+		if err != nil || user.ID != 1 {
+			t.Fatalf("Unexpected first user %v %v", user, err)
+		}
+		break
+	}
+	// a partial read does not store the ETag
+	count := 0
+	for _, err := range client.UsersIter(ctx, "test-register-id", Trojan) {
+		if err != nil {
+			t.Fatalf("Expected the list to be downloaded again, got %v", err)
+		}
+		count++
+	}
+	if count != 100 {
+		t.Fatalf("Expected 100 users, got %d", count)
+	}
+}
+
+func TestUsersIterBodies(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		wantUsers int
+		wantParse bool
+	}{
+		{"null data", `{"data":null,"message":"ok"}`, 0, false},
+		{"empty data", `{"data":[]}`, 0, false},
+		{"unknown fields", `{"meta":{"a":[1,2]},"data":[{"id":1,"uuid":"a","extra":{"x":1}}],"message":"ok"}`, 1, false},
+		{"truncated", `{"data":[{"id":1,"uuid":"a"},{"id":2`, 1, true},
+		{"not an object", `[{"id":1}]`, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			t.Cleanup(server.Close)
+			client := newTestClient(t, server.URL)
+
+			users := 0
+			var gotErr error
+			for _, err := range client.UsersIter(context.Background(), "test-register-id", Trojan) {
+				if err != nil {
+					gotErr = err
+					continue
+				}
+				users++
+			}
+			var apiErr *APIError
+			if tt.wantParse != (errors.As(gotErr, &apiErr) && apiErr.IsParseError()) {
+				t.Fatalf("Expected parse error %v, got %v", tt.wantParse, gotErr)
+			}
+			if users != tt.wantUsers {
+				t.Fatalf("Expected %d users, got %d", tt.wantUsers, users)
+			}
+		})
+	}
+}
+
+func TestUsersIterErrors(t *testing.T) {
+	var hits atomic.Int32
+	server := newFlakyServer(t, 1, http.StatusServiceUnavailable, nil, &hits)
+	client := newTestClientWith(t, server.URL, Config{
+		Retry: &RetryPolicy{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+	})
+	// the 503 body is read before retrying, the retry gets a body that is not a users list
+	for _, err := range client.UsersIter(context.Background(), "test-register-id", Trojan) {
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) || !apiErr.IsParseError() {
+			t.Fatalf("Expected parse error after the retry, got %v", err)
+		}
+	}
+	if hits.Load() != 2 {
+		t.Fatalf("Expected 2 requests, got %d", hits.Load())
+	}
+
+	notFound := newTestServer(t, 404, map[string]any{"message": "node not found", "code": CodeNodeNotFound})
+	client = newTestClient(t, notFound.URL)
+	calls := 0
+	for _, err := range client.UsersIter(context.Background(), "test-register-id", Trojan) {
+		calls++
+		if !errors.Is(err, ErrNodeNotFound) {
+			t.Fatalf("Expected ErrNodeNotFound, got %v", err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("Expected a single error, got %d yields", calls)
+	}
+}
+
+func TestUsersIterTimeout(t *testing.T) {
+	body := usersBody(2)
+	var delayHeaders atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if delayHeaders.Load() {
+			time.Sleep(300 * time.Millisecond)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(body[:len(body)/2])
+		w.(http.Flusher).Flush()
+		// the rest of the list arrives after the client timeout
+		time.Sleep(300 * time.Millisecond)
+		_, _ = w.Write(body[len(body)/2:])
+	}))
+	t.Cleanup(server.Close)
+	client := newTestClientWith(t, server.URL, Config{
+		Timeout: 100 * time.Millisecond,
+		Retry:   &RetryPolicy{MaxAttempts: 1},
+	})
+
+	count := 0
+	for _, err := range client.UsersIter(context.Background(), "test-register-id", Trojan) {
+		if err != nil {
+			t.Fatalf("Expected the timeout to stop at the headers, got %v", err)
+		}
+		count++
+	}
+	if count != 2 {
+		t.Fatalf("Expected 2 users, got %d", count)
+	}
+
+	delayHeaders.Store(true)
+	for _, err := range client.UsersIter(context.Background(), "test-register-id", Trojan) {
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) || !apiErr.IsNetworkError() || !errors.Is(err, errHeaderTimeout) {
+			t.Fatalf("Expected a header timeout, got %v", err)
+		}
+	}
+}
+
+func TestUsersIterConnectionLost(t *testing.T) {
+	body := usersBody(10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+		_, _ = w.Write(body[:len(body)/2])
+	}))
+	t.Cleanup(server.Close)
+	client := newTestClient(t, server.URL)
+
+	var last error
+	for _, err := range client.UsersIter(context.Background(), "test-register-id", Trojan) {
+		last = err
+	}
+	var apiErr *APIError
+	if !errors.As(last, &apiErr) || !apiErr.IsNetworkError() {
+		t.Fatalf("Expected a network error for a truncated body, got %v", last)
+	}
+}
+
+// peakHeap track the highest live heap seen while running fn
+func peakHeap(fn func()) uint64 {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	read := func() uint64 {
+		metrics.Read(sample)
+		return sample[0].Value.Uint64()
+	}
+	runtime.GC()
+	base := read()
+	var peak atomic.Uint64
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(100 * time.Microsecond)
+		defer ticker.Stop()
+		for {
+			if v := read(); v > peak.Load() {
+				peak.Store(v)
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	fn()
+	close(done)
+	<-stopped
+	if p := peak.Load(); p > base {
+		return p - base
+	}
+	return 0
+}
+
+const benchUsers = 200000
+
+// BenchmarkUsers and BenchmarkUsersIter compare loading a 200k user list at
+// once with streaming it, see the peak-heap-B metric
+func BenchmarkUsers(b *testing.B) {
+	server := newUsersServer(b, usersBody(benchUsers))
+	client := newTestClientWith(b, server.URL, Config{Timeout: 30 * time.Second})
+	b.ReportAllocs()
+	b.ResetTimer()
+	var peak uint64
+	for i := 0; i < b.N; i++ {
+		client.eTags.Clear()
+		peak = max(peak, peakHeap(func() {
+			users, err := client.Users(context.Background(), "test-register-id", Trojan)
+			if err != nil || len(*users) != benchUsers {
+				b.Fatalf("Users() unexpected result: %v", err)
+			}
+		}))
+	}
+	b.ReportMetric(float64(peak), "peak-heap-B")
+}
+
+func BenchmarkUsersIter(b *testing.B) {
+	server := newUsersServer(b, usersBody(benchUsers))
+	client := newTestClientWith(b, server.URL, Config{Timeout: 30 * time.Second})
+	b.ReportAllocs()
+	b.ResetTimer()
+	var peak uint64
+	for i := 0; i < b.N; i++ {
+		client.eTags.Clear()
+		peak = max(peak, peakHeap(func() {
+			count := 0
+			for _, err := range client.UsersIter(context.Background(), "test-register-id", Trojan) {
+				if err != nil {
+					b.Fatalf("UsersIter() unexpected error: %v", err)
+				}
+				count++
+			}
+			if count != benchUsers {
+				b.Fatalf("Expected %d users, got %d", benchUsers, count)
+			}
+		}))
+	}
+	b.ReportMetric(float64(peak), "peak-heap-B")
+}
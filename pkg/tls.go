@@ -0,0 +1,299 @@
+package pkg
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// defaultTLSReloadInterval is how often certificate files are checked for changes
+const defaultTLSReloadInterval = 10 * time.Second
+
+// TLSConfig tls options for the panel connection.
+// Files are re-read when their modification time changes, so certificates
+// can be rotated on disk without restarting the process.
+type TLSConfig struct {
+	// CAFile PEM bundle used to verify the panel certificate
+	CAFile string
+	// CAPEM PEM bundle used to verify the panel certificate, merged with CAFile
+	CAPEM []byte
+	// CertFile client certificate chain for mutual TLS
+	CertFile string
+	// KeyFile client private key for mutual TLS
+	KeyFile string
+	// CertPEM client certificate chain, used when CertFile is empty
+	CertPEM []byte
+	// KeyPEM client private key, used when KeyFile is empty
+	KeyPEM []byte
+	// ServerName overrides the name used for SNI and certificate verification.
+	// With a custom CA it is required for an IP host reached through Proxy.
+	ServerName string
+	// MinVersion minimum TLS version, defaults to tls.VersionTLS12
+	MinVersion uint16
+	// PinnedSPKI base64 encoded SHA-256 hashes of the accepted SubjectPublicKeyInfo.
+	// When set, at least one certificate of the verified chain must match.
+	PinnedSPKI []string
+	// ReloadInterval how often files are checked for changes, defaults to 10s
+	ReloadInterval time.Duration
+}
+
+// clientConfig build the *tls.Config used by the transport and the reloader
+// backing it
+func (t *TLSConfig) clientConfig() (*tls.Config, *tlsReloader) {
+	minVersion := t.MinVersion
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS12
+	}
+	interval := t.ReloadInterval
+	if interval <= 0 {
+		interval = defaultTLSReloadInterval
+	}
+	r := &tlsReloader{config: t, interval: interval}
+
+	tlsConfig := &tls.Config{
+		ServerName: t.ServerName,
+		MinVersion: minVersion,
+	}
+	if t.CertFile != "" || len(t.CertPEM) > 0 {
+		tlsConfig.GetClientCertificate = r.clientCertificate
+	}
+	if t.hasCA() {
+		// direct connections go through dialTLSContext, this check is left
+		// for connections the transport handshakes itself, such as through a proxy
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = r.verifyConnection
+	} else if len(t.PinnedSPKI) > 0 {
+		tlsConfig.VerifyConnection = r.verifyPins
+	}
+	return tlsConfig, r
+}
+
+// hasCA report whether a custom CA bundle replaces the system roots
+func (t *TLSConfig) hasCA() bool {
+	return t.CAFile != "" || len(t.CAPEM) > 0
+}
+
+// tlsReloader lazily loads certificate material and reloads it when files change
+type tlsReloader struct {
+	config   *TLSConfig
+	interval time.Duration
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	certMod   time.Time
+	keyMod    time.Time
+	caMod     time.Time
+	cert      *tls.Certificate
+	roots     *x509.CertPool
+}
+
+func (r *tlsReloader) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cert, nil
+}
+
+func (r *tlsReloader) verifyConnection(cs tls.ConnectionState) error {
+	if err := r.reload(); err != nil {
+		return err
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("tls: panel presented no certificates")
+	}
+	r.mu.Lock()
+	roots := r.roots
+	r.mu.Unlock()
+
+	serverName := r.config.ServerName
+	if serverName == "" {
+		serverName = cs.ServerName
+	}
+	if serverName == "" {
+		// no SNI is sent for an IP host, so the dialed host is unknown here
+		return errors.New("tls: cannot verify the panel host name, set TLSConfig.ServerName")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       serverName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	chains, err := cs.PeerCertificates[0].Verify(opts)
+	if err != nil {
+		return err
+	}
+	cs.VerifiedChains = chains
+	return r.verifyPins(cs)
+}
+
+// dialTLSContext dial the panel and verify its certificate against the
+// current CA pool and the dialed host, which is also right for IP hosts that
+// send no SNI. The handshake settings, ALPN included, come from the transport.
+func (r *tlsReloader) dialTLSContext(transport *http.Transport) DialContextFunc {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if err := r.reload(); err != nil {
+			return nil, err
+		}
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		dial := transport.DialContext
+		if dial == nil {
+			dial = dialer.DialContext
+		}
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		r.mu.Lock()
+		roots := r.roots
+		r.mu.Unlock()
+		config := transport.TLSClientConfig.Clone()
+		config.RootCAs = roots
+		config.InsecureSkipVerify = false
+		config.VerifyConnection = r.verifyPins
+		if config.ServerName == "" {
+			config.ServerName = host
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
+
+func (r *tlsReloader) verifyPins(cs tls.ConnectionState) error {
+	if len(r.config.PinnedSPKI) == 0 {
+		return nil
+	}
+	for _, chain := range cs.VerifiedChains {
+		for _, cert := range chain {
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			hash := base64.StdEncoding.EncodeToString(sum[:])
+			for _, pin := range r.config.PinnedSPKI {
+				if pin == hash {
+					return nil
+				}
+			}
+		}
+	}
+	return errors.New("tls: no certificate in the chain matches the pinned SPKI hashes")
+}
+
+// reload re-read the files when they have changed since the last check
+func (r *tlsReloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if !r.checkedAt.IsZero() && now.Sub(r.checkedAt) < r.interval {
+		return nil
+	}
+
+	// a failed reload keeps the previous material, so a rotation caught
+	// half-written does not break connections that were working
+	rootsErr := r.reloadRoots()
+	certErr := r.reloadCert()
+	if rootsErr == nil && certErr == nil {
+		r.checkedAt = now
+	}
+	if rootsErr != nil && r.roots == nil {
+		return rootsErr
+	}
+	if certErr != nil && r.cert == nil {
+		return certErr
+	}
+	return nil
+}
+
+func (r *tlsReloader) reloadRoots() error {
+	t := r.config
+	if t.CAFile == "" && len(t.CAPEM) == 0 {
+		return nil
+	}
+	var caMod time.Time
+	if t.CAFile != "" {
+		info, err := os.Stat(t.CAFile)
+		if err != nil {
+			return fmt.Errorf("tls: stat ca file: %w", err)
+		}
+		caMod = info.ModTime()
+	}
+	if r.roots != nil && caMod.Equal(r.caMod) {
+		return nil
+	}
+
+	pool := x509.NewCertPool()
+	if len(t.CAPEM) > 0 && !pool.AppendCertsFromPEM(t.CAPEM) {
+		return errors.New("tls: no certificates found in CAPEM")
+	}
+	if t.CAFile != "" {
+		data, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return fmt.Errorf("tls: read ca file: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("tls: no certificates found in %s", t.CAFile)
+		}
+	}
+	r.roots = pool
+	r.caMod = caMod
+	return nil
+}
+
+func (r *tlsReloader) reloadCert() error {
+	t := r.config
+	if t.CertFile == "" {
+		if len(t.CertPEM) == 0 || r.cert != nil {
+			return nil
+		}
+		cert, err := tls.X509KeyPair(t.CertPEM, t.KeyPEM)
+		if err != nil {
+			return fmt.Errorf("tls: load client certificate: %w", err)
+		}
+		r.cert = &cert
+		return nil
+	}
+
+	certInfo, err := os.Stat(t.CertFile)
+	if err != nil {
+		return fmt.Errorf("tls: stat cert file: %w", err)
+	}
+	keyInfo, err := os.Stat(t.KeyFile)
+	if err != nil {
+		return fmt.Errorf("tls: stat key file: %w", err)
+	}
+	if r.cert != nil && certInfo.ModTime().Equal(r.certMod) && keyInfo.ModTime().Equal(r.keyMod) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return fmt.Errorf("tls: load client certificate: %w", err)
+	}
+	r.cert = &cert
+	r.certMod = certInfo.ModTime()
+	r.keyMod = keyInfo.ModTime()
+	return nil
+}
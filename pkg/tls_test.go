@@ -0,0 +1,313 @@
+package pkg
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a generated certificate with its PEM encoding
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func (c *testCert) tlsCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	cert, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	if err != nil {
+		t.Fatalf("X509KeyPair: %v", err)
+	}
+	return cert
+}
+
+func (c *testCert) spki() string {
+	sum := sha256.Sum256(c.cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// newTestCert issues a certificate signed by parent, or a self-signed CA when parent is nil.
+// Server certificates are valid for 127.0.0.1 and panel.internal.
+func newTestCert(t *testing.T, name string, parent *testCert, isClient bool) *testCert {
+	t.Helper()
+	return issueTestCert(t, name, parent, isClient, "127.0.0.1", "panel.internal")
+}
+
+// issueTestCert like newTestCert, with the IPs and DNS names of a server certificate
+func issueTestCert(t *testing.T, name string, parent *testCert, isClient bool, hosts ...string) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+		tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+		if isClient {
+			tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+		} else {
+			tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+			for _, host := range hosts {
+				if ip := net.ParseIP(host); ip != nil {
+					tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+				} else {
+					tmpl.DNSNames = append(tmpl.DNSNames, host)
+				}
+			}
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey: %v", err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// newMTLSServer starts a TLS server that requires client certificates signed by ca
+func newMTLSServer(t *testing.T, ca, serverCert *testCert) *httptest.Server {
+	t.Helper()
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"data":true,"message":"success"}`))
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert.tlsCertificate(t)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func writeTestFile(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return path
+}
+
+func TestTLSMutualAuth(t *testing.T) {
+	ca := newTestCert(t, "test-ca", nil, false)
+	server := newMTLSServer(t, ca, newTestCert(t, "panel", ca, false))
+	clientCert := newTestCert(t, "node", ca, true)
+
+	dir := t.TempDir()
+	client := newTestClientWith(t, server.URL, Config{TLS: &TLSConfig{
+		CAFile:   writeTestFile(t, dir, "ca.pem", ca.certPEM),
+		CertFile: writeTestFile(t, dir, "cert.pem", clientCert.certPEM),
+		KeyFile:  writeTestFile(t, dir, "key.pem", clientCert.keyPEM),
+	}})
+
+	if err := client.Heartbeat(context.Background(), "test-register-id", Trojan, ""); err != nil {
+		t.Fatalf("Heartbeat() unexpected error: %v", err)
+	}
+}
+
+func TestTLSMutualAuthPEM(t *testing.T) {
+	ca := newTestCert(t, "test-ca", nil, false)
+	server := newMTLSServer(t, ca, newTestCert(t, "panel", ca, false))
+	clientCert := newTestCert(t, "node", ca, true)
+
+	client := newTestClientWith(t, server.URL, Config{TLS: &TLSConfig{
+		CAPEM:   ca.certPEM,
+		CertPEM: clientCert.certPEM,
+		KeyPEM:  clientCert.keyPEM,
+	}})
+
+	if err := client.Heartbeat(context.Background(), "test-register-id", Trojan, ""); err != nil {
+		t.Fatalf("Heartbeat() unexpected error: %v", err)
+	}
+}
+
+func TestTLSServerNameOverride(t *testing.T) {
+	ca := newTestCert(t, "test-ca", nil, false)
+	server := newMTLSServer(t, ca, newTestCert(t, "panel", ca, false))
+	clientCert := newTestCert(t, "node", ca, true)
+
+	tests := []struct {
+		name       string
+		serverName string
+		wantErr    bool
+	}{
+		{"matching name", "panel.internal", false},
+		{"mismatching name", "other.internal", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newTestClientWith(t, server.URL, Config{TLS: &TLSConfig{
+				CAPEM:      ca.certPEM,
+				CertPEM:    clientCert.certPEM,
+				KeyPEM:     clientCert.keyPEM,
+				ServerName: tt.serverName,
+			}})
+			err := client.Heartbeat(context.Background(), "test-register-id", Trojan, "")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Heartbeat() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTLSMissingClientCert(t *testing.T) {
+	ca := newTestCert(t, "test-ca", nil, false)
+	server := newMTLSServer(t, ca, newTestCert(t, "panel", ca, false))
+
+	client := newTestClientWith(t, server.URL, Config{TLS: &TLSConfig{CAPEM: ca.certPEM}})
+
+	err := client.Heartbeat(context.Background(), "test-register-id", Trojan, "")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || !apiErr.IsNetworkError() {
+		t.Fatalf("Expected network error, got %v", err)
+	}
+}
+
+func TestTLSUnknownCA(t *testing.T) {
+	ca := newTestCert(t, "test-ca", nil, false)
+	server := newMTLSServer(t, ca, newTestCert(t, "panel", ca, false))
+	clientCert := newTestCert(t, "node", ca, true)
+	otherCA := newTestCert(t, "other-ca", nil, false)
+
+	client := newTestClientWith(t, server.URL, Config{TLS: &TLSConfig{
+		CAPEM:   otherCA.certPEM,
+		CertPEM: clientCert.certPEM,
+		KeyPEM:  clientCert.keyPEM,
+	}})
+
+	if err := client.Heartbeat(context.Background(), "test-register-id", Trojan, ""); err == nil {
+		t.Fatal("Expected error for untrusted panel certificate, got nil")
+	}
+}
+
+func TestTLSWrongHostIP(t *testing.T) {
+	ca := newTestCert(t, "test-ca", nil, false)
+	// signed by the trusted CA, but for another host than the dialed IP
+	server := newMTLSServer(t, ca, issueTestCert(t, "other", ca, false, "other.example"))
+	clientCert := newTestCert(t, "node", ca, true)
+
+	client := newTestClientWith(t, server.URL, Config{TLS: &TLSConfig{
+		CAPEM:   ca.certPEM,
+		CertPEM: clientCert.certPEM,
+		KeyPEM:  clientCert.keyPEM,
+	}})
+
+	err := client.Heartbeat(context.Background(), "test-register-id", Trojan, "")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || !apiErr.IsNetworkError() {
+		t.Fatalf("Expected a network error for a certificate of another host, got %v", err)
+	}
+}
+
+func TestTLSPinnedSPKI(t *testing.T) {
+	ca := newTestCert(t, "test-ca", nil, false)
+	serverCert := newTestCert(t, "panel", ca, false)
+	server := newMTLSServer(t, ca, serverCert)
+	clientCert := newTestCert(t, "node", ca, true)
+
+	tests := []struct {
+		name    string
+		pins    []string
+		wantErr bool
+	}{
+		{"leaf pin", []string{serverCert.spki()}, false},
+		{"ca pin", []string{"bogus", ca.spki()}, false},
+		{"no matching pin", []string{newTestCert(t, "other", nil, false).spki()}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newTestClientWith(t, server.URL, Config{TLS: &TLSConfig{
+				CAPEM:      ca.certPEM,
+				CertPEM:    clientCert.certPEM,
+				KeyPEM:     clientCert.keyPEM,
+				PinnedSPKI: tt.pins,
+			}})
+			err := client.Heartbeat(context.Background(), "test-register-id", Trojan, "")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Heartbeat() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTLSReloadOnFileChange(t *testing.T) {
+	ca := newTestCert(t, "test-ca", nil, false)
+	server := newMTLSServer(t, ca, newTestCert(t, "panel", ca, false))
+	otherCA := newTestCert(t, "other-ca", nil, false)
+	// signed by a CA the server does not trust
+	staleCert := newTestCert(t, "node", otherCA, true)
+	freshCert := newTestCert(t, "node", ca, true)
+
+	dir := t.TempDir()
+	certFile := writeTestFile(t, dir, "cert.pem", staleCert.certPEM)
+	keyFile := writeTestFile(t, dir, "key.pem", staleCert.keyPEM)
+	client := newTestClientWith(t, server.URL, Config{TLS: &TLSConfig{
+		CAPEM:          ca.certPEM,
+		CertFile:       certFile,
+		KeyFile:        keyFile,
+		ReloadInterval: time.Nanosecond,
+	}})
+
+	ctx := context.Background()
+	if err := client.Heartbeat(ctx, "test-register-id", Trojan, ""); err == nil {
+		t.Fatal("Expected error with untrusted client certificate, got nil")
+	}
+
+	writeTestFile(t, dir, "cert.pem", freshCert.certPEM)
+	writeTestFile(t, dir, "key.pem", freshCert.keyPEM)
+	later := time.Now().Add(time.Minute)
+	for _, path := range []string{certFile, keyFile} {
+		if err := os.Chtimes(path, later, later); err != nil {
+			t.Fatalf("Chtimes: %v", err)
+		}
+	}
+
+	if err := client.Heartbeat(ctx, "test-register-id", Trojan, ""); err != nil {
+		t.Fatalf("Heartbeat() after rotation unexpected error: %v", err)
+	}
+}
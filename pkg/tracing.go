@@ -0,0 +1,86 @@
+package pkg
+
+import (
+	"context"
+	"net/http"
+
+	resty "github.com/go-resty/resty/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName instrumentation scope of the client spans
+const tracerName = "github.com/xflash-panda/server-client/pkg"
+
+// Span attribute keys
+const (
+	AttrNodeType       = attribute.Key("panel.node_type")
+	AttrNodeId         = attribute.Key("panel.node_id")
+	AttrRegisterId     = attribute.Key("panel.register_id")
+	AttrErrorType      = attribute.Key("panel.error_type")
+	AttrRetryCount     = attribute.Key("panel.retry_count")
+	AttrHTTPStatusCode = attribute.Key("http.response.status_code")
+)
+
+// tracing spans of a Client, nil when no TracerProvider is configured
+type tracing struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+func newTracing(provider trace.TracerProvider, propagator propagation.TextMapPropagator) *tracing {
+	if provider == nil {
+		return nil
+	}
+	if propagator == nil {
+		propagator = propagation.TraceContext{}
+	}
+	return &tracing{
+		tracer:     provider.Tracer(tracerName),
+		propagator: propagator,
+	}
+}
+
+// start a span named panel.<operation>
+func (t *tracing) start(ctx context.Context, op operation) (context.Context, trace.Span) {
+	attrs := make([]attribute.KeyValue, 0, 3)
+	if op.nodeType != "" {
+		attrs = append(attrs, AttrNodeType.String(string(op.nodeType)))
+	}
+	if op.nodeId != 0 {
+		attrs = append(attrs, AttrNodeId.Int(int(op.nodeId)))
+	}
+	if op.registerId != "" {
+		attrs = append(attrs, AttrRegisterId.String(op.registerId))
+	}
+	return t.tracer.Start(ctx, "panel."+op.name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...))
+}
+
+// inject write the trace context of ctx into the request headers
+func (t *tracing) inject(ctx context.Context, r *resty.Request) {
+	t.propagator.Inject(ctx, propagation.HeaderCarrier(r.Header))
+}
+
+// end record the result of the call and end the span
+func (t *tracing) end(span trace.Span, attempts int, res *resty.Response, err error) {
+	span.SetAttributes(AttrRetryCount.Int(attempts - 1))
+	if res != nil {
+		span.SetAttributes(AttrHTTPStatusCode.Int(res.StatusCode()))
+	}
+	errorType := resultErrorType(res, err)
+	if errorType != "" {
+		span.SetAttributes(AttrErrorType.String(string(errorType)))
+	}
+	switch {
+	case err != nil:
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	case res.StatusCode() >= http.StatusBadRequest:
+		span.SetStatus(codes.Error, string(errorType))
+	}
+	span.End()
+}
@@ -0,0 +1,117 @@
+package pkg
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// newTestTracer a tracer provider recording the ended spans
+func newTestTracer(t *testing.T) (*sdktrace.TracerProvider, *tracetest.SpanRecorder) {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	t.Cleanup(func() { _ = provider.Shutdown(context.Background()) })
+	return provider, recorder
+}
+
+func spanAttrs(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	return attrs
+}
+
+func TestTracingSpan(t *testing.T) {
+	var traceparent atomic.Value
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent.Store(r.Header.Get("Traceparent"))
+		if hits.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`{"data":true,"message":"success"}`))
+	}))
+	t.Cleanup(server.Close)
+	provider, recorder := newTestTracer(t)
+	client := newTestClientWith(t, server.URL, Config{
+		Retry:          &RetryPolicy{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+		TracerProvider: provider,
+	})
+
+	if err := heartbeatCall(client); err != nil {
+		t.Fatalf("Heartbeat() unexpected error: %v", err)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("Expected one span, got %d", len(spans))
+	}
+	span := spans[0]
+	if span.Name() != "panel.Heartbeat" {
+		t.Errorf("Expected span panel.Heartbeat, got %s", span.Name())
+	}
+	attrs := spanAttrs(span)
+	if attrs[AttrNodeType].AsString() != "trojan" || attrs[AttrRegisterId].AsString() != "test-register-id" {
+		t.Errorf("Unexpected node attributes %v", attrs)
+	}
+	if attrs[AttrHTTPStatusCode].AsInt64() != 200 || attrs[AttrRetryCount].AsInt64() != 1 {
+		t.Errorf("Expected status 200 after one retry, got %v", attrs)
+	}
+	if _, ok := attrs[AttrErrorType]; ok || span.Status().Code == codes.Error {
+		t.Errorf("Expected successful span, got %v", span.Status())
+	}
+
+	want := "00-" + span.SpanContext().TraceID().String() + "-" + span.SpanContext().SpanID().String() + "-01"
+	if got, _ := traceparent.Load().(string); got != want {
+		t.Errorf("Expected traceparent %s, got %s", want, got)
+	}
+}
+
+func TestTracingError(t *testing.T) {
+	server := newTestServer(t, 404, map[string]any{"message": "not found"})
+	provider, recorder := newTestTracer(t)
+	client := newTestClientWith(t, server.URL, Config{
+		Retry:          &RetryPolicy{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+		TracerProvider: provider,
+	})
+
+	if _, err := client.Config(context.Background(), 7, Trojan); err == nil {
+		t.Fatal("Expected error, got nil")
+	}
+	span := recorder.Ended()[0]
+	attrs := spanAttrs(span)
+	if attrs[AttrNodeId].AsInt64() != 7 {
+		t.Errorf("Expected node id 7, got %v", attrs[AttrNodeId])
+	}
+	if attrs[AttrErrorType].AsString() != string(ErrorTypeClientError) || span.Status().Code != codes.Error {
+		t.Errorf("Expected client error span, got %v %v", attrs, span.Status())
+	}
+}
+
+func TestTracingDisabled(t *testing.T) {
+	var traceparent atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent.Store(r.Header.Get("Traceparent"))
+		_, _ = w.Write([]byte(`{"data":true,"message":"success"}`))
+	}))
+	t.Cleanup(server.Close)
+	client := newTestClient(t, server.URL)
+
+	if err := heartbeatCall(client); err != nil {
+		t.Fatalf("Heartbeat() unexpected error: %v", err)
+	}
+	if client.tracing != nil || traceparent.Load().(string) != "" {
+		t.Fatal("Expected no tracing without a TracerProvider")
+	}
+}
@@ -0,0 +1,153 @@
+package pkg
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	resty "github.com/go-resty/resty/v2"
+)
+
+// DialContextFunc dials the panel connection, see net.Dialer.DialContext
+type DialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// configureTransport apply the connection options of Config to the resty transport
+func configureTransport(client *resty.Client, cfg *Config) {
+	transport, err := client.Transport()
+	if err != nil {
+		return
+	}
+	if cfg.MaxIdleConns > 0 {
+		transport.MaxIdleConns = cfg.MaxIdleConns
+	}
+	if cfg.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	}
+	if cfg.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = cfg.IdleConnTimeout
+	}
+	transport.ForceAttemptHTTP2 = cfg.EnableHTTP2
+	if !cfg.EnableHTTP2 {
+		// a non-nil empty map disables HTTP/2 negotiation
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	if cfg.Proxy != "" {
+		transport.Proxy = proxyFunc(cfg.Proxy)
+	}
+	if cfg.DialContext != nil || cfg.LocalAddr != "" || cfg.Resolve != "" {
+		transport.DialContext = dialContextFunc(cfg)
+	}
+	if cfg.TLS != nil {
+		tlsConfig, reloader := cfg.TLS.clientConfig()
+		transport.TLSClientConfig = tlsConfig
+		if cfg.TLS.hasCA() {
+			transport.DialTLSContext = reloader.dialTLSContext(transport)
+		}
+	}
+}
+
+// proxyFunc return a transport proxy func for proxyURL.
+// Parse errors are reported on each request, since New cannot fail.
+func proxyFunc(proxyURL string) func(*http.Request) (*url.URL, error) {
+	u, err := url.Parse(proxyURL)
+	if err == nil {
+		switch u.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			err = fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("invalid proxy %q: %w", proxyURL, err)
+		return func(*http.Request) (*url.URL, error) { return nil, err }
+	}
+	return http.ProxyURL(u)
+}
+
+// dialContextFunc build the dialer from DialContext, LocalAddr and Resolve
+func dialContextFunc(cfg *Config) DialContextFunc {
+	dial := cfg.DialContext
+	if dial == nil {
+		dialer := &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}
+		localAddr := cfg.LocalAddr
+		dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if localAddr != "" {
+				ip, err := resolveLocalAddr(localAddr, addr)
+				if err != nil {
+					return nil, err
+				}
+				// copy so concurrent dials do not share LocalAddr
+				d := *dialer
+				d.LocalAddr = &net.TCPAddr{IP: ip}
+				return d.DialContext(ctx, network, addr)
+			}
+			return dialer.DialContext(ctx, network, addr)
+		}
+	}
+
+	if cfg.Resolve == "" {
+		return dial
+	}
+	// the panel hosts, APIHosts replaces APIHost when set
+	apiHosts := map[string]bool{}
+	rawURLs := []string{cfg.APIHost}
+	if len(cfg.APIHosts) > 0 {
+		rawURLs = rawURLs[:0]
+		for _, h := range cfg.APIHosts {
+			rawURLs = append(rawURLs, h.URL)
+		}
+	}
+	for _, raw := range rawURLs {
+		if u, err := url.Parse(raw); err == nil && u.Hostname() != "" {
+			apiHosts[u.Hostname()] = true
+		}
+	}
+	resolve := cfg.Resolve
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err == nil && apiHosts[host] {
+			addr = net.JoinHostPort(resolve, port)
+		}
+		return dial(ctx, network, addr)
+	}
+}
+
+// resolveLocalAddr return the source IP for localAddr, which is either an IP
+// or an interface name. For interfaces the first address of the same family
+// as the remote addr is used.
+func resolveLocalAddr(localAddr string, remoteAddr string) (net.IP, error) {
+	if ip := net.ParseIP(localAddr); ip != nil {
+		return ip, nil
+	}
+	iface, err := net.InterfaceByName(localAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid local address %q: %w", localAddr, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("list addresses of %s: %w", localAddr, err)
+	}
+	wantIPv4 := true
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			wantIPv4 = ip.To4() != nil
+		}
+	}
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if (ipNet.IP.To4() != nil) == wantIPv4 {
+			return ipNet.IP, nil
+		}
+	}
+	return nil, fmt.Errorf("interface %s has no usable address", localAddr)
+}
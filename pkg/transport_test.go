@@ -0,0 +1,373 @@
+package pkg
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// newSOCKS5Server starts a minimal no-auth SOCKS5 CONNECT proxy and counts its connections
+func newSOCKS5Server(t *testing.T, conns *atomic.Int32) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns.Add(1)
+			go serveSOCKS5(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func serveSOCKS5(conn net.Conn) {
+	defer conn.Close()
+	// greeting: VER NMETHODS METHODS...
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(conn, make([]byte, head[1])); err != nil {
+		return
+	}
+	_, _ = conn.Write([]byte{5, 0})
+
+	// request: VER CMD RSV ATYP DST.ADDR DST.PORT
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return
+	}
+	var host string
+	switch req[3] {
+	case 1:
+		ip := make([]byte, 4)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return
+		}
+		host = net.IP(ip).String()
+	case 3:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return
+		}
+		name := make([]byte, l[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return
+		}
+		host = string(name)
+	default:
+		return
+	}
+	portBuf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, portBuf); err != nil {
+		return
+	}
+	port := binary.BigEndian.Uint16(portBuf)
+
+	target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		_, _ = conn.Write([]byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+	_, _ = conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+
+	go func() { _, _ = io.Copy(target, conn) }()
+	_, _ = io.Copy(conn, target)
+}
+
+func TestHTTPProxy(t *testing.T) {
+	var hits atomic.Int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if r.URL.Host != "panel.invalid" {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"data":true,"message":"success"}`))
+	}))
+	t.Cleanup(proxy.Close)
+
+	client := newTestClientWith(t, "http://panel.invalid", Config{
+		Proxy: proxy.URL,
+	})
+
+	if err := client.Heartbeat(context.Background(), "test-register-id", Trojan, ""); err != nil {
+		t.Fatalf("Heartbeat() unexpected error: %v", err)
+	}
+	if hits.Load() == 0 {
+		t.Fatal("Expected request to go through the proxy")
+	}
+}
+
+func TestSOCKS5Proxy(t *testing.T) {
+	server := newTestServer(t, 200, map[string]any{"data": true, "message": "success"})
+	var conns atomic.Int32
+	proxyAddr := newSOCKS5Server(t, &conns)
+
+	client := newTestClientWith(t, server.URL, Config{
+		Proxy: "socks5://" + proxyAddr,
+	})
+
+	if err := client.Heartbeat(context.Background(), "test-register-id", Trojan, ""); err != nil {
+		t.Fatalf("Heartbeat() unexpected error: %v", err)
+	}
+	if conns.Load() == 0 {
+		t.Fatal("Expected connection through the SOCKS5 proxy")
+	}
+}
+
+func TestInvalidProxy(t *testing.T) {
+	server := newTestServer(t, 200, map[string]any{"data": true, "message": "success"})
+
+	client := newTestClientWith(t, server.URL, Config{
+		Proxy: "ftp://127.0.0.1:21",
+	})
+
+	err := client.Heartbeat(context.Background(), "test-register-id", Trojan, "")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || !apiErr.IsNetworkError() {
+		t.Fatalf("Expected network error for unsupported proxy scheme, got %v", err)
+	}
+}
+
+func TestCustomDialContext(t *testing.T) {
+	server := newTestServer(t, 200, map[string]any{"data": true, "message": "success"})
+	serverAddr := server.Listener.Addr().String()
+
+	var dials atomic.Int32
+	client := newTestClientWith(t, "http://panel.invalid", Config{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dials.Add(1)
+			var d net.Dialer
+			return d.DialContext(ctx, network, serverAddr)
+		},
+	})
+
+	if err := client.Heartbeat(context.Background(), "test-register-id", Trojan, ""); err != nil {
+		t.Fatalf("Heartbeat() unexpected error: %v", err)
+	}
+	if dials.Load() == 0 {
+		t.Fatal("Expected custom DialContext to be used")
+	}
+}
+
+func TestResolveOverride(t *testing.T) {
+	var gotHost atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHost.Store(r.Host)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"data":true,"message":"success"}`))
+	}))
+	t.Cleanup(server.Close)
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	apiHost := "http://panel.invalid:" + port
+	client := newTestClientWith(t, apiHost, Config{
+		Resolve: "127.0.0.1",
+	})
+
+	if err := client.Heartbeat(context.Background(), "test-register-id", Trojan, ""); err != nil {
+		t.Fatalf("Heartbeat() unexpected error: %v", err)
+	}
+	u, _ := url.Parse(apiHost)
+	if got := gotHost.Load(); got != u.Host {
+		t.Fatalf("Expected Host header %q, got %v", u.Host, got)
+	}
+}
+
+func TestResolveOverrideAPIHosts(t *testing.T) {
+	var gotHosts sync.Map
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHosts.Store(r.Host, true)
+		if strings.HasPrefix(r.Host, "panel1.") {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"data":true,"message":"success"}`))
+	}))
+	t.Cleanup(server.Close)
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	client := newTestClientWith(t, "", Config{
+		APIHosts: []Host{{URL: "http://panel1.invalid:" + port}, {URL: "http://panel2.invalid:" + port}},
+		Resolve:  "127.0.0.1",
+	})
+
+	if err := client.Heartbeat(context.Background(), "test-register-id", Trojan, ""); err != nil {
+		t.Fatalf("Heartbeat() unexpected error: %v", err)
+	}
+	for _, host := range []string{"panel1.invalid:" + port, "panel2.invalid:" + port} {
+		if _, ok := gotHosts.Load(host); !ok {
+			t.Fatalf("Expected a request to %s", host)
+		}
+	}
+}
+
+func TestLocalAddr(t *testing.T) {
+	var remote atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remote.Store(r.RemoteAddr)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"data":true,"message":"success"}`))
+	}))
+	t.Cleanup(server.Close)
+
+	tests := []struct {
+		name      string
+		localAddr string
+		wantErr   bool
+	}{
+		{"ip", "127.0.0.1", false},
+		{"unknown interface", "no-such-iface0", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newTestClientWith(t, server.URL, Config{
+				LocalAddr: tt.localAddr,
+			})
+			err := client.Heartbeat(context.Background(), "test-register-id", Trojan, "")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Heartbeat() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			host, _, _ := net.SplitHostPort(remote.Load().(string))
+			if host != tt.localAddr {
+				t.Fatalf("Expected source address %s, got %s", tt.localAddr, host)
+			}
+		})
+	}
+}
+
+// newCountingTLSServer starts a TLS server that counts accepted connections
+func newCountingTLSServer(tb testing.TB, enableHTTP2 bool, conns *atomic.Int32) *httptest.Server {
+	tb.Helper()
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Proto", r.Proto)
+		_, _ = w.Write([]byte(`{"data":true,"message":"success"}`))
+	}))
+	server.EnableHTTP2 = enableHTTP2
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	server.StartTLS()
+	tb.Cleanup(server.Close)
+	return server
+}
+
+func newReuseTestClient(tb testing.TB, server *httptest.Server, cfg Config) *Client {
+	cfg.TLS = &TLSConfig{
+		CAPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}),
+	}
+	return newTestClientWith(tb, server.URL, cfg)
+}
+
+func TestConnectionReuse(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    Config
+		wantConns int32
+	}{
+		{"reuse by default", Config{}, 1},
+		{"close per request", Config{CloseConnection: true}, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var conns atomic.Int32
+			server := newCountingTLSServer(t, false, &conns)
+			client := newReuseTestClient(t, server, tt.config)
+
+			ctx := context.Background()
+			for i := 0; i < 5; i++ {
+				if err := client.Heartbeat(ctx, "test-register-id", Trojan, ""); err != nil {
+					t.Fatalf("Heartbeat() unexpected error: %v", err)
+				}
+			}
+			if got := conns.Load(); got != tt.wantConns {
+				t.Fatalf("Expected %d connections, got %d", tt.wantConns, got)
+			}
+		})
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	tests := []struct {
+		name        string
+		enableHTTP2 bool
+		wantProto   string
+	}{
+		{"disabled by default", false, "HTTP/1.1"},
+		{"enabled", true, "HTTP/2.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var conns atomic.Int32
+			server := newCountingTLSServer(t, true, &conns)
+			client := newReuseTestClient(t, server, Config{EnableHTTP2: tt.enableHTTP2})
+
+			res, err := client.client.R().Get("/")
+			if err != nil {
+				t.Fatalf("Get() unexpected error: %v", err)
+			}
+			if got := res.Header().Get("X-Proto"); got != tt.wantProto {
+				t.Fatalf("Expected %s, got %s", tt.wantProto, got)
+			}
+		})
+	}
+}
+
+// BenchmarkHeartbeatTLS compares close-per-request with connection reuse
+// against a local TLS server; handshakes/op reports the TLS handshakes paid
+// by each call.
+func BenchmarkHeartbeatTLS(b *testing.B) {
+	benchmarks := []struct {
+		name   string
+		config Config
+	}{
+		{"CloseConnection", Config{CloseConnection: true}},
+		{"Reuse", Config{}},
+		{"ReuseHTTP2", Config{EnableHTTP2: true}},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			var conns atomic.Int32
+			server := newCountingTLSServer(b, bm.config.EnableHTTP2, &conns)
+			client := newReuseTestClient(b, server, bm.config)
+			ctx := context.Background()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := client.Heartbeat(ctx, "test-register-id", Trojan, ""); err != nil {
+					b.Fatalf("Heartbeat() unexpected error: %v", err)
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(conns.Load())/float64(b.N), "handshakes/op")
+		})
+	}
+}
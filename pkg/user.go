@@ -0,0 +1,86 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// passwordNodeTypes protocols authenticating users with a password instead of the UUID
+var passwordNodeTypes = map[NodeType]bool{
+	Trojan:    true,
+	Hysteria2: true,
+	AnyTLS:    true,
+}
+
+// Credential the secret a node of nodeType authenticates the user with. Password
+// based protocols use Password and fall back to the UUID when the panel sends none.
+func (u User) Credential(nodeType NodeType) string {
+	if passwordNodeTypes[NodeType(nodeType.String())] && u.Password != "" {
+		return u.Password
+	}
+	return u.UUID
+}
+
+// SpeedLimitBytes speed limit in bytes per second, 0 is unlimited
+func (u User) SpeedLimitBytes() uint64 {
+	if u.SpeedLimit <= 0 {
+		return 0
+	}
+	return uint64(u.SpeedLimit) * 1000 * 1000 / 8
+}
+
+// ExpiresAt expiry time, zero when the user never expires
+func (u User) ExpiresAt() time.Time {
+	if u.ExpiredAt <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(u.ExpiredAt, 0)
+}
+
+// Expired report whether the user has expired at now
+func (u User) Expired(now time.Time) bool {
+	return u.ExpiredAt > 0 && !now.Before(time.Unix(u.ExpiredAt, 0))
+}
+
+// UnmarshalJSON decode a user tolerantly: the optional fields may be absent or
+// null, and numbers may be sent as strings as some panels do.
+func (u *User) UnmarshalJSON(data []byte) error {
+	type plain User
+	aux := struct {
+		*plain
+		SpeedLimit  looseInt `json:"speed_limit"`
+		DeviceLimit looseInt `json:"device_limit"`
+		ExpiredAt   looseInt `json:"expired_at"`
+	}{plain: (*plain)(u)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	u.SpeedLimit = int64(aux.SpeedLimit)
+	u.DeviceLimit = int(aux.DeviceLimit)
+	u.ExpiredAt = int64(aux.ExpiredAt)
+	return nil
+}
+
+// looseInt an integer decoded from a number, a numeric string, an empty string or null
+type looseInt int64
+
+func (n *looseInt) UnmarshalJSON(data []byte) error {
+	data = bytes.Trim(data, `"`)
+	if len(data) == 0 || string(data) == "null" {
+		*n = 0
+		return nil
+	}
+	if v, err := strconv.ParseInt(string(data), 10, 64); err == nil {
+		*n = looseInt(v)
+		return nil
+	}
+	v, err := strconv.ParseFloat(string(data), 64)
+	if err != nil {
+		return fmt.Errorf("invalid number %s", data)
+	}
+	*n = looseInt(v)
+	return nil
+}
@@ -0,0 +1,93 @@
+package pkg
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestUserUnmarshal(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    User
+		wantErr bool
+	}{
+		{"id and uuid only", `{"id":1,"uuid":"a"}`, User{ID: 1, UUID: "a"}, false},
+		{"all fields", `{"id":1,"uuid":"a","password":"p","speed_limit":100,"device_limit":3,"expired_at":1700000000}`,
+			User{ID: 1, UUID: "a", Password: "p", SpeedLimit: 100, DeviceLimit: 3, ExpiredAt: 1700000000}, false},
+		{"nulls", `{"id":1,"uuid":"a","password":null,"speed_limit":null,"device_limit":null,"expired_at":null}`,
+			User{ID: 1, UUID: "a"}, false},
+		{"numeric strings", `{"id":1,"uuid":"a","speed_limit":"50","device_limit":"","expired_at":"1700000000"}`,
+			User{ID: 1, UUID: "a", SpeedLimit: 50, ExpiredAt: 1700000000}, false},
+		{"float", `{"id":1,"uuid":"a","speed_limit":12.0}`, User{ID: 1, UUID: "a", SpeedLimit: 12}, false},
+		{"invalid number", `{"id":1,"uuid":"a","speed_limit":"fast"}`, User{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got User
+			err := json.Unmarshal([]byte(tt.body), &got)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Unmarshal() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Fatalf("Expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestUserMarshalOmitsUnset(t *testing.T) {
+	data, err := json.Marshal(User{ID: 1, UUID: "a"})
+	if err != nil {
+		t.Fatalf("Marshal() unexpected error: %v", err)
+	}
+	if string(data) != `{"id":1,"uuid":"a"}` {
+		t.Fatalf("Expected the optional fields to be omitted, got %s", data)
+	}
+}
+
+func TestUserCredential(t *testing.T) {
+	withPassword := User{ID: 1, UUID: "uuid", Password: "secret"}
+	withoutPassword := User{ID: 2, UUID: "uuid"}
+	tests := []struct {
+		nodeType NodeType
+		want     string
+	}{
+		{Trojan, "secret"},
+		{Hysteria2, "secret"},
+		{AnyTLS, "secret"},
+		{"Trojan", "secret"},
+		{VMess, "uuid"},
+		{ShadowSocks, "uuid"},
+		{Hysteria, "uuid"},
+		{Tuic, "uuid"},
+	}
+	for _, tt := range tests {
+		if got := withPassword.Credential(tt.nodeType); got != tt.want {
+			t.Errorf("Credential(%s) = %q, want %q", tt.nodeType, got, tt.want)
+		}
+		if got := withoutPassword.Credential(tt.nodeType); got != "uuid" {
+			t.Errorf("Credential(%s) without password = %q, want the UUID", tt.nodeType, got)
+		}
+	}
+}
+
+func TestUserLimits(t *testing.T) {
+	user := User{SpeedLimit: 8, ExpiredAt: 1700000000}
+	if got := user.SpeedLimitBytes(); got != 1000*1000 {
+		t.Fatalf("Expected 8 Mbps to be 1MB/s, got %d", got)
+	}
+	expiry := time.Unix(1700000000, 0)
+	if !user.ExpiresAt().Equal(expiry) {
+		t.Fatalf("Unexpected expiry %v", user.ExpiresAt())
+	}
+	if user.Expired(expiry.Add(-time.Second)) || !user.Expired(expiry) {
+		t.Fatalf("Expected the user to expire at %v", expiry)
+	}
+
+	var unlimited User
+	if unlimited.SpeedLimitBytes() != 0 || !unlimited.ExpiresAt().IsZero() || unlimited.Expired(time.Now()) {
+		t.Fatalf("Expected zero fields to mean no limit")
+	}
+}
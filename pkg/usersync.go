@@ -0,0 +1,123 @@
+package pkg
+
+import (
+	"maps"
+	"slices"
+	"sync"
+)
+
+// UserSet users of a node kept in sync with the panel by Client.SyncUsers.
+// It is safe for concurrent use, readers see each sync applied as a whole.
+type UserSet struct {
+	mu       sync.RWMutex
+	revision int64
+	users    map[int]User
+}
+
+// NewUserSet create an empty set, its first sync fetches the full list
+func NewUserSet() *UserSet {
+	return &UserSet{users: make(map[int]User)}
+}
+
+// Revision of the panel user list the set reflects, 0 before the first delta sync
+func (s *UserSet) Revision() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.revision
+}
+
+// Len number of users
+func (s *UserSet) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.users)
+}
+
+// Get the user with id
+func (s *UserSet) Get(id int) (User, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	user, ok := s.users[id]
+	return user, ok
+}
+
+// Users copy of the users ordered by ID
+func (s *UserSet) Users() []User {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	users := slices.Collect(maps.Values(s.users))
+	slices.SortFunc(users, func(a, b User) int { return a.ID - b.ID })
+	return users
+}
+
+// UserChanges what a sync changed in a UserSet
+type UserChanges struct {
+	Revision int64
+	// Full the whole list was fetched, the changes are computed against the previous set
+	Full    bool
+	Added   []User
+	Updated []User
+	Removed []User
+}
+
+// Empty report whether the sync changed nothing
+func (c UserChanges) Empty() bool {
+	return len(c.Added) == 0 && len(c.Updated) == 0 && len(c.Removed) == 0
+}
+
+// applyDelta apply the changes sent by the panel. Updates of unknown users
+// count as additions and removals of unknown users are ignored.
+func (s *UserSet) applyDelta(delta *UsersDelta) UserChanges {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changes := UserChanges{Revision: delta.Revision}
+	for _, user := range slices.Concat(delta.Added, delta.Updated) {
+		old, ok := s.users[user.ID]
+		switch {
+		case !ok:
+			changes.Added = append(changes.Added, user)
+		case old != user:
+			changes.Updated = append(changes.Updated, user)
+		default:
+			continue
+		}
+		s.users[user.ID] = user
+	}
+	for _, id := range delta.Removed {
+		if old, ok := s.users[id]; ok {
+			changes.Removed = append(changes.Removed, old)
+			delete(s.users, id)
+		}
+	}
+	s.revision = delta.Revision
+	return changes
+}
+
+// replace the set with a full list
+func (s *UserSet) replace(revision int64, list []User) UserChanges {
+	users := make(map[int]User, len(list))
+	for _, user := range list {
+		users[user.ID] = user
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changes := UserChanges{Revision: revision, Full: true}
+	for id, user := range users {
+		old, ok := s.users[id]
+		switch {
+		case !ok:
+			changes.Added = append(changes.Added, user)
+		case old != user:
+			changes.Updated = append(changes.Updated, user)
+		}
+	}
+	for id, old := range s.users {
+		if _, ok := users[id]; !ok {
+			changes.Removed = append(changes.Removed, old)
+		}
+	}
+	s.users = users
+	s.revision = revision
+	return changes
+}
@@ -0,0 +1,207 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// deltaPanel mock panel keeping a revisioned user list
+type deltaPanel struct {
+	mu       sync.Mutex
+	revision int64
+	users    map[int]User
+	// history changes by revision, revisions before oldest are expired
+	history map[int64]UsersDelta
+	oldest  int64
+	// requested revisions, in order
+	requested []int64
+}
+
+func newDeltaPanel(users ...User) *deltaPanel {
+	p := &deltaPanel{revision: 1, users: map[int]User{}, history: map[int64]UsersDelta{}, oldest: 1}
+	for _, u := range users {
+		p.users[u.ID] = u
+	}
+	return p
+}
+
+// change record a new revision
+func (p *deltaPanel) change(added []User, removed []int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.revision++
+	for _, u := range added {
+		p.users[u.ID] = u
+	}
+	for _, id := range removed {
+		delete(p.users, id)
+	}
+	p.history[p.revision] = UsersDelta{Added: added, Removed: removed}
+}
+
+func (p *deltaPanel) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if !strings.HasSuffix(r.URL.Path, "/users/delta") {
+		http.NotFound(w, r)
+		return
+	}
+	since, _ := strconv.ParseInt(r.URL.Query().Get("revision"), 10, 64)
+	p.requested = append(p.requested, since)
+
+	delta := UsersDelta{Revision: p.revision}
+	switch {
+	case since == 0:
+		delta.Full = true
+		for _, u := range p.users {
+			delta.Users = append(delta.Users, u)
+		}
+	case since < p.oldest:
+		w.WriteHeader(http.StatusGone)
+		_, _ = w.Write([]byte(`{"message":"revision too old","code":"revision_expired"}`))
+		return
+	default:
+		for rev := since + 1; rev <= p.revision; rev++ {
+			delta.Added = append(delta.Added, p.history[rev].Added...)
+			delta.Removed = append(delta.Removed, p.history[rev].Removed...)
+		}
+	}
+	_ = json.NewEncoder(w).Encode(RespUsersDelta{Data: &delta})
+}
+
+func TestSyncUsersDelta(t *testing.T) {
+	panel := newDeltaPanel(User{ID: 1, UUID: "a"}, User{ID: 2, UUID: "b"})
+	server := httptest.NewServer(panel)
+	t.Cleanup(server.Close)
+	client := newTestClient(t, server.URL)
+	ctx := context.Background()
+	set := NewUserSet()
+
+	changes, err := client.SyncUsers(ctx, "test-register-id", Trojan, set)
+	if err != nil {
+		t.Fatalf("SyncUsers() unexpected error: %v", err)
+	}
+	if !changes.Full || len(changes.Added) != 2 || set.Len() != 2 || set.Revision() != 1 {
+		t.Fatalf("Expected a full first sync, got %+v", changes)
+	}
+
+	panel.change([]User{{ID: 3, UUID: "c"}, {ID: 1, UUID: "a2"}}, []int{2})
+	changes, err = client.SyncUsers(ctx, "test-register-id", Trojan, set)
+	if err != nil {
+		t.Fatalf("SyncUsers() unexpected error: %v", err)
+	}
+	if changes.Full || changes.Revision != 2 {
+		t.Fatalf("Expected a delta sync to revision 2, got %+v", changes)
+	}
+	if len(changes.Added) != 1 || changes.Added[0].ID != 3 ||
+		len(changes.Updated) != 1 || changes.Updated[0].UUID != "a2" ||
+		len(changes.Removed) != 1 || changes.Removed[0].UUID != "b" {
+		t.Fatalf("Unexpected changes %+v", changes)
+	}
+	if got := set.Users(); len(got) != 2 || got[0] != (User{ID: 1, UUID: "a2"}) || got[1].ID != 3 {
+		t.Fatalf("Unexpected users %v", got)
+	}
+
+	changes, err = client.SyncUsers(ctx, "test-register-id", Trojan, set)
+	if err != nil || !changes.Empty() {
+		t.Fatalf("Expected no changes, got %+v %v", changes, err)
+	}
+	if want := []int64{0, 1, 2}; len(panel.requested) != 3 || panel.requested[1] != want[1] || panel.requested[2] != want[2] {
+		t.Fatalf("Expected revisions %v to be requested, got %v", want, panel.requested)
+	}
+}
+
+func TestSyncUsersExpiredRevision(t *testing.T) {
+	panel := newDeltaPanel(User{ID: 1, UUID: "a"})
+	server := httptest.NewServer(panel)
+	t.Cleanup(server.Close)
+	client := newTestClient(t, server.URL)
+	ctx := context.Background()
+	set := NewUserSet()
+
+	if _, err := client.SyncUsers(ctx, "test-register-id", Trojan, set); err != nil {
+		t.Fatalf("SyncUsers() unexpected error: %v", err)
+	}
+	panel.change([]User{{ID: 2, UUID: "b"}}, []int{1})
+	panel.mu.Lock()
+	panel.oldest = 2 // compacted history
+	panel.mu.Unlock()
+
+	changes, err := client.SyncUsers(ctx, "test-register-id", Trojan, set)
+	if err != nil {
+		t.Fatalf("SyncUsers() unexpected error: %v", err)
+	}
+	if !changes.Full || len(changes.Added) != 1 || len(changes.Removed) != 1 || set.Revision() != 2 {
+		t.Fatalf("Expected a full fallback with computed changes, got %+v", changes)
+	}
+	if got := panel.requested; len(got) != 3 || got[1] != 1 || got[2] != 0 {
+		t.Fatalf("Expected an expired delta then a full fetch, got %v", got)
+	}
+}
+
+func TestSyncUsersWithoutDeltaEndpoint(t *testing.T) {
+	var deltaHits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/users/delta") {
+			deltaHits.Add(1)
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte(`{"data":[{"id":1,"uuid":"a"}]}`))
+	}))
+	t.Cleanup(server.Close)
+	client := newTestClient(t, server.URL)
+	ctx := context.Background()
+
+	// an ETag left by another caller must not hide the list from an empty set
+	if _, err := client.RawUsers(ctx, "test-register-id", Trojan); err != nil {
+		t.Fatalf("RawUsers() unexpected error: %v", err)
+	}
+	set := NewUserSet()
+	changes, err := client.SyncUsers(ctx, "test-register-id", Trojan, set)
+	if err != nil || len(changes.Added) != 1 || set.Len() != 1 {
+		t.Fatalf("Expected the full list, got %+v %v", changes, err)
+	}
+
+	changes, err = client.SyncUsers(ctx, "test-register-id", Trojan, set)
+	if err != nil || !changes.Empty() || set.Len() != 1 {
+		t.Fatalf("Expected no changes on 304, got %+v %v", changes, err)
+	}
+	if deltaHits.Load() != 1 {
+		t.Fatalf("Expected the delta endpoint asked once, got %d", deltaHits.Load())
+	}
+
+	// asked again once the endpoint may have been deployed
+	client.bulkMissing.Store(usersDeltaPath(Trojan), time.Now().Add(-bulkRetryAfter))
+	if _, err := client.SyncUsers(ctx, "test-register-id", Trojan, set); err != nil {
+		t.Fatalf("SyncUsers() unexpected error: %v", err)
+	}
+	if deltaHits.Load() != 2 {
+		t.Fatalf("Expected the delta endpoint asked again, got %d", deltaHits.Load())
+	}
+}
+
+func TestSyncUsersNodeNotFound(t *testing.T) {
+	server := newTestServer(t, 404, map[string]any{"message": "node not found", "code": CodeNodeNotFound})
+	client := newTestClient(t, server.URL)
+
+	_, err := client.SyncUsers(context.Background(), "test-register-id", Trojan, NewUserSet())
+	if !errors.Is(err, ErrNodeNotFound) {
+		t.Fatalf("Expected the node error, not a fallback, got %v", err)
+	}
+}